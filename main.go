@@ -1,20 +1,51 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build/constraint"
+	"go/format"
+	"go/importer"
 	"go/parser"
+	"go/scanner"
 	"go/token"
+	"go/types"
+	"html"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"iter"
+	"math"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type FuncInfo struct {
@@ -27,20 +58,303 @@ type FuncInfo struct {
 	StartLine int
 	EndLine   int
 	LineCount int
+	// LineDirective is the "file:line" a //line directive maps the
+	// declaration to (e.g. "gen/parser.y:100"), or "" when none applies
+	// (Go only). StartLine and EndLine always count lines in File as stored.
+	LineDirective string
+	// Build is the build constraint of the declaring file (e.g. "linux"),
+	// or "" when the file is unconstrained.
+	Build string
+	// BodyHash fingerprints the normalized function body (braces included,
+	// declaration line excluded), or is "" for functions without a body.
+	BodyHash string
+	// ParamTypes and ResultTypes list one rendered type per parameter or
+	// result, in declaration order ("a, b int" yields two entries). They are
+	// nil for languages whose extractor does not provide them.
+	ParamTypes  []string
+	ResultTypes []string
+	// TypeParams lists the rendered constraint of each type parameter of a
+	// generic function, in declaration order ("[K, V comparable]" yields two
+	// entries). It is nil for non-generic functions.
+	TypeParams []string
+	// Doc is the text of the function's doc comment, without comment
+	// markers, or "" when it has none (Go only).
+	Doc string
+	// Closures, Goroutines and Defers count the func literals, go statements
+	// and defer statements inside the body (Go only).
+	Closures   int
+	Goroutines int
+	Defers     int
+	// MaxDepth is the deepest block nesting inside the body: 0 for a flat
+	// body, 1 inside an if/for/case, and so on (Go only).
+	MaxDepth int
+	// Complexity is the cyclomatic complexity of the body, closures
+	// included: 1 plus one per if, for, range, non-default case and &&/||
+	// (Go only; 0 without a body).
+	Complexity int
+	// Ordinal numbers functions that may be declared several times, init
+	// and blank (_) functions, by their order within File, starting at 1.
+	// It is 0 for every other function.
+	Ordinal int
+	// Duplicate numbers declarations that collide with an earlier one of
+	// the same package, receiver, name and build (a malformed tree),
+	// starting at 1; see addFunc. It is 0 otherwise. TS overloads are merged
+	// before this, see mergeTsOverloads.
+	Duplicate int
+	// Calls lists the distinct callees named in the body, sorted, as written
+	// ("helper", "db.Commit", "c.Do"); resolution is purely by name and type
+	// conversions are left out. Recursive is set when the function calls
+	// itself directly (Go only).
+	Calls     []string
+	Recursive bool
+	// DebtMarkers counts TODO, FIXME and XXX markers in comments inside the
+	// body, by marker; nil when there are none (Go only).
+	DebtMarkers map[string]int
+	// ErrorExits counts the error-handling and process-exit constructs in
+	// the body by errorExitKinds entry; nil when there are none (Go only).
+	ErrorExits map[string]int
+	// ErrorWraps counts how the body builds errors, by errorWrapKinds
+	// entry; nil when it builds none (Go only).
+	ErrorWraps map[string]int
+	// Stub is set when the body is only a placeholder: "empty", "panic" (a
+	// single panic call) or "return" (a single return of zero values such
+	// as nil, 0 or ""). It is "" otherwise and for functions without a body
+	// (Go only).
+	Stub string
 }
 
 type FuncKey struct {
 	Package  string
 	Receiver string
 	Name     string
+	// Build keeps platform-specific variants of the same function
+	// (foo_linux.go vs foo_windows.go) from colliding in a FuncSet.
+	Build string
+	// File and Ordinal are only set for init and blank functions, which a
+	// package may declare any number of times (see FuncInfo.Ordinal). File
+	// and Duplicate are only set for colliding declarations.
+	File      string
+	Ordinal   int
+	Duplicate int
+}
+
+// CollectOptions controls which files and functions are collected from a ref.
+type CollectOptions struct {
+	OnlyExported bool
+	// ExportedExcept holds package substrings where OnlyExported does not
+	// apply, so unexported functions are still collected there.
+	ExportedExcept []string
+	PackageFilter  string
+	// PublicSurface collects only exported functions and all methods,
+	// exported or not, of exported types, along with exported types only;
+	// see onPublicSurface.
+	PublicSurface bool
+	// ExcludeNames holds path.Match patterns; functions whose name (not
+	// receiver) matches any of them are not collected.
+	ExcludeNames []string
+	// IncludePaths, when non-empty, holds cleaned slash-separated directory
+	// prefixes; source files outside all of them are neither read nor
+	// parsed. go.mod files are always read.
+	IncludePaths []string
+	// Tags, when non-empty, enables build-constraint evaluation: files whose
+	// constraint is not satisfied by Tags (plus the target GOOS/GOARCH) are
+	// skipped entirely. When empty, every file is collected.
+	Tags []string
+	// GofmtBodies hashes bodies as they read after running gofmt over the
+	// whole file, so purely cosmetic reformatting keeps the same BodyHash.
+	GofmtBodies bool
+	// Jobs is how many files are read concurrently; 0 means one per CPU.
+	Jobs int
+	// NoBody skips everything derived from function bodies: BodyHash, the
+	// body metrics, calls and debt markers stay empty.
+	NoBody bool
+	// Normalize selects what body hashes ignore.
+	Normalize BodyNormalization
+	// TypeCheck type-checks every package with go/types and renders
+	// signatures from the resolved types: imported types by full import
+	// path, aliases resolved. Functions whose types can't be resolved keep
+	// their AST rendering.
+	TypeCheck bool
+}
+
+// BodyNormalization selects what normalizeBody ignores on top of line
+// endings, trailing whitespace and blank lines around the body.
+type BodyNormalization struct {
+	// Comments drops comment-only lines: "//" lines and lines of "/* */"
+	// blocks that start a line. Comments after code are kept.
+	Comments bool
+	// BlankLines drops blank lines inside the body.
+	BlankLines bool
+	// Indent strips leading whitespace from every line.
+	Indent bool
+	// ImportRenames maps old package qualifiers to new ones (--rename-import):
+	// "old.Foo" reads as "new.Foo", so bodies that only follow a package
+	// move hash the same.
+	ImportRenames map[string]string
+}
+
+// any reports whether any normalization beyond the default is selected.
+func (n BodyNormalization) any() bool {
+	return n.Comments || n.BlankLines || n.Indent || len(n.ImportRenames) > 0
+}
+
+// DiffOptions controls how diffFuncs decides that a function changed.
+type DiffOptions struct {
+	// CompareBodies treats a function as changed only when its signature,
+	// file or BodyHash differ, instead of whenever its line range moved.
+	// Functions without a hash on either side fall back to line ranges.
+	CompareBodies bool
+}
+
+// keepUnexported reports whether unexported functions of pkgPath are
+// collected: always without OnlyExported, and in --exported-except packages.
+func (o CollectOptions) keepUnexported(pkgPath string) bool {
+	if !o.OnlyExported {
+		return true
+	}
+	for _, sub := range o.ExportedExcept {
+		if strings.Contains(pkgPath, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// onPublicSurface reports whether a function belongs to what --public-surface
+// keeps: an exported plain function, or any method of an exported type. An
+// unexported method can still decide whether the type satisfies an
+// interface, so it counts.
+func onPublicSurface(exported bool, receiver string) bool {
+	if receiver == "" {
+		return exported
+	}
+	return token.IsExported(receiverBaseType(receiver))
+}
+
+// excludedName reports whether a function called name matches an
+// --exclude-name pattern.
+func (o CollectOptions) excludedName(name string) bool {
+	for _, pattern := range o.ExcludeNames {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// includedPath reports whether file lies under one of the --include-paths
+// directories, or whether no directories were given.
+func (o CollectOptions) includedPath(file string) bool {
+	if len(o.IncludePaths) == 0 {
+		return true
+	}
+	for _, dir := range o.IncludePaths {
+		if dir == "." || file == dir || strings.HasPrefix(file, dir+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 type FuncSet map[FuncKey]*FuncInfo
 
+// TypeInfo describes a named struct or interface type declared at package
+// level (Go only). For interfaces, Fields holds the method set: methods with
+// their signature as Type, and embedded interfaces as Embedded fields.
+type TypeInfo struct {
+	Package   string
+	File      string
+	Name      string
+	Build     string
+	StartLine int
+	EndLine   int
+	Interface bool
+	Fields    []FieldInfo
+}
+
+// FieldInfo is one struct field or interface method. Embedded fields are
+// named after their type ("Mutex" for sync.Mutex), and "A, B int" yields two
+// fields. Interface methods carry their signature without parameter names,
+// e.g. "([]byte) (int, error)", so renaming a parameter is not a change.
+type FieldInfo struct {
+	Name     string
+	Type     string
+	Tag      string // unquoted, e.g. json:"id,omitempty"
+	Embedded bool
+}
+
+type TypeKey struct {
+	Package string
+	Name    string
+	Build   string
+}
+
+type TypeSet map[TypeKey]*TypeInfo
+
+func typeKeyOf(t *TypeInfo) TypeKey {
+	return TypeKey{Package: t.Package, Name: t.Name, Build: t.Build}
+}
+
+func typeLess(a, b *TypeInfo) bool {
+	if a.Package != b.Package {
+		return a.Package < b.Package
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.Build < b.Build
+}
+
+// ParseFailure records a file that could not be parsed at a ref; its
+// functions are missing from that side of the diff.
+type ParseFailure struct {
+	Ref  string
+	File string
+	Err  string
+}
+
 type PackageStats struct {
 	New     int
 	Removed int
 	Changed int
+	// LOCAdded sums the line counts of new functions and the growth of
+	// changed ones; LOCRemoved sums removed functions and the shrinkage of
+	// changed ones.
+	LOCAdded   int
+	LOCRemoved int
+}
+
+func (s *PackageStats) addNew(f *FuncInfo) {
+	s.New++
+	s.LOCAdded += f.LineCount
+}
+
+func (s *PackageStats) addRemoved(f *FuncInfo) {
+	s.Removed++
+	s.LOCRemoved += f.LineCount
+}
+
+// addChanged counts a changed function, given as its from and to sides.
+func (s *PackageStats) addChanged(from, to *FuncInfo) {
+	s.Changed++
+	if d := from.LineCount - to.LineCount; d > 0 {
+		s.LOCAdded += d
+	} else {
+		s.LOCRemoved -= d
+	}
+}
+
+// NetLOC is how many lines the package grew by (negative if it shrank).
+func (s *PackageStats) NetLOC() int {
+	return s.LOCAdded - s.LOCRemoved
+}
+
+// formatNetLOC renders a NetLOC value with an explicit sign.
+func formatNetLOC(n int) string {
+	if n > 0 {
+		return fmt.Sprintf("+%d", n)
+	}
+	return strconv.Itoa(n)
 }
 
 type TsExtractedMethod struct {
@@ -52,429 +366,7254 @@ type TsExtractedMethod struct {
 	StartLine     int    `json:"startLine"`
 	EndLine       int    `json:"endLine"`
 	LineCount     int    `json:"lineCount"`
+	Body          string `json:"body"`
 }
 
 func main() {
 	dirFlag := flag.String("dir", "", "Path to the git repository (optional). If empty, use current working directory.")
+	gitDir := flag.String("git-dir", "", "Path to the .git directory or a bare repository; passed to every git invocation")
+	workTree := flag.String("work-tree", "", "Path to the working tree; passed to every git invocation together with --git-dir")
 	fromRef := flag.String("from", "development", "Git ref to compare from (e.g. branch, tag, commit)")
 	toRef := flag.String("to", "master", "Git ref to compare to (e.g. branch, tag, commit)")
+	commit := flag.String("commit", "", "Diff a single commit against its first parent (sets --from=<commit> and --to=<commit>^); a root commit is diffed against an empty tree")
+	fromDir := flag.String("from-dir", "", "Read --from from the git repository at this path instead of the current one")
+	toDir := flag.String("to-dir", "", "Read --to from the git repository at this path instead of the current one")
+	fromRepo := flag.String("from-repo", "", "Read --from from this remote repository URL, cloned into (and fetched from) a cache directory")
+	toRepo := flag.String("to-repo", "", "Read --to from this remote repository URL, cloned into (and fetched from) a cache directory")
+	toArchive := flag.String("to-archive", "", "Read the to side from this source archive (.tar, .tar.gz, .tgz or .zip) instead of --to")
 	onlyExported := flag.Bool("only-exported", false, "Include only exported (public) functions and methods")
+	publicSurface := flag.Bool("public-surface", false, "Include only exported functions and every method, exported or not, of exported types (--lang go only)")
+	var exportedExcept listFlag
+	flag.Var(&exportedExcept, "exported-except", "With --only-exported, still include unexported functions of packages matching this substring (repeatable, or comma-separated)")
+	var excludeNames listFlag
+	flag.Var(&excludeNames, "exclude-name", "Skip functions and methods whose name matches this glob, e.g. String or Proto* (repeatable, or comma-separated)")
+	var includePaths listFlag
+	flag.Var(&includePaths, "include-paths", "Only read and parse files under these directories, relative to the repo root, e.g. cmd,internal/api (repeatable, or comma-separated)")
+	fromPath := flag.String("from-path", "", "With --to-path, compare the code under this directory of --from against the code under --to-path of --to (e.g. v2 vs v1 of an API kept in-tree)")
+	toPath := flag.String("to-path", "", "With --from-path, the directory of --to to compare against; file and package paths of each side are made relative to its directory so they line up")
+	var only listFlag
+	flag.Var(&only, "only", "Restrict the report to these functions, as file.go:FuncName or file.go:line (repeatable, or comma-separated)")
+	var onlyReceivers listFlag
+	flag.Var(&onlyReceivers, "only-receivers", "Restrict the report to methods on these receivers, e.g. Client,*Client (repeatable, or comma-separated)")
+	includeConstructors := flag.Bool("include-constructors", false, "With --only-receivers, also keep functions that return one of the receiver types")
+	mermaid := flag.Bool("mermaid", false, "Add Mermaid charts of the new/removed/changed counts and per-package churn after the Markdown summary")
+	relativeTo := flag.String("relative-to", "", "Report file paths relative to this directory (relative to the repo root) instead of the repo root")
+	relativeOutside := flag.String("relative-outside", "drop", "With --relative-to, what to do with functions outside the directory: drop, or keep (shown with ../)")
 	summaryOnly := flag.Bool("summary-only", false, "Show only summary and package-level stats (no detailed function lists)")
+	noSummary := flag.Bool("no-summary", false, "Leave out the title, summary and package-level stats of the Markdown report, printing only the detail sections")
 	pkgFilter := flag.String("package", "", "Optional substring filter for package path (e.g. 'internal/' or 'pkg/foo')")
+	outFile := flag.String("out", "", "Write the report to this file (creating parent directories) instead of stdout")
 	outDir := flag.String("out-dir", "", "If set, write each changed function report as its own Markdown file in this directory")
 	lang := flag.String("lang", "go", "Language mode: go or ts")
+	tags := flag.String("tags", "", "Comma-separated build tags; if set, Go files whose build constraints are not satisfied are skipped")
+	typeCheck := flag.Bool("typecheck", false, "Type-check each ref's packages with go/types so signatures use fully-qualified types with aliases resolved; falls back to the AST rendering where that fails (--lang go only)")
+	var formats formatFlag
+	flag.Var(&formats, "format", "Output format: markdown (default), markdown-collapsible, term, junit, patch, html, jsonl, csv, tsv, slack or gitlab-codequality; repeat as name:path to write several formats in one run")
+	tsvHeader := flag.Bool("header", false, "With --format=tsv, start with a line naming the columns")
+	csvKind := flag.String("csv-kind", "functions", "With --format=csv: functions (one row per function change), packages (one row per package), or both (functions.csv and packages.csv in --out-dir)")
+	prevTag := flag.Bool("prev-tag", false, "Compare the release --to (a semver tag) against the tag immediately preceding it, which becomes the base; --from is ignored")
+	thresholdLOC := flag.Int("threshold-loc", 0, "Highlight changed functions whose line count changed by more than N lines (0 disables)")
+	requireIface := flag.String("require-interface", "", "Interfaces to watch, as Name=Method,Method;Name=Method (e.g. 'io.Writer=Write;store.Repo=Get,Put'); types that had all methods and changed one are flagged")
+	apiCheck := flag.Bool("api-check", false, "Report only exported API changes, split into incompatible and compatible as apidiff does, and exit with status 3 if any are incompatible")
+	exitCount := flag.Bool("exit-count", false, "Exit with a status derived from the number of changed plus removed functions: 0 for none, otherwise 3+N capped at 125")
+	failOn := flag.String("fail-on", "", "Comma-separated conditions that make funcdiff exit with status 3: threshold, removed, signature")
+	groupBy := flag.String("group-by", "package", "Group report listings by: package, file or change-kind")
+	onlyChanged := flag.Bool("only-changed", false, "Omit new and removed functions from the Markdown report and show only changed ones")
+	headOnly := flag.Bool("head-only", false, "Report only the new functions of --from, with their bodies (or, with --out-dir, one file per function)")
+	dryRun := flag.Bool("dry-run", false, "With --out-dir, list the per-function files that would be written without creating anything")
+	filenameTemplate := flag.String("filename-template", "", "text/template for per-function file names under --out-dir, with {{.Package}} {{.File}} {{.Receiver}} {{.Name}}; '/' creates subdirectories")
+	maxBodyBytes := flag.Int("max-body-bytes", 0, "Truncate function bodies in per-function reports beyond N bytes (0 = unlimited)")
+	noBody := flag.Bool("no-body", false, "Skip function bodies: no body hashes or metrics, and per-function reports show signatures only")
+	gofmtBodies := flag.Bool("compare-bodies-with-gofmt", false, "Compare function bodies after gofmt instead of by line range, so reformatting alone is not a change")
+	ignoreComments := flag.Bool("ignore-comments", false, "Compare function bodies by hash, ignoring comment-only lines")
+	ignoreBlankLines := flag.Bool("ignore-blank-lines", false, "Compare function bodies by hash, ignoring blank lines inside them")
+	ignoreIndent := flag.Bool("ignore-leading-indent", false, "Compare function bodies by hash, ignoring leading whitespace on every line")
+	var renameImports listFlag
+	flag.Var(&renameImports, "rename-import", "Compare function bodies by hash, reading package qualifier old as new, e.g. oldpkg=newpkg, so bodies that only follow a package move are unchanged (repeatable, or comma-separated)")
+	explain := flag.Bool("explain", false, "Annotate each changed function with why it was flagged (signature, file, start/end line, body)")
+	repoURL := flag.String("repo-url", "", "Link function locations in Markdown reports to this repository's web UI, e.g. https://github.com/org/repo, or auto to derive it from the origin remote")
+	repoURLStyle := flag.String("repo-url-style", "auto", "Line anchor style of --repo-url: github, gitlab, or auto (gitlab when the host name contains gitlab)")
+	canonical := flag.Bool("canonical", false, "Make the output depend only on the inputs, for golden files and reproducible artifacts: absolute dates instead of relative ones, no terminal colors")
+	blame := flag.Bool("blame", false, "Annotate each changed function with the author and commit that last touched its lines in --to (runs git blame, --jobs at a time)")
+	jobs := flag.Int("jobs", 0, "Number of files read concurrently (git show processes); 0 means one per CPU")
+	cacheDir := flag.String("cache-dir", "", "Directory for cached per-ref function sets (default: funcdiff/funcsets under the user cache directory)")
+	noCache := flag.Bool("no-cache", false, "Collect every ref afresh, neither reading nor writing the cache")
+	maxFunctions := flag.Int("max-functions", 0, "List at most this many functions per section of the Markdown and HTML reports (0: no limit); totals still count all")
+	sortBy := flag.String("sort", "name", "Order of changed functions: name (package, file, receiver, name) or impact (highest impact score first)")
+	slackTop := flag.Int("slack-top", 10, "With --format=slack, list at most this many changed and removed functions each")
+	slackMaxChars := flag.Int("slack-max-chars", 3000, "With --format=slack, keep the whole message within this many characters")
+	theme := flag.String("theme", "light", "Color theme of --format=html: light or dark")
+	htmlFragment := flag.Bool("html-fragment", false, "With --format=html, write only the report's <div> (with its scoped styles) for embedding in an existing page")
+	impactWeightsFlag := flag.String("impact-weights", "", "Impact score weights as key=value pairs, e.g. signature=10,loc=0.1,complexity=1,exported=2 (omitted keys keep their defaults)")
+	strict := flag.Bool("strict", false, "Treat any file that fails to parse as a fatal error")
+	worktree := flag.Bool("worktree", false, "Read the from side from the working tree (including uncommitted changes) instead of --from")
+	saveSnapshotPath := flag.String("save-snapshot", "", "Write the to side's functions to this JSON snapshot file")
+	baseline := flag.String("baseline", "", "Load the to side from a JSON snapshot written by --save-snapshot instead of --to")
+	watch := flag.Bool("watch", false, "Watch the working tree and reprint a terminal summary against --to whenever source files change")
+	emitHash := flag.Bool("emit-hash", false, "Print a stable SHA-256 of the diff to stderr, e.g. to skip re-posting identical reports")
+	emitFuzzStubs := flag.Bool("emit-fuzz-stubs", false, "Write a FuzzXxx test stub into --out-dir for each changed exported function whose parameters are all fuzzable (Go only)")
+	fetchDeepen := flag.Int("fetch-deepen", 0, "In a shallow clone, run 'git fetch --deepen=N' when --from or --to is not available locally, then retry")
+	gitTimeoutFlag := flag.Duration("git-timeout", 60*time.Second, "Abort any single git invocation that runs longer than this (0 = no limit)")
+	detectPackageMovesFlag := flag.Bool("detect-package-moves", false, "Report a removed function and a new one in another package with the same receiver, name, signature and body as moved between packages instead of churn")
+	detectMethodConversions := flag.Bool("detect-method-conversions", false, "Report a removed function and a new method of the same package and name (or the reverse) with similar bodies as a function/method conversion instead of churn")
+	ignoreReceiverRename := flag.Bool("ignore-receiver-rename", false, "Report removed and new methods with the same name, signature and body on a renamed receiver type as a receiver rename instead of churn")
+	detectMovesGlobal := flag.Bool("detect-moves-global", false, "Pair new and removed functions with identical bodies across all packages as possible relocations/duplicates")
+	flag.BoolVar(&logJSON, "log-json", false, "Write warnings and errors to stderr as JSON lines with level, msg, file and ref fields")
 	flag.Parse()
 
-	// If --dir is provided, change working directory first
-	if *dirFlag != "" {
-		if err := os.Chdir(*dirFlag); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: failed to change directory to %s: %v\n", *dirFlag, err)
+	gitTimeout = *gitTimeoutFlag
+	// Ctrl-C cancels running git commands and ends --watch cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	failConditions, err := parseFailOn(*failOn)
+	if err != nil {
+		logf("error", "", "", "%v", err)
+		os.Exit(1)
+	}
+
+	if len(formats) == 0 {
+		formats = formatFlag{{Name: "markdown"}}
+	}
+	toOut := 0
+	for _, f := range formats {
+		if !slices.Contains(knownFormats, f.Name) {
+			logf("error", "", "", "unsupported --format %q (use %s)", f.Name, strings.Join(knownFormats, ", "))
 			os.Exit(1)
 		}
+		if f.Path == "" {
+			toOut++
+		}
+	}
+	if toOut > 1 {
+		logf("error", "", "", "only one --format can go to --out or stdout; give the others a path, as in --format=jsonl:report.jsonl")
+		os.Exit(1)
 	}
 
-	repoRoot, err := gitRoot()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	if *noBody && (*gofmtBodies || formats.has("patch") || formats.has("html")) {
+		logf("error", "", "", "--no-body cannot be combined with --compare-bodies-with-gofmt, --format=patch or --format=html")
 		os.Exit(1)
 	}
+	if *noBody && (*ignoreComments || *ignoreBlankLines || *ignoreIndent || len(renameImports) > 0) {
+		logf("error", "", "", "--no-body cannot be combined with --ignore-comments, --ignore-blank-lines, --ignore-leading-indent or --rename-import")
+		os.Exit(1)
+	}
+	var importRenames map[string]string
+	for _, r := range renameImports {
+		oldPkg, newPkg, ok := strings.Cut(r, "=")
+		if !ok || !token.IsIdentifier(oldPkg) || !token.IsIdentifier(newPkg) {
+			logf("error", "", "", "invalid --rename-import %q: use old=new with package names as written in code", r)
+			os.Exit(1)
+		}
+		if importRenames == nil {
+			importRenames = make(map[string]string)
+		}
+		importRenames[oldPkg] = newPkg
+	}
 
-	var (
-		fromFuncs FuncSet
-		toFuncs   FuncSet
-	)
+	for _, side := range []struct {
+		name      string
+		dir, repo string
+	}{{"from", *fromDir, *fromRepo}, {"to", *toDir, *toRepo}} {
+		if side.dir != "" && side.repo != "" {
+			logf("error", "", "", "--%s-dir and --%s-repo are mutually exclusive", side.name, side.name)
+			os.Exit(1)
+		}
+		if (side.dir != "" || side.repo != "") && (*gitDir != "" || *workTree != "") {
+			logf("error", "", "", "--%s-dir/--%s-repo cannot be combined with --git-dir or --work-tree", side.name, side.name)
+			os.Exit(1)
+		}
+	}
+	if *toArchive != "" && (*toDir != "" || *toRepo != "" || *baseline != "") {
+		logf("error", "", "", "--to-archive cannot be combined with --to-dir, --to-repo or --baseline")
+		os.Exit(1)
+	}
+	if (*fromDir != "" || *fromRepo != "") && (*worktree || *watch) {
+		logf("error", "", "", "--worktree and --watch read the current repository; drop --from-dir/--from-repo")
+		os.Exit(1)
+	}
 
-	
+	if *relativeOutside != "drop" && *relativeOutside != "keep" {
+		logf("error", "", "", "unsupported --relative-outside %q (use drop or keep)", *relativeOutside)
+		os.Exit(1)
+	}
 
-	switch *lang {
-	case "go":
-		fromFuncs, err = collectGoFuncs(*fromRef, repoRoot, *onlyExported, *pkgFilter)
-		if err != nil { 
-			fmt.Fprintf(os.Stderr, "Error collecting functions from %s: %v\n", *fromRef, err)
+	if *maxFunctions < 0 {
+		logf("error", "", "", "--max-functions must not be negative")
+		os.Exit(1)
+	}
+	if *slackTop < 0 || *slackMaxChars <= 0 {
+		logf("error", "", "", "--slack-top must not be negative and --slack-max-chars must be positive")
+		os.Exit(1)
+	}
+
+	switch *csvKind {
+	case "functions", "packages":
+	case "both":
+		if formats.has("csv") && (*outDir == "" || formats.dest("csv", *outFile) != "") {
+			logf("error", "", "", "--csv-kind=both writes functions.csv and packages.csv into --out-dir; set --out-dir and give --format=csv no path or --out")
+			os.Exit(1)
 		}
-		toFuncs, err = collectGoFuncs(*toRef, repoRoot, *onlyExported, *pkgFilter)
-		if err != nil { 
-			fmt.Fprintf(os.Stderr, "Error collecting functions from %s: %v\n", *toRef, err)
-		 }
+	default:
+		logf("error", "", "", "unsupported --csv-kind %q (use functions, packages or both)", *csvKind)
+		os.Exit(1)
+	}
+	switch *repoURLStyle {
+	case "auto", "github", "gitlab":
+	default:
+		logf("error", "", "", "unsupported --repo-url-style %q (use auto, github or gitlab)", *repoURLStyle)
+		os.Exit(1)
+	}
+	if *noSummary && *summaryOnly {
+		logf("error", "", "", "--no-summary and --summary-only are opposites; pass at most one")
+		os.Exit(1)
+	}
+	if *headOnly && (*onlyChanged || *summaryOnly || len(formats) > 1 || formats[0].Name != "markdown") {
+		logf("error", "", "", "--head-only writes a Markdown list of new functions; drop --only-changed, --summary-only and --format")
+		os.Exit(1)
+	}
+	if *publicSurface && (*onlyExported || *lang != "go") {
+		logf("error", "", "", "--public-surface only applies to --lang go and cannot be combined with --only-exported")
+		os.Exit(1)
+	}
+	if *typeCheck && *lang != "go" {
+		logf("error", "", "", "--typecheck only applies to --lang go")
+		os.Exit(1)
+	}
+	if *emitFuzzStubs && (*outDir == "" || *lang != "go") {
+		logf("error", "", "", "--emit-fuzz-stubs writes Go test files into --out-dir; set --out-dir and use --lang go")
+		os.Exit(1)
+	}
+	if *theme != "light" && *theme != "dark" {
+		logf("error", "", "", "unsupported --theme %q (use light or dark)", *theme)
+		os.Exit(1)
+	}
 
-	case "ts":
-		fromFuncs, err = collectTsFuncs(*fromRef, repoRoot, *pkgFilter)
-		if err != nil { 
-			fmt.Fprintf(os.Stderr, "Error collecting functions from %s: %v\n", *fromRef, err)
-		 }
-		toFuncs, err = collectTsFuncs(*toRef, repoRoot, *pkgFilter)
-		if err != nil { 
-			fmt.Fprintf(os.Stderr, "Error collecting functions from %s: %v\n", *toRef, err)
-		 }
+	if *sortBy != "name" && *sortBy != "impact" {
+		logf("error", "", "", "unsupported --sort %q (use name or impact)", *sortBy)
+		os.Exit(1)
+	}
+	impactWeights, err := parseImpactWeights(*impactWeightsFlag)
+	if err != nil {
+		logf("error", "", "", "%v", err)
+		os.Exit(1)
+	}
 
-	default:
-		fmt.Fprintf(os.Stderr, "unsupported --lang %q (use go or ts)\n", *lang)
+	if *groupBy != "package" && *groupBy != "file" && *groupBy != "change-kind" {
+		logf("error", "", "", "unsupported --group-by %q (use package, file or change-kind)", *groupBy)
 		os.Exit(1)
 	}
 
-	report := buildMarkdownReport(*fromRef, *toRef, fromFuncs, toFuncs, *summaryOnly, *outDir)
-	fmt.Println(report)
-}
+	requiredIfaces, err := parseRequiredInterfaces(*requireIface)
+	if err != nil {
+		logf("error", "", "", "%v", err)
+		os.Exit(1)
+	}
 
-// gitRoot returns the root directory of the git repo.
-func gitRoot() (string, error) {
-	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
-	out, err := cmd.Output()
+	selectors, err := parseFuncSelectors(only)
 	if err != nil {
-		return "", fmt.Errorf("not a git repository or git not available: %w", err)
+		logf("error", "", "", "%v", err)
+		os.Exit(1)
 	}
-	return strings.TrimSpace(string(out)), nil
-}
 
-// gitListGoFiles lists all .go files for a given ref.
-func gitListGoFiles(ref string) ([]string, error) {
-	cmd := exec.Command("git", "ls-tree", "-r", "--name-only", ref)
-	out, err := cmd.Output()
+	nameTmpl, err := parseFilenameTemplate(*filenameTemplate)
 	if err != nil {
-		return nil, fmt.Errorf("git ls-tree failed for ref %s: %w", ref, err)
+		logf("error", "", "", "%v", err)
+		os.Exit(1)
 	}
 
-	lines := strings.Split(string(out), "\n")
-	var files []string
-	for _, l := range lines {
-		l = strings.TrimSpace(l)
-		if l == "" {
+	var collect collectFunc
+	switch *lang {
+	case "go":
+		collect = collectGoFuncs
+	case "ts":
+		collect = collectTsFuncs
+	default:
+		logf("error", "", "", "unsupported --lang %q (use go or ts)", *lang)
+		os.Exit(1)
+	}
+
+	for i, dir := range includePaths {
+		dir = path.Clean(filepath.ToSlash(dir))
+		if path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../") {
+			logf("error", "", "", "invalid --include-paths %q: use a directory relative to the repo root", includePaths[i])
+			os.Exit(1)
+		}
+		includePaths[i] = dir
+	}
+	if (*fromPath == "") != (*toPath == "") {
+		logf("error", "", "", "--from-path and --to-path must be set together")
+		os.Exit(1)
+	}
+	for _, opt := range []struct {
+		name string
+		dir  *string
+	}{{"from-path", fromPath}, {"to-path", toPath}} {
+		if *opt.dir == "" {
 			continue
 		}
-		if strings.HasSuffix(l, ".go") && !strings.HasSuffix(l, "_test.go") {
-			files = append(files, l)
+		dir := path.Clean(filepath.ToSlash(*opt.dir))
+		if path.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+			logf("error", "", "", "invalid --%s %q: use a directory below the repo root", opt.name, *opt.dir)
+			os.Exit(1)
+		}
+		*opt.dir = dir
+	}
+	for _, pattern := range excludeNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			logf("error", "", "", "invalid --exclude-name %q: %v", pattern, err)
+			os.Exit(1)
 		}
 	}
-	return files, nil
-}
 
-// gitShowFile returns the contents of file at ref:path.
-func gitShowFile(ref, path string) ([]byte, error) {
-	spec := fmt.Sprintf("%s:%s", ref, path)
-	cmd := exec.Command("git", "show", spec)
-	out, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("git show failed for %s: %w", spec, err)
+	collectOpts := CollectOptions{
+		OnlyExported:   *onlyExported,
+		PublicSurface:  *publicSurface,
+		ExportedExcept: exportedExcept,
+		PackageFilter:  *pkgFilter,
+		ExcludeNames:   excludeNames,
+		IncludePaths:   includePaths,
+		Tags:           splitList(*tags),
+		GofmtBodies:    *gofmtBodies,
+		Jobs:           *jobs,
+		NoBody:         *noBody,
+		TypeCheck:      *typeCheck,
+		Normalize: BodyNormalization{
+			Comments:      *ignoreComments,
+			BlankLines:    *ignoreBlankLines,
+			Indent:        *ignoreIndent,
+			ImportRenames: importRenames,
+		},
+	}
+	// Normalization only matters if bodies decide what changed.
+	diffOpts := DiffOptions{CompareBodies: *gofmtBodies || collectOpts.Normalize.any()}
+
+	if !*noCache {
+		cache, err := newCollectCache(*cacheDir, *lang)
+		if err != nil {
+			logf("warning", "", "", "caching disabled: %v", err)
+		} else {
+			collect = cache.wrap(collect)
+		}
 	}
-	return out, nil
-}
 
-// collectFuncs parses Go files from a ref and builds a FuncSet.
-func collectGoFuncs(ref, repoRoot string, onlyExported bool, pkgFilter string) (FuncSet, error) {
-	files, err := gitListGoFiles(ref)
+	// Resolve --git-dir/--work-tree before --dir changes the working directory.
+	for _, opt := range []struct{ name, path string }{{"--git-dir", *gitDir}, {"--work-tree", *workTree}} {
+		if opt.path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(opt.path)
+		if err != nil {
+			logf("error", "", "", "invalid %s %s: %v", opt.name, opt.path, err)
+			os.Exit(1)
+		}
+		gitGlobalArgs = append(gitGlobalArgs, opt.name+"="+abs)
+	}
+
+	// Like --git-dir, --from-dir and --to-dir are relative to where funcdiff
+	// was started, not to --dir.
+	fromRepoDir, fromRepoName, err := sideRepo(ctx, *fromDir, *fromRepo)
 	if err != nil {
-		return nil, err
+		logf("error", "", "", "%v", err)
+		os.Exit(1)
+	}
+	toRepoDir, toRepoName, err := sideRepo(ctx, *toDir, *toRepo)
+	if err != nil {
+		logf("error", "", "", "%v", err)
+		os.Exit(1)
 	}
 
-	fset := token.NewFileSet()
-	funcs := make(FuncSet)
+	// If --dir is provided, change working directory first
+	if *dirFlag != "" {
+		if err := os.Chdir(*dirFlag); err != nil {
+			logf("error", "", "", "failed to change directory to %s: %v", *dirFlag, err)
+			os.Exit(1)
+		}
+	}
 
-	for _, path := range files {
-		src, err := gitShowFile(ref, path)
+	// Only a side that reads from the current repository needs one: with
+	// --from-dir/--from-repo and --to-dir/--to-repo (or --to-archive,
+	// --baseline) funcdiff runs anywhere.
+	var repoRoot string
+	if fromRepoDir == "" || toRepoDir == "" && *toArchive == "" && *baseline == "" || *worktree || *watch || *commit != "" || *prevTag {
+		repoRoot, err = gitRoot(ctx)
 		if err != nil {
-			// If a single file fails (e.g. deleted or binary), log and continue.
-			fmt.Fprintf(os.Stderr, "Warning: skipping %s@%s: %v\n", path, ref, err)
-			continue
+			logf("error", "", "", "%v", err)
+			os.Exit(1)
 		}
+	}
 
-		file, err := parser.ParseFile(fset, path, src, 0)
+	// Refs from CI variables fill in --from/--to unless given explicitly.
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	rootCommit := false
+	if *commit != "" {
+		for _, name := range []string{"from", "to", "prev-tag", "worktree", "watch", "baseline", "from-dir", "to-dir", "from-repo", "to-repo", "to-archive"} {
+			if explicit[name] {
+				logf("error", "", "", "--commit cannot be combined with --%s", name)
+				os.Exit(1)
+			}
+		}
+		hasParent, err := commitHasParent(ctx, *commit)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: parsing failed for %s@%s: %v\n", path, ref, err)
+			logf("error", "", "", "%v", err)
+			os.Exit(1)
+		}
+		*fromRef, *toRef = *commit, *commit+"^"
+		rootCommit = !hasParent
+		explicit["from"], explicit["to"] = true, true
+	}
+	for _, ci := range []struct {
+		name string
+		ref  *string
+		vars []string
+	}{
+		{"from", fromRef, ciHeadRefVars},
+		{"to", toRef, ciBaseRefVars},
+	} {
+		if explicit[ci.name] {
 			continue
 		}
+		if v, ref := ciRef(ci.vars); ref != "" {
+			*ci.ref = preferLocalOrRemote(ctx, ref)
+			logf("info", "", "", "--%s=%s (from %s)", ci.name, *ci.ref, v)
+		}
+	}
+
+	if *prevTag {
+		prev, err := previousSemverTag(ctx, *toRef)
+		if err != nil {
+			logf("error", "", "", "%v", err)
+			os.Exit(1)
+		}
+		// The release is the new side and the previous tag the base.
+		*fromRef, *toRef = *toRef, prev
+	}
 
-		pkgName := file.Name.Name
-		// Derive a pseudo package path from directory + package name.
-		dir := filepath.Dir(path)
-		// Make it relative style: ./dir/pkg
-		var pkgPath string
-		if dir == "." {
-			pkgPath = pkgName
-		} else {
-			pkgPath = filepath.ToSlash(filepath.Join(dir, pkgName))
+	var fromSrc fileSource = gitRefSource{ref: *fromRef, dir: fromRepoDir, repo: fromRepoName}
+	if *worktree || *watch {
+		fromSrc = worktreeSource{root: repoRoot}
+	}
+	var toSrc fileSource = gitRefSource{ref: *toRef, dir: toRepoDir, repo: toRepoName}
+	if rootCommit {
+		toSrc = emptySource{name: "empty tree (root commit)"}
+	}
+	if *toArchive != "" {
+		archive, err := loadArchive(*toArchive)
+		if err != nil {
+			logf("error", "", "", "%v", err)
+			os.Exit(1)
 		}
+		toSrc = archive
+	}
 
-		if pkgFilter != "" && !strings.Contains(pkgPath, pkgFilter) {
+	// Fail early, with advice for shallow clones, rather than on the first
+	// git ls-tree/show of a ref whose objects aren't here.
+	for _, src := range []fileSource{fromSrc, toSrc} {
+		gs, ok := src.(gitRefSource)
+		if !ok || (src == toSrc && *baseline != "") {
 			continue
 		}
+		if err := ensureRef(ctx, gs.dir, gs.ref, *fetchDeepen); err != nil {
+			logf("error", "", "", "%v", err)
+			os.Exit(1)
+		}
+	}
 
-		ast.Inspect(file, func(n ast.Node) bool {
-			fn, ok := n.(*ast.FuncDecl)
-			if !ok {
-				return true
+	if *fromPath != "" {
+		for _, name := range []string{"baseline", "watch"} {
+			if explicit[name] {
+				logf("error", "", "", "--from-path and --to-path cannot be combined with --%s", name)
+				os.Exit(1)
 			}
+		}
+	}
 
-			name := fn.Name.Name
-			if onlyExported && !fn.Name.IsExported() {
-				return true
-			}
+	fromOpts, toOpts := collectOpts, collectOpts
+	if *fromPath != "" {
+		fromOpts.IncludePaths = sideIncludePaths(*fromPath, collectOpts.IncludePaths)
+		toOpts.IncludePaths = sideIncludePaths(*toPath, collectOpts.IncludePaths)
+	}
 
-			receiver := formatReceiver(fn.Recv)
-			exported := fn.Name.IsExported()
-			signature := formatSignature(fn.Type)
+	fromFuncs, fromTypes, fromFailures, err := collect(ctx, fromSrc, repoRoot, fromOpts)
+	if err != nil {
+		logf("error", "", fromSrc.Name(), "collecting functions from %s: %v", fromSrc.Name(), err)
+	}
+	if *fromPath != "" {
+		fromFuncs, fromTypes = stripSidePath(fromFuncs, fromTypes, fromFailures, *fromPath)
+		fromSrc = rebasedSource{fileSource: fromSrc, dir: *fromPath, name: fromSrc.Name() + ":" + *fromPath}
+	}
 
-			pos := fset.Position(fn.Pos())
-			end := fset.Position(fn.End())
-			startLine := pos.Line
-			endLine := end.Line
-			lineCount := endLine - startLine + 1
-			if lineCount < 0 {
-				lineCount = 0
-			}
+	var (
+		toFuncs    FuncSet
+		toTypes    TypeSet
+		toFailures []ParseFailure
+	)
+	if *baseline != "" {
+		snap, err := loadSnapshot(*baseline, *lang)
+		if err != nil {
+			logf("error", "", "", "%v", err)
+			os.Exit(1)
+		}
+		toFuncs = snap.funcSet()
+		toTypes = snap.typeSet()
+		toSrc = snapshotSource{snap: snap}
+	} else {
+		toFuncs, toTypes, toFailures, err = collect(ctx, toSrc, repoRoot, toOpts)
+		if err != nil {
+			logf("error", "", toSrc.Name(), "collecting functions from %s: %v", toSrc.Name(), err)
+		}
+		if *toPath != "" {
+			toFuncs, toTypes = stripSidePath(toFuncs, toTypes, toFailures, *toPath)
+			toSrc = rebasedSource{fileSource: toSrc, dir: *toPath, name: toSrc.Name() + ":" + *toPath}
+		}
+	}
 
-			info := &FuncInfo{
-				Package:   pkgPath,
-				File:      path,
-				Name:      name,
-				Receiver:  receiver,
-				Signature: signature,
-				Exported:  exported,
-				StartLine: startLine,
-				EndLine:   endLine,
-				LineCount: lineCount,
-			}
+	if *saveSnapshotPath != "" {
+		if err := saveSnapshot(*saveSnapshotPath, toSrc.Name(), *lang, toFuncs, toTypes); err != nil {
+			logf("error", "", "", "%v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *watch {
+		match := isGoSourceFile
+		if *lang == "ts" {
+			match = isTsSourceFile
+		}
+		w := worktreeWatcher{
+			src:         worktreeSource{root: repoRoot},
+			match:       match,
+			collect:     collect,
+			repoRoot:    repoRoot,
+			collectOpts: collectOpts,
+			diffOpts:    diffOpts,
+			base:        toFuncs,
+			baseTypes:   toTypes,
+			reportOpts:  ReportOptions{FromRef: "working tree", ToRef: toSrc.Name()},
+		}
+		w.run(ctx)
+		return
+	}
+
+	parseFailures := append(fromFailures, toFailures...)
+	if *strict && len(parseFailures) > 0 {
+		for _, f := range parseFailures {
+			logf("error", f.File, f.Ref, "parsing failed for %s@%s: %s", f.File, f.Ref, f.Err)
+		}
+		os.Exit(1)
+	}
+
+	diff := diffFuncs(fromFuncs, toFuncs, diffOpts)
+	diff.ChangedTypes = diffTypes(fromTypes, toTypes)
+	diff.ParseFailures = parseFailures
+	if *ignoreReceiverRename {
+		detectReceiverRenames(&diff)
+	}
+	if *detectPackageMovesFlag {
+		detectPackageMoves(&diff)
+	}
+	if *detectMethodConversions {
+		detectFuncMethodConversions(ctx, &diff, fromSrc, toSrc)
+	}
+	relDir, err := relativeToDir(repoRoot, *relativeTo)
+	if err != nil {
+		logf("error", "", "", "%v", err)
+		os.Exit(1)
+	}
+	hash := narrowDiff(&diff, NarrowOptions{
+		Only:                selectors,
+		Receivers:           onlyReceivers,
+		IncludeConstructors: *includeConstructors,
+		GlobalMoves:         *detectMovesGlobal,
+		RelativeTo:          relDir,
+		KeepOutside:         *relativeOutside == "keep",
+	})
+	if relDir != "" {
+		fromSrc = rebasedSource{fileSource: fromSrc, dir: relDir}
+		toSrc = rebasedSource{fileSource: toSrc, dir: relDir}
+	}
+	sortChanged(diff.ChangedFuncs, *sortBy, impactWeights)
+
+	reportOpts := ReportOptions{
+		FromRef:      fromSrc.Name(),
+		ToRef:        toSrc.Name(),
+		FromSource:   fromSrc,
+		ToSource:     toSrc,
+		SummaryOnly:  *summaryOnly,
+		NoSummary:    *noSummary,
+		OutDir:       *outDir,
+		ThresholdLOC: *thresholdLOC,
+		GroupBy:      *groupBy,
+		OnlyChanged:  *onlyChanged,
+		HeadOnly:     *headOnly,
+		DryRun:       *dryRun,
+		MaxBodyBytes: *maxBodyBytes,
+		FailOn:       splitList(*failOn),
+
+		FilenameTemplate:   nameTmpl,
+		RequiredInterfaces: requiredIfaces,
+		Explain:            *explain,
+		Diff:               diffOpts,
+		NoBody:             *noBody,
+		Mermaid:            *mermaid,
+		Sort:               *sortBy,
+		ImpactWeights:      impactWeights,
+		Normalize:          collectOpts.Normalize,
+		MaxFunctions:       *maxFunctions,
+		SlackTop:           *slackTop,
+		SlackMaxChars:      *slackMaxChars,
+		Theme:              *theme,
+		HTMLFragment:       *htmlFragment,
+		Canonical:          *canonical,
+		TSVHeader:          *tsvHeader,
+	}
+	if *repoURL != "" {
+		links, err := newSourceLinks(ctx, *repoURL, *repoURLStyle, fromSrc, toSrc, fromFuncs, toFuncs)
+		if err != nil {
+			logf("error", "", "", "--repo-url: %v", err)
+			os.Exit(1)
+		}
+		reportOpts.Links = links
+	}
+	if *blame {
+		changed, _ := capPairs(diff.ChangedFuncs, *maxFunctions)
+		blamed, err := blameChanged(ctx, toSrc, changed, *jobs)
+		if err != nil {
+			logf("error", "", "", "--blame: %v", err)
+			os.Exit(1)
+		}
+		reportOpts.Blame = blamed
+	}
 
-			key := FuncKey{
-				Package:  pkgPath,
-				Receiver: receiver,
-				Name:     name,
+	if *apiCheck {
+		if explicit["format"] {
+			logf("error", "", "", "--api-check has its own output; drop --format")
+			os.Exit(1)
+		}
+		report, incompatible := buildAPICheckReport(diff)
+		if *outFile != "" {
+			if err := writeReportFile(*outFile, report); err != nil {
+				logf("error", "", "", "%v", err)
+				os.Exit(1)
 			}
-			funcs[key] = info
+		} else {
+			fmt.Println(report)
+		}
+		if incompatible > 0 {
+			logf("info", "", "", "--api-check: %d incompatible API changes", incompatible)
+			os.Exit(exitFailOn)
+		}
+		return
+	}
+
+	for _, f := range formats {
+		dest := f.Path
+		if dest == "" {
+			dest = *outFile
+		}
+		if err := writeFormat(ctx, f.Name, dest, diff, reportOpts, *csvKind, *outDir); err != nil {
+			logf("error", "", "", "%v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *emitFuzzStubs {
+		stubs, files, err := writeFuzzStubs(*outDir, diff, reportOpts)
+		if err != nil {
+			logf("error", "", "", "--emit-fuzz-stubs: %v", err)
+			os.Exit(1)
+		}
+		logf("info", "", "", "--emit-fuzz-stubs: wrote %d stubs in %d files", stubs, files)
+	}
+
+	if *emitHash {
+		fmt.Fprintf(os.Stderr, "funcdiff-hash: sha256:%s\n", hash)
+	}
+
+	for _, cond := range failConditions {
+		if cond.triggered(diff, reportOpts) {
+			logf("info", "", "", "--fail-on=%s: %s", cond.name, cond.describe)
+			os.Exit(exitFailOn)
+		}
+	}
+
+	if *exitCount {
+		os.Exit(countExitCode(len(diff.ChangedFuncs) + len(diff.RemovedFuncs)))
+	}
+}
+
+// logJSON makes logf write JSON lines instead of text (--log-json).
+var logJSON bool
 
+// logEntry is one --log-json diagnostic. File and Ref are set when the
+// message concerns one file or one side.
+type logEntry struct {
+	Level string `json:"level"` // error, warning or info
+	Msg   string `json:"msg"`
+	File  string `json:"file,omitempty"`
+	Ref   string `json:"ref,omitempty"`
+}
+
+// logf writes a diagnostic to stderr: "Error: msg", "Warning: msg" or
+// "funcdiff: msg" by level, or with --log-json a logEntry on one line.
+// Every stderr diagnostic goes through here.
+func logf(level, file, ref, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if logJSON {
+		line, err := json.Marshal(logEntry{Level: level, Msg: msg, File: file, Ref: ref})
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "%s\n", line)
+			return
+		}
+	}
+	prefix := map[string]string{"error": "Error: ", "warning": "Warning: ", "info": "funcdiff: "}[level]
+	fmt.Fprintf(os.Stderr, "%s%s\n", prefix, msg)
+}
+
+// knownFormats lists the --format names, in the order the help text and
+// errors give them.
+var knownFormats = []string{"markdown", "markdown-collapsible", "term", "junit", "patch", "html", "jsonl", "csv", "tsv", "slack", "gitlab-codequality"}
+
+// formatOutput is one --format value: a format name and, for name:path,
+// the file to write it to.
+type formatOutput struct {
+	Name string
+	Path string
+}
+
+// formatFlag collects repeated --format values in order.
+type formatFlag []formatOutput
+
+func (f *formatFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, o := range *f {
+		parts[i] = o.Name
+		if o.Path != "" {
+			parts[i] += ":" + o.Path
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *formatFlag) Set(s string) error {
+	name, file, _ := strings.Cut(s, ":")
+	*f = append(*f, formatOutput{Name: name, Path: file})
+	return nil
+}
+
+func (f formatFlag) has(name string) bool {
+	for _, o := range f {
+		if o.Name == name {
 			return true
+		}
+	}
+	return false
+}
+
+// dest returns where the first output of format name goes: its own path,
+// or out (--out, "" for stdout) when it has none.
+func (f formatFlag) dest(name, out string) string {
+	for _, o := range f {
+		if o.Name == name && o.Path != "" {
+			return o.Path
+		}
+	}
+	return out
+}
+
+// writeFormat renders diff as format name and writes it to dest, or to
+// stdout when dest is "". csvKind and outDir only matter for csv.
+func writeFormat(ctx context.Context, name, dest string, diff DiffResult, opts ReportOptions, csvKind, outDir string) error {
+	var report string
+	var err error
+	switch name {
+	case "markdown":
+		report = buildMarkdownReport(ctx, diff, opts)
+	case "markdown-collapsible":
+		opts.Collapsible = true
+		report = buildMarkdownReport(ctx, diff, opts)
+	case "term":
+		report = buildTermReport(diff, opts, dest == "" && !opts.Canonical && useColor(os.Stdout))
+	case "junit":
+		report, err = buildJUnitReport(diff, opts)
+	case "patch":
+		report = buildPatchReport(ctx, diff, opts)
+	case "html":
+		report = buildHTMLReport(ctx, diff, opts)
+	case "slack":
+		report = buildSlackReport(diff, opts)
+	case "gitlab-codequality":
+		report, err = buildGitLabCodeQualityReport(diff, opts)
+	case "jsonl":
+		return streamReport(dest, func(w io.Writer) error {
+			return writeJSONLReport(w, diff, opts)
 		})
+	case "csv":
+		switch csvKind {
+		case "packages":
+			return streamReport(dest, func(w io.Writer) error {
+				return writePackagesCSV(w, diff)
+			})
+		case "both":
+			return writeCSVFiles(outDir, diff, opts)
+		}
+		return streamReport(dest, func(w io.Writer) error {
+			return writeFunctionsCSV(w, diff, opts)
+		})
+	case "tsv":
+		return streamReport(dest, func(w io.Writer) error {
+			return writeTSVReport(w, diff, opts)
+		})
+	default:
+		return fmt.Errorf("unsupported --format %q (use %s)", name, strings.Join(knownFormats, ", "))
+	}
+	if err != nil {
+		return err
+	}
+	if dest != "" {
+		return writeReportFile(dest, report)
+	}
+	fmt.Println(report)
+	return nil
+}
+
+// writeReportFile writes report (plus a trailing newline, as on stdout) to
+// path, creating its parent directories.
+func writeReportFile(path, report string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create directory for --out: %w", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(report+"\n"), 0o644); err != nil {
+		return fmt.Errorf("write --out: %w", err)
+	}
+	return nil
+}
+
+// exitFailOn is the exit status used when a --fail-on condition is met. It
+// stays clear of 1 (fatal errors) and 2 (flag usage errors).
+const exitFailOn = 3
+
+// exitCountMax caps --exit-count statuses below the values shells reserve
+// (126 and up for "not executable", "not found" and signals).
+const exitCountMax = 125
+
+// countExitCode maps n changed+removed functions to the --exit-count status:
+// 0 when n is 0, otherwise exitFailOn+n capped at exitCountMax, so the
+// statuses 1-3 keep meaning error, usage and --fail-on.
+func countExitCode(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return min(exitFailOn+n, exitCountMax)
+}
+
+// failCondition is a --fail-on condition evaluated after the report is printed.
+type failCondition struct {
+	name      string
+	describe  string
+	triggered func(diff DiffResult, opts ReportOptions) bool
+}
+
+var knownFailConditions = []failCondition{
+	{
+		name:     "threshold",
+		describe: "a changed function exceeded --threshold-loc",
+		triggered: func(diff DiffResult, opts ReportOptions) bool {
+			return opts.ThresholdLOC > 0 && len(largeChanges(diff.ChangedFuncs, opts.ThresholdLOC)) > 0
+		},
+	},
+	{
+		name:     "removed",
+		describe: "an exported function was removed",
+		triggered: func(diff DiffResult, opts ReportOptions) bool {
+			for _, f := range diff.RemovedFuncs {
+				if f.Exported {
+					return true
+				}
+			}
+			return false
+		},
+	},
+	{
+		name:     "signature",
+		describe: "a function signature changed",
+		triggered: func(diff DiffResult, opts ReportOptions) bool {
+			for _, pair := range diff.ChangedFuncs {
+				if signatureChanged(pair[0], pair[1]) {
+					return true
+				}
+			}
+			return false
+		},
+	},
+}
+
+// parseFailOn resolves the --fail-on list against knownFailConditions.
+func parseFailOn(s string) ([]failCondition, error) {
+	var conds []failCondition
+	for _, name := range splitList(s) {
+		found := false
+		for _, c := range knownFailConditions {
+			if c.name == name {
+				conds = append(conds, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown --fail-on condition %q", name)
+		}
+	}
+	return conds, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// listFlag is a flag that may be repeated; each value may also hold a
+// comma-separated list. The values accumulate in order.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, splitList(s)...)
+	return nil
+}
+
+// gitGlobalArgs are passed to every git invocation, ahead of the subcommand.
+// They carry --git-dir / --work-tree so all helpers target the same repo.
+var gitGlobalArgs []string
+
+// gitTimeout bounds each git invocation (--git-timeout); 0 means no limit.
+var gitTimeout time.Duration
+
+// runGit runs git with gitGlobalArgs applied in dir ("" for the current
+// directory) and returns its stdout. Every git call in funcdiff must go
+// through it. The command is killed when ctx is canceled or gitTimeout
+// elapses, and the error then says so instead of reporting a bare
+// "signal: killed". On a non-zero exit the error is an *exec.ExitError
+// carrying git's stderr.
+func runGit(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	if gitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gitTimeout)
+		defer cancel()
+	}
+
+	full := make([]string, 0, len(gitGlobalArgs)+len(args))
+	full = append(full, gitGlobalArgs...)
+	full = append(full, args...)
+	cmd := exec.CommandContext(ctx, "git", full...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil && ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("git %s timed out after %s (see --git-timeout): %w", args[0], gitTimeout, ctx.Err())
+		}
+		return nil, fmt.Errorf("git %s canceled: %w", args[0], ctx.Err())
+	}
+	return out, err
+}
+
+// gitRoot returns the root directory of the git repo: the top of the working
+// tree (the linked worktree's own root when run inside one), or the git
+// directory itself for bare repositories, which have no working tree.
+func gitRoot(ctx context.Context) (string, error) {
+	out, err := runGit(ctx, "", "rev-parse", "--is-bare-repository")
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("not a git repository or git not available: %w", err)
+	}
+
+	if strings.TrimSpace(string(out)) == "true" {
+		out, err = runGit(ctx, "", "rev-parse", "--absolute-git-dir")
+	} else {
+		out, err = runGit(ctx, "", "rev-parse", "--show-toplevel")
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot determine repository root: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// CI variables consulted, in order, for --from and --to when those flags are
+// not given: GitHub Actions (pull_request events), then GitLab CI.
+var (
+	ciHeadRefVars = []string{"GITHUB_HEAD_REF", "CI_COMMIT_REF_NAME"}
+	ciBaseRefVars = []string{"GITHUB_BASE_REF", "CI_MERGE_REQUEST_TARGET_BRANCH_NAME"}
+)
+
+// ciRef returns the first of vars that is set to a non-empty value, and that
+// value.
+func ciRef(vars []string) (name, ref string) {
+	for _, v := range vars {
+		if ref := strings.TrimSpace(os.Getenv(v)); ref != "" {
+			return v, ref
+		}
+	}
+	return "", ""
+}
+
+// preferLocalOrRemote returns branch if it resolves locally, or
+// "origin/<branch>" if only the remote-tracking branch exists, which is the
+// usual state of a CI checkout. Otherwise branch is returned unchanged.
+func preferLocalOrRemote(ctx context.Context, branch string) string {
+	if ok, _ := refHasTree(ctx, "", branch); ok {
+		return branch
+	}
+	if ok, _ := refHasTree(ctx, "", "origin/"+branch); ok {
+		return "origin/" + branch
+	}
+	return branch
+}
+
+// commitHasParent resolves rev to a single commit for --commit and reports
+// whether it has a parent. Missing or ambiguous revisions are errors that
+// carry git's explanation.
+func commitHasParent(ctx context.Context, rev string) (bool, error) {
+	out, err := runGit(ctx, "", "rev-parse", "--verify", "--end-of-options", rev+"^{commit}")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// git explains ambiguity on "error:" lines; a missing revision only
+		// gets a generic "fatal: Needed a single revision".
+		msg := "no such commit"
+		for _, line := range strings.Split(string(exitErr.Stderr), "\n") {
+			if rest, ok := strings.CutPrefix(line, "error: "); ok {
+				msg = rest
+				break
+			}
+		}
+		return false, fmt.Errorf("--commit %s: %s", rev, msg)
+	}
+	if err != nil {
+		return false, fmt.Errorf("--commit %s: %w", rev, err)
+	}
+
+	out, err = runGit(ctx, "", "rev-list", "--parents", "-n", "1", strings.TrimSpace(string(out)))
+	if err != nil {
+		return false, fmt.Errorf("--commit %s: git rev-list failed: %w", rev, err)
+	}
+	return len(strings.Fields(string(out))) > 1, nil
+}
+
+// refHasTree reports whether ref resolves to a tree whose object is present.
+func refHasTree(ctx context.Context, dir, ref string) (bool, error) {
+	_, err := runGit(ctx, dir, "rev-parse", "--verify", "--quiet", ref+"^{tree}")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// isShallowRepo reports whether the repository is a shallow clone.
+func isShallowRepo(ctx context.Context, dir string) (bool, error) {
+	out, err := runGit(ctx, dir, "rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == "true", nil
+}
+
+// ensureRef checks that ref can be read. In a shallow clone a missing ref is
+// usually history that wasn't fetched: with deepen > 0 it fetches that many
+// more commits (repeatedly, until the ref shows up or nothing more arrives),
+// otherwise it returns an error explaining how to get the history.
+func ensureRef(ctx context.Context, dir, ref string, deepen int) error {
+	ok, err := refHasTree(ctx, dir, ref)
+	if err != nil || ok {
+		return err
+	}
+	shallow, err := isShallowRepo(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if !shallow {
+		return fmt.Errorf("unknown ref %q (not a branch, tag or commit in this repository)", ref)
+	}
+
+	for deepen > 0 {
+		logf("info", "", "", "%s is not in this shallow clone; fetching %d more commits", ref, deepen)
+		if _, err := runGit(ctx, dir, "fetch", fmt.Sprintf("--deepen=%d", deepen)); err != nil {
+			return fmt.Errorf("git fetch --deepen=%d failed: %w", deepen, err)
+		}
+		if ok, err := refHasTree(ctx, dir, ref); err != nil || ok {
+			return err
+		}
+		if shallow, err = isShallowRepo(ctx, dir); err != nil || !shallow {
+			break // complete history and still no ref
+		}
+	}
+	if !shallow {
+		return fmt.Errorf("unknown ref %q, even with the complete history fetched", ref)
+	}
+	return fmt.Errorf("ref %q is not available in this shallow clone (or does not exist); fetch more history "+
+		"(git fetch --deepen=<n>, git fetch --unshallow, or a larger fetch-depth in CI), "+
+		"or rerun with --fetch-deepen=<n>", ref)
+}
+
+// previousSemverTag returns the highest semver tag that sorts before tag.
+// Pre-release tags are only considered when tag is itself a pre-release, so
+// v1.4.0 is compared with v1.3.2 rather than v1.4.0-rc.2.
+func previousSemverTag(ctx context.Context, tag string) (string, error) {
+	target, ok := parseSemver(tag)
+	if !ok {
+		return "", fmt.Errorf("--prev-tag needs --to to be a semver tag, got %q", tag)
+	}
+
+	out, err := runGit(ctx, "", "tag", "--sort=-v:refname")
+	if err != nil {
+		return "", fmt.Errorf("git tag failed: %w", err)
+	}
+
+	var (
+		best    string
+		bestVer semver
+	)
+	for _, line := range strings.Split(string(out), "\n") {
+		name := strings.TrimSpace(line)
+		v, ok := parseSemver(name)
+		if !ok || compareSemver(v, target) >= 0 {
+			continue
+		}
+		if v.pre != "" && target.pre == "" {
+			continue
+		}
+		// git's v:refname ordering puts pre-releases after their release, so
+		// pick the maximum ourselves instead of trusting the first match.
+		if best == "" || compareSemver(v, bestVer) > 0 {
+			best, bestVer = name, v
+		}
+	}
+
+	if best == "" {
+		return "", fmt.Errorf("%s is the first tag; there is no previous tag to diff against", tag)
+	}
+	return best, nil
+}
+
+type semver struct {
+	major, minor, patch int
+	pre                 string
+}
+
+// parseSemver parses tags like "v1.4.0", "1.4.0" or "v1.4.0-rc.1+build.5".
+// Build metadata is ignored, as semver prescribes.
+func parseSemver(tag string) (semver, bool) {
+	s := strings.TrimPrefix(tag, "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	var v semver
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.pre = s[i+1:]
+		s = s[:i]
+		if v.pre == "" {
+			return semver{}, false
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, p := range parts {
+		n, ok := parseUint(p)
+		if !ok {
+			return semver{}, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+func parseUint(s string) (int, bool) {
+	if s == "" {
+		return 0, false
+	}
+	n := 0
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0, false
+		}
+		n = n*10 + int(r-'0')
+	}
+	return n, true
+}
+
+// compareSemver orders versions by semver precedence, returning -1, 0 or 1.
+func compareSemver(a, b semver) int {
+	for _, d := range []int{a.major - b.major, a.minor - b.minor, a.patch - b.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+
+	// A release has higher precedence than any of its pre-releases.
+	switch {
+	case a.pre == b.pre:
+		return 0
+	case a.pre == "":
+		return 1
+	case b.pre == "":
+		return -1
+	}
+
+	ap := strings.Split(a.pre, ".")
+	bp := strings.Split(b.pre, ".")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		an, aNum := parseUint(ap[i])
+		bn, bNum := parseUint(bp[i])
+		switch {
+		case aNum && bNum:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aNum:
+			return -1 // numeric identifiers sort before alphanumeric ones
+		case bNum:
+			return 1
+		default:
+			if c := strings.Compare(ap[i], bp[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	switch {
+	case len(ap) < len(bp):
+		return -1
+	case len(ap) > len(bp):
+		return 1
+	}
+	return 0
+}
+
+// gitListFiles lists every file path in the tree of ref.
+func gitListFiles(ctx context.Context, dir, ref string) ([]string, error) {
+	out, err := runGit(ctx, dir, "ls-tree", "-r", "--name-only", ref)
+	if err != nil {
+		return nil, fmt.Errorf("git ls-tree failed for ref %s: %w", ref, err)
+	}
+
+	lines := strings.Split(string(out), "\n")
+	var files []string
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		files = append(files, l)
+	}
+	return files, nil
+}
+
+// isGoSourceFile reports whether path is a non-test Go file.
+func isGoSourceFile(path string) bool {
+	return strings.HasSuffix(path, ".go") && !strings.HasSuffix(path, "_test.go")
+}
+
+// isTsSourceFile reports whether path is a non-test TypeScript file.
+func isTsSourceFile(path string) bool {
+	return strings.HasSuffix(path, ".ts") &&
+		!strings.HasSuffix(path, ".spec.ts") &&
+		!strings.HasSuffix(path, ".test.ts")
+}
+
+// gitShowFile returns the contents of file at ref:path. If the path does not
+// exist at ref, the error wraps fs.ErrNotExist.
+func gitShowFile(ctx context.Context, dir, ref, path string) ([]byte, error) {
+	spec := fmt.Sprintf("%s:%s", ref, path)
+	out, err := runGit(ctx, dir, "show", spec)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			msg := string(exitErr.Stderr)
+			if strings.Contains(msg, "does not exist in") || strings.Contains(msg, "exists on disk, but not in") {
+				return nil, fmt.Errorf("%s is not present at %s: %w", path, ref, fs.ErrNotExist)
+			}
+		}
+		return nil, fmt.Errorf("git show failed for %s: %w", spec, err)
+	}
+	return out, nil
+}
+
+// fileSource is where one side of the diff reads its files from.
+type fileSource interface {
+	// Name labels the side in reports and warnings (usually the ref).
+	Name() string
+	ListFiles(ctx context.Context) ([]string, error)
+	ReadFile(ctx context.Context, path string) ([]byte, error)
+}
+
+// emptySource is a side with no files, e.g. the parent of a root commit.
+type emptySource struct{ name string }
+
+func (s emptySource) Name() string { return s.name }
+
+func (s emptySource) ListFiles(ctx context.Context) ([]string, error) { return nil, nil }
+
+func (s emptySource) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+}
+
+// gitRefSource reads files from a git ref without checking it out. dir is
+// the repository to read from ("" for the current one, see --from-dir), and
+// repo, when set, names it in reports as "<repo>@<ref>".
+type gitRefSource struct{ ref, dir, repo string }
+
+func (s gitRefSource) Name() string {
+	if s.repo != "" {
+		return s.repo + "@" + s.ref
+	}
+	return s.ref
+}
+
+func (s gitRefSource) ListFiles(ctx context.Context) ([]string, error) {
+	return gitListFiles(ctx, s.dir, s.ref)
+}
+
+func (s gitRefSource) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return gitShowFile(ctx, s.dir, s.ref, path)
+}
+
+// blameInfo is the most recent commit among a function's lines.
+type blameInfo struct {
+	Author string
+	Commit string // abbreviated
+	Time   time.Time
+}
+
+// describe renders bl as "author, when (commit)". when is relative to now
+// ("3 days ago"), or the UTC author date with canonical.
+func (bl blameInfo) describe(canonical bool) string {
+	when := relativeAge(bl.Time, time.Now())
+	if canonical {
+		when = "on " + bl.Time.UTC().Format("2006-01-02")
+	}
+	return fmt.Sprintf("%s, %s (%s)", bl.Author, when, bl.Commit)
+}
+
+// relativeAge renders how long before now t was, at the coarsest fitting
+// unit: "3 hours ago", "5 days ago", "2 years ago".
+func relativeAge(t, now time.Time) string {
+	d := now.Sub(t)
+	var n int
+	var unit string
+	switch {
+	case d < time.Hour:
+		return "less than an hour ago"
+	case d < 24*time.Hour:
+		n, unit = int(d/time.Hour), "hour"
+	case d < 30*24*time.Hour:
+		n, unit = int(d/(24*time.Hour)), "day"
+	case d < 365*24*time.Hour:
+		n, unit = int(d/(30*24*time.Hour)), "month"
+	default:
+		n, unit = int(d/(365*24*time.Hour)), "year"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s ago", n, unit)
+}
+
+// blameChanged runs git blame over the to-side lines of each changed
+// function, up to jobs at a time (0 means one per CPU), and returns the most
+// recent commit found for each. src must read from a git ref, possibly
+// rebased by --relative-to. A function whose lines can't be blamed is
+// skipped with a warning.
+func blameChanged(ctx context.Context, src fileSource, changed [][2]*FuncInfo, jobs int) (map[*FuncInfo]blameInfo, error) {
+	src, dir := unwrapRebased(src)
+	gs, ok := src.(gitRefSource)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a git ref", src.Name())
+	}
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	results := make([]*blameInfo, len(changed))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < len(changed); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f := changed[i][1]
+				bl, err := gitBlameRange(ctx, gs.dir, gs.ref, path.Join(dir, f.File), f.StartLine, f.EndLine)
+				if err != nil {
+					logf("warning", f.File, gs.ref, "--blame: %s: %v", qualifiedName(f), err)
+					continue
+				}
+				results[i] = &bl
+			}
+		}()
+	}
+	for i := range changed {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	blamed := make(map[*FuncInfo]blameInfo, len(changed))
+	for i, bl := range results {
+		if bl != nil {
+			blamed[changed[i][1]] = *bl
+		}
+	}
+	return blamed, nil
+}
+
+// gitBlameRange blames lines start..end of file at ref in the repository
+// dir and returns the most recently authored commit among them.
+func gitBlameRange(ctx context.Context, dir, ref, file string, start, end int) (blameInfo, error) {
+	out, err := runGit(ctx, dir, "blame", "--line-porcelain", "-L", fmt.Sprintf("%d,%d", start, end), ref, "--", file)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return blameInfo{}, fmt.Errorf("git blame failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return blameInfo{}, err
+	}
+
+	// --line-porcelain repeats the commit headers for every line: a
+	// "<sha> <orig> <final>" line, then "author", "author-time" and so on.
+	var latest, cur blameInfo
+	for _, line := range strings.Split(string(out), "\n") {
+		key, val, _ := strings.Cut(line, " ")
+		switch {
+		case len(key) == 40 && strings.Trim(key, "0123456789abcdef") == "":
+			cur = blameInfo{Commit: key[:7]}
+		case key == "author":
+			cur.Author = val
+		case key == "author-time":
+			sec, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				continue
+			}
+			cur.Time = time.Unix(sec, 0)
+			if cur.Time.After(latest.Time) {
+				latest = cur
+			}
+		}
+	}
+	if latest.Commit == "" {
+		return blameInfo{}, fmt.Errorf("git blame returned no lines")
+	}
+	return latest, nil
+}
+
+// sourceLinks builds links from function locations to a repository's web
+// UI for --repo-url. Each function links into the commit of the side it
+// was collected from.
+type sourceLinks struct {
+	base  string // repository URL, without a trailing slash
+	style string // github or gitlab
+	sides map[*FuncInfo]linkSide
+}
+
+// linkSide is where a function's side lives in the repository: the commit,
+// and the directory its reported file paths are relative to (--relative-to,
+// --from-path or --to-path).
+type linkSide struct {
+	sha, dir string
+}
+
+// newSourceLinks resolves both sides to commit SHAs and the repository URL
+// (repoURL, or the origin remote for "auto"). A side that is not a git ref,
+// such as the working tree or a snapshot, gets no links; one wrapped in
+// rebasedSource links to its files below the rebased directory.
+func newSourceLinks(ctx context.Context, repoURL, style string, fromSrc, toSrc fileSource, fromFuncs, toFuncs FuncSet) (*sourceLinks, error) {
+	if repoURL == "auto" {
+		out, err := runGit(ctx, "", "remote", "get-url", "origin")
+		if err != nil {
+			return nil, fmt.Errorf("no origin remote to derive the URL from: %w", err)
+		}
+		repoURL = webURL(strings.TrimSpace(string(out)))
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("%q is not an http(s) repository URL", repoURL)
+	}
+	if style == "auto" {
+		style = "github"
+		if strings.Contains(u.Hostname(), "gitlab") {
+			style = "gitlab"
+		}
+	}
+
+	l := &sourceLinks{base: strings.TrimSuffix(repoURL, "/"), style: style, sides: make(map[*FuncInfo]linkSide)}
+	for _, side := range []struct {
+		src   fileSource
+		funcs FuncSet
+	}{{fromSrc, fromFuncs}, {toSrc, toFuncs}} {
+		src, dir := unwrapRebased(side.src)
+		gs, ok := src.(gitRefSource)
+		if !ok {
+			continue
+		}
+		out, err := runGit(ctx, gs.dir, "rev-parse", "--verify", "--end-of-options", gs.ref+"^{commit}")
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s to a commit: %w", gs.ref, err)
+		}
+		sha := strings.TrimSpace(string(out))
+		for _, f := range side.funcs {
+			l.sides[f] = linkSide{sha: sha, dir: dir}
+		}
+	}
+	return l, nil
+}
+
+// webURL turns a git remote URL into the repository's web URL:
+// "git@github.com:org/repo.git" and "ssh://git@github.com/org/repo.git"
+// both become "https://github.com/org/repo".
+func webURL(remote string) string {
+	remote = strings.TrimSuffix(remote, ".git")
+	if rest, ok := strings.CutPrefix(remote, "ssh://"); ok {
+		if _, hostPath, ok := strings.Cut(rest, "@"); ok {
+			rest = hostPath
+		}
+		return "https://" + rest
+	}
+	if user, hostPath, ok := strings.Cut(remote, "@"); ok && !strings.Contains(user, "://") {
+		return "https://" + strings.Replace(hostPath, ":", "/", 1)
+	}
+	if u, err := url.Parse(remote); err == nil && u.User != nil {
+		u.User = nil
+		return u.String()
+	}
+	return remote
+}
+
+// url returns the web URL of f's lines, or "" when its side has no commit.
+func (l *sourceLinks) url(f *FuncInfo) string {
+	side, ok := l.sides[f]
+	if !ok {
+		return ""
+	}
+	sha, file := side.sha, path.Join(side.dir, filepath.ToSlash(f.File))
+	if l.style == "gitlab" {
+		return fmt.Sprintf("%s/-/blob/%s/%s#L%d-%d", l.base, sha, file, f.StartLine, f.EndLine)
+	}
+	return fmt.Sprintf("%s/blob/%s/%s#L%d-L%d", l.base, sha, file, f.StartLine, f.EndLine)
+}
+
+// link renders text as a Markdown link to f's lines. It returns text
+// unchanged when l is nil or f's side has no commit.
+func (l *sourceLinks) link(f *FuncInfo, text string) string {
+	if l == nil {
+		return text
+	}
+	if u := l.url(f); u != "" {
+		return "[" + text + "](" + u + ")"
+	}
+	return text
+}
+
+// sideRepo resolves --from-dir/--from-repo (or the --to pair) for one side:
+// the repository directory git should run in, "" for the current one, and
+// the name of the repository in reports.
+func sideRepo(ctx context.Context, dir, url string) (repoDir, name string, err error) {
+	switch {
+	case dir != "":
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return "", "", err
+		}
+		return abs, dir, nil
+	case url != "":
+		repoDir, err := remoteRepoDir(ctx, url)
+		if err != nil {
+			return "", "", err
+		}
+		return repoDir, url, nil
+	}
+	return "", "", nil
+}
+
+// remoteRepoDir returns a bare mirror of the repository at url, kept under
+// the user cache directory so later runs only fetch what is new. It is
+// cloned on first use; afterwards all branches and tags are fetched.
+func remoteRepoDir(ctx context.Context, url string) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("no cache directory for cloning %s: %w", url, err)
+	}
+	dir := filepath.Join(cache, "funcdiff", "remotes", shortHash(url)+".git")
+	if _, err := os.Stat(dir); err == nil {
+		logf("info", "", "", "fetching %s", url)
+		if _, err := runGit(ctx, dir, "fetch", "--quiet", "--prune", "--tags", url, "+refs/heads/*:refs/heads/*"); err != nil {
+			return "", fmt.Errorf("git fetch %s failed: %w", url, err)
+		}
+		return dir, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return "", err
+	}
+	logf("info", "", "", "cloning %s into %s", url, dir)
+	if _, err := runGit(ctx, "", "clone", "--quiet", "--bare", url, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("git clone %s failed: %w", url, err)
+	}
+	return dir, nil
+}
+
+// worktreeSource reads files from the working tree at root, including
+// uncommitted edits and untracked (but not ignored) files.
+type worktreeSource struct{ root string }
+
+func (s worktreeSource) Name() string { return "working tree" }
+
+func (s worktreeSource) ListFiles(ctx context.Context) ([]string, error) {
+	out, err := runGit(ctx, s.root, "ls-files", "--cached", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files failed: %w", err)
+	}
+	var files []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			files = append(files, l)
+		}
+	}
+	return files, nil
+}
+
+func (s worktreeSource) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.root, filepath.FromSlash(path)))
+}
+
+// archiveSource reads files from a source archive (--to-archive) loaded
+// into memory by loadArchive. Paths are slash-separated and relative to the
+// archive root.
+type archiveSource struct {
+	path  string
+	files map[string][]byte
+}
+
+func (s archiveSource) Name() string { return filepath.Base(s.path) }
+
+func (s archiveSource) ListFiles(ctx context.Context) ([]string, error) {
+	files := make([]string, 0, len(s.files))
+	for name := range s.files {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s archiveSource) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	data, ok := s.files[path]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+	}
+	return data, nil
+}
+
+// loadArchive reads every regular file of a .tar, .tar.gz/.tgz or .zip
+// archive into memory. When all entries share a single top-level directory,
+// as in release tarballs ("project-1.2.0/..."), it is stripped so paths line
+// up with the repository.
+func loadArchive(file string) (archiveSource, error) {
+	files := make(map[string][]byte)
+	add := func(name string, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("read %s in %s: %w", name, file, err)
+		}
+		files[path.Clean(name)] = data
+		return nil
+	}
+
+	lower := strings.ToLower(file)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		zr, err := zip.OpenReader(file)
+		if err != nil {
+			return archiveSource{}, fmt.Errorf("open --to-archive: %w", err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return archiveSource{}, fmt.Errorf("read %s in %s: %w", f.Name, file, err)
+			}
+			err = add(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return archiveSource{}, err
+			}
+		}
+	case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		fh, err := os.Open(file)
+		if err != nil {
+			return archiveSource{}, fmt.Errorf("open --to-archive: %w", err)
+		}
+		defer fh.Close()
+		var r io.Reader = fh
+		if !strings.HasSuffix(lower, ".tar") {
+			gz, err := gzip.NewReader(fh)
+			if err != nil {
+				return archiveSource{}, fmt.Errorf("read %s: %w", file, err)
+			}
+			defer gz.Close()
+			r = gz
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return archiveSource{}, fmt.Errorf("read %s: %w", file, err)
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := add(hdr.Name, tr); err != nil {
+				return archiveSource{}, err
+			}
+		}
+	default:
+		return archiveSource{}, fmt.Errorf("--to-archive %s: unsupported archive (use .tar, .tar.gz, .tgz or .zip)", file)
+	}
+
+	prefix := ""
+	for name := range files {
+		i := strings.IndexByte(name, '/')
+		if i < 0 || (prefix != "" && name[:i+1] != prefix) {
+			prefix = ""
+			break
+		}
+		prefix = name[:i+1]
+	}
+	if prefix != "" {
+		stripped := make(map[string][]byte, len(files))
+		for name, data := range files {
+			stripped[strings.TrimPrefix(name, prefix)] = data
+		}
+		files = stripped
+	}
+	return archiveSource{path: file, files: files}, nil
+}
+
+// Timing of the --watch polling loop.
+const (
+	watchPollInterval = 500 * time.Millisecond
+	// watchDebounce is how long the tree must stay unchanged before a
+	// re-run, so a burst of saves triggers a single diff.
+	watchDebounce = 300 * time.Millisecond
+)
+
+// worktreeWatcher implements --watch: it polls the working tree and re-diffs
+// it against a fixed base whenever a matching file changes.
+type worktreeWatcher struct {
+	src         worktreeSource
+	match       func(string) bool
+	collect     collectFunc
+	repoRoot    string
+	collectOpts CollectOptions
+	diffOpts    DiffOptions
+	base        FuncSet
+	baseTypes   TypeSet
+	reportOpts  ReportOptions
+}
+
+// run loops until ctx is canceled, printing a fresh summary after every
+// settled change.
+func (w worktreeWatcher) run(ctx context.Context) {
+	last := ""
+	for ctx.Err() == nil {
+		state, err := w.fingerprint(ctx)
+		if err != nil && ctx.Err() == nil {
+			logf("warning", "", "", "watch: %v", err)
+		}
+		if err == nil && state != last {
+			// Debounce: wait until the tree stops changing.
+			for sleepCtx(ctx, watchDebounce) {
+				next, err := w.fingerprint(ctx)
+				if err != nil || next == state {
+					break
+				}
+				state = next
+			}
+			last = state
+			w.report(ctx)
+		}
+		sleepCtx(ctx, watchPollInterval)
+	}
+}
+
+// sleepCtx waits for d and reports true, or returns false as soon as ctx is
+// canceled.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// fingerprint summarizes path, size and mtime of every watched file.
+func (w worktreeWatcher) fingerprint(ctx context.Context) (string, error) {
+	files, err := listSourceFiles(ctx, w.src, w.match)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, f := range files {
+		fi, err := os.Stat(filepath.Join(w.src.root, filepath.FromSlash(f)))
+		if err != nil {
+			continue // deleted but still in the index
+		}
+		fmt.Fprintf(&b, "%s\x00%d\x00%d\n", f, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+func (w worktreeWatcher) report(ctx context.Context) {
+	funcs, types, failures, err := w.collect(ctx, w.src, w.repoRoot, w.collectOpts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		logf("warning", "", "", "watch: %v", err)
+		return
+	}
+	diff := diffFuncs(funcs, w.base, w.diffOpts)
+	diff.ChangedTypes = diffTypes(types, w.baseTypes)
+	diff.ParseFailures = failures
+
+	if isTerminal(os.Stdout) {
+		fmt.Print("\x1b[H\x1b[2J") // clear screen, cursor home
+	}
+	fmt.Println(buildTermReport(diff, w.reportOpts, useColor(os.Stdout)))
+	fmt.Printf("  (watching, updated %s; Ctrl-C to stop)\n", time.Now().Format("15:04:05"))
+}
+
+// snapshotSource stands in for a side loaded from a --baseline snapshot.
+// Snapshots hold function metadata only, so no file can be read back.
+type snapshotSource struct{ snap *snapshot }
+
+func (s snapshotSource) Name() string { return s.snap.Ref + " (snapshot)" }
+
+func (s snapshotSource) ListFiles(ctx context.Context) ([]string, error) {
+	return nil, fmt.Errorf("snapshot %s does not store files", s.snap.Ref)
+}
+
+func (s snapshotSource) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return nil, fmt.Errorf("snapshot %s does not store file contents", s.snap.Ref)
+}
+
+// snapshotVersion is bumped whenever the snapshot format changes
+// incompatibly.
+const snapshotVersion = 2
+
+// snapshot is the on-disk JSON form of one side's FuncSet.
+type snapshot struct {
+	Version int         `json:"version"`
+	Lang    string      `json:"lang"`
+	Ref     string      `json:"ref"`
+	Funcs   []*FuncInfo `json:"funcs"`
+	Types   []*TypeInfo `json:"types,omitempty"`
+}
+
+func (s *snapshot) funcSet() FuncSet {
+	funcs := make(FuncSet, len(s.Funcs))
+	for _, f := range s.Funcs {
+		funcs[funcKeyOf(f)] = f
+	}
+	return funcs
+}
+
+func (s *snapshot) typeSet() TypeSet {
+	types := make(TypeSet, len(s.Types))
+	for _, t := range s.Types {
+		types[typeKeyOf(t)] = t
+	}
+	return types
+}
+
+// saveSnapshot writes funcs and types to path as a snapshot of ref.
+func saveSnapshot(path, ref, lang string, funcs FuncSet, types TypeSet) error {
+	snap := snapshot{Version: snapshotVersion, Lang: lang, Ref: ref}
+	for _, f := range funcs {
+		snap.Funcs = append(snap.Funcs, f)
+	}
+	sort.Slice(snap.Funcs, func(i, j int) bool {
+		a, b := snap.Funcs[i], snap.Funcs[j]
+		if ka, kb := funcSortKey(a), funcSortKey(b); ka != kb {
+			return ka < kb
+		}
+		return a.Build < b.Build
+	})
+	for _, t := range types {
+		snap.Types = append(snap.Types, t)
+	}
+	sort.Slice(snap.Types, func(i, j int) bool {
+		return typeLess(snap.Types[i], snap.Types[j])
+	})
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("write snapshot %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadSnapshot reads a snapshot written by saveSnapshot for lang.
+func loadSnapshot(path, lang string) (*snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("decode snapshot %s: %w", path, err)
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot %s has version %d, expected %d", path, snap.Version, snapshotVersion)
+	}
+	if snap.Lang != lang {
+		return nil, fmt.Errorf("snapshot %s was taken with --lang %s, not %s", path, snap.Lang, lang)
+	}
+	return &snap, nil
+}
+
+// cacheVersion is bumped whenever cacheEntry changes incompatibly.
+const cacheVersion = 6
+
+// cacheEntry is the on-disk form of one collection result in a
+// collectCache.
+type cacheEntry struct {
+	Version  int            `json:"version"`
+	Funcs    []*FuncInfo    `json:"funcs"`
+	Types    []*TypeInfo    `json:"types,omitempty"`
+	Failures []ParseFailure `json:"failures,omitempty"`
+}
+
+// collectCache keeps what a collector returned for a git ref on disk, keyed
+// by the tree the ref resolves to, so a later run against the same tree
+// skips listing and parsing files. Keys also cover the funcdiff executable,
+// --lang, the collection options and $GOOS/$GOARCH, so anything that could
+// change the result misses the cache.
+type collectCache struct {
+	dir  string
+	lang string
+	tool string // fingerprint of the running executable
+}
+
+// newCollectCache returns a cache under dir, or under the user cache
+// directory when dir is "".
+func newCollectCache(dir, lang string) (*collectCache, error) {
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("no cache directory (use --cache-dir or --no-cache): %w", err)
+		}
+		dir = filepath.Join(cache, "funcdiff", "funcsets")
+	}
+	// Resolve now: --dir changes the working directory later.
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("locate funcdiff executable: %w", err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		return nil, fmt.Errorf("fingerprint funcdiff executable: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return &collectCache{dir: dir, lang: lang, tool: fmt.Sprintf("%x", sum)}, nil
+}
+
+// path returns the entry file for tree collected with opts.
+func (c *collectCache) path(tree string, opts CollectOptions) string {
+	opts.Jobs = 0 // doesn't affect the result
+	key, _ := json.Marshal(struct {
+		Tool, Lang, Tree, GOOS, GOARCH string
+		Opts                           CollectOptions
+	}{c.tool, c.lang, tree, os.Getenv("GOOS"), os.Getenv("GOARCH"), opts})
+	sum := sha256.Sum256(key)
+	return filepath.Join(c.dir, fmt.Sprintf("%x.json", sum[:16]))
+}
+
+// wrap returns a collectFunc that serves git refs from the cache and fills
+// it on a miss. Other sources (the working tree, an empty tree) are always
+// collected afresh. Problems with the cache itself only cost a warning.
+func (c *collectCache) wrap(collect collectFunc) collectFunc {
+	return func(ctx context.Context, src fileSource, repoRoot string, opts CollectOptions) (FuncSet, TypeSet, []ParseFailure, error) {
+		gs, ok := src.(gitRefSource)
+		if !ok {
+			return collect(ctx, src, repoRoot, opts)
+		}
+		out, err := runGit(ctx, gs.dir, "rev-parse", "--verify", "--end-of-options", gs.ref+"^{tree}")
+		if err != nil {
+			return collect(ctx, src, repoRoot, opts)
+		}
+		path := c.path(strings.TrimSpace(string(out)), opts)
+
+		if entry, err := readCacheEntry(path); err == nil {
+			funcs := make(FuncSet, len(entry.Funcs))
+			for _, f := range entry.Funcs {
+				funcs[funcKeyOf(f)] = f
+			}
+			types := make(TypeSet, len(entry.Types))
+			for _, t := range entry.Types {
+				types[typeKeyOf(t)] = t
+			}
+			// The same tree may have been cached under another ref name.
+			for i := range entry.Failures {
+				entry.Failures[i].Ref = src.Name()
+			}
+			return funcs, types, entry.Failures, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			logf("warning", "", src.Name(), "ignoring cache entry for %s: %v", src.Name(), err)
+		}
+
+		funcs, types, failures, err := collect(ctx, src, repoRoot, opts)
+		if err != nil || ctx.Err() != nil {
+			return funcs, types, failures, err
+		}
+		entry := cacheEntry{Version: cacheVersion, Failures: failures}
+		for _, f := range funcs {
+			entry.Funcs = append(entry.Funcs, f)
+		}
+		for _, t := range types {
+			entry.Types = append(entry.Types, t)
+		}
+		if err := writeCacheEntry(path, entry); err != nil {
+			logf("warning", "", src.Name(), "not caching %s: %v", src.Name(), err)
+		}
+		return funcs, types, failures, nil
+	}
+}
+
+func readCacheEntry(path string) (*cacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	if entry.Version != cacheVersion {
+		return nil, fmt.Errorf("%s has version %d, expected %d", path, entry.Version, cacheVersion)
+	}
+	return &entry, nil
+}
+
+// writeCacheEntry writes entry through a temporary file, so concurrent runs
+// never read a partial entry.
+func writeCacheEntry(path string, entry cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".entry-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileContent is the result of reading one file.
+type fileContent struct {
+	data []byte
+	err  error
+}
+
+// readFiles reads files from source with up to jobs concurrent reads (0
+// means one per CPU) and yields each file's index and contents in the order
+// of files, so callers can process them, and report problems,
+// deterministically. Reads run ahead of the caller by at most 2*jobs files,
+// so only that many contents are held at once however many files there are.
+// Stopping the loop early cancels the reads still pending.
+func readFiles(ctx context.Context, source fileSource, files []string, jobs int) iter.Seq2[int, fileContent] {
+	return func(yield func(int, fileContent) bool) {
+		if jobs <= 0 {
+			jobs = runtime.NumCPU()
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		defer func() {
+			cancel()
+			wg.Wait()
+		}()
+
+		// Each file gets its own one-slot channel so workers never wait on
+		// the caller; ahead holds a token per file read but not yet yielded.
+		results := make([]chan fileContent, len(files))
+		for i := range results {
+			results[i] = make(chan fileContent, 1)
+		}
+		ahead := make(chan struct{}, 2*jobs)
+		next := make(chan int)
+		go func() {
+			defer close(next)
+			for i := range files {
+				select {
+				case ahead <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case next <- i:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		for w := 0; w < jobs && w < len(files); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					data, err := source.ReadFile(ctx, files[i])
+					results[i] <- fileContent{data, err}
+				}
+			}()
+		}
+
+		for i := range files {
+			content := <-results[i]
+			<-ahead
+			if !yield(i, content) {
+				return
+			}
+		}
+	}
+}
+
+// listSourceFiles returns the files of src accepted by match.
+func listSourceFiles(ctx context.Context, src fileSource, match func(string) bool) ([]string, error) {
+	all, err := src.ListFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range all {
+		if match(f) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// collectFunc is the signature shared by the per-language collectors.
+type collectFunc func(ctx context.Context, src fileSource, repoRoot string, opts CollectOptions) (FuncSet, TypeSet, []ParseFailure, error)
+
+// funcKeyOf returns the FuncSet key identifying info.
+func funcKeyOf(info *FuncInfo) FuncKey {
+	key := FuncKey{
+		Package:  info.Package,
+		Receiver: info.Receiver,
+		Name:     info.Name,
+		Build:    info.Build,
+	}
+	if info.Ordinal > 0 {
+		key.File = info.File
+		key.Ordinal = info.Ordinal
+	}
+	if info.Duplicate > 0 {
+		key.File = info.File
+		key.Duplicate = info.Duplicate
+	}
+	return key
+}
+
+// addFunc adds info to funcs. A declaration whose key is already taken is
+// kept under a key that includes its file (see FuncInfo.Duplicate) instead
+// of overwriting the earlier one, and a warning names both.
+func addFunc(funcs FuncSet, info *FuncInfo, ref string) {
+	prev, ok := funcs[funcKeyOf(info)]
+	for ok {
+		info.Duplicate++
+		_, ok = funcs[funcKeyOf(info)]
+	}
+	if prev != nil {
+		logf("warning", info.File, ref, "%s.%s is declared more than once at %s (%s:%d and %s:%d); keeping both",
+			info.Package, qualifiedName(info), ref, prev.File, prev.StartLine, info.File, info.StartLine)
+	}
+	funcs[funcKeyOf(info)] = info
+}
+
+// isRepeatableFunc reports whether fn may legally share its name with other
+// declarations in the same package: init functions and blank (_) functions
+// or methods.
+func isRepeatableFunc(fn *ast.FuncDecl) bool {
+	return fn.Name.Name == "_" || (fn.Name.Name == "init" && fn.Recv == nil)
+}
+
+// collectFuncs parses Go files from a source and builds a FuncSet.
+func collectGoFuncs(ctx context.Context, source fileSource, repoRoot string, opts CollectOptions) (FuncSet, TypeSet, []ParseFailure, error) {
+	ref := source.Name()
+	all, err := source.ListFiles(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var files, modFiles []string
+	for _, f := range all {
+		switch {
+		case isGoSourceFile(f):
+			if opts.includedPath(f) {
+				files = append(files, f)
+			}
+		case path.Base(f) == "go.mod":
+			modFiles = append(modFiles, f)
+		}
+	}
+	modules := readGoModules(ctx, source, modFiles, opts.Jobs)
+
+	fset := token.NewFileSet()
+	funcs := make(FuncSet)
+	types := make(TypeSet)
+	var failures []ParseFailure
+	var checked typeCheckSet
+	if opts.TypeCheck {
+		checked = typeCheckSet{files: make(map[string][]*ast.File), decls: make(map[*FuncInfo]*ast.FuncDecl)}
+	}
+
+	for i, content := range readFiles(ctx, source, files, opts.Jobs) {
+		path := files[i]
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+		src, err := content.data, content.err
+		if err != nil {
+			// If a single file fails (e.g. deleted or binary), log and continue.
+			logf("warning", path, ref, "skipping %s@%s: %v", path, ref, err)
+			continue
+		}
+
+		buildExpr, err := fileBuildConstraint(path, src)
+		if err != nil {
+			logf("warning", path, ref, "bad build constraint in %s@%s: %v", path, ref, err)
+		}
+		if len(opts.Tags) > 0 && buildExpr != nil && !buildExpr.Eval(buildTagSet(opts.Tags)) {
+			// Excluded by --tags, exactly as `go build -tags` would.
+			continue
+		}
+		build := ""
+		if buildExpr != nil {
+			build = buildExpr.String()
+		}
+
+		// Comments are kept so doc comments (fn.Doc) and in-body comments are
+		// available; they don't affect positions, see StartLine below.
+		file, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+		if err != nil {
+			failures = append(failures, ParseFailure{Ref: ref, File: path, Err: err.Error()})
+			continue
+		}
+
+		pkgPath := goPackagePath(path, file.Name.Name, modules)
+		if checked.files != nil {
+			// Filtered-out packages are still checked: others may import them.
+			checked.files[pkgPath] = append(checked.files[pkgPath], file)
+		}
+
+		if opts.PackageFilter != "" && !strings.Contains(pkgPath, opts.PackageFilter) {
+			continue
+		}
+
+		collectTypes(types, fset, file, pkgPath, build, opts)
+
+		var gofmtHashes []string
+		if opts.GofmtBodies {
+			gofmtHashes = gofmtBodyHashes(path, src, file, opts.Normalize)
+		}
+
+		ordinals := make(map[string]int) // receiver+name -> count so far
+		declIndex := -1
+		ast.Inspect(file, func(n ast.Node) bool {
+			fn, ok := n.(*ast.FuncDecl)
+			if !ok {
+				return true
+			}
+			declIndex++
+
+			name := fn.Name.Name
+			if !fn.Name.IsExported() && !opts.keepUnexported(pkgPath) {
+				return true
+			}
+			if opts.excludedName(name) {
+				return true
+			}
+
+			receiver := formatReceiver(fn.Recv)
+			if opts.PublicSurface && !onPublicSurface(fn.Name.IsExported(), receiver) {
+				return true
+			}
+			ordinal := 0
+			if isRepeatableFunc(fn) {
+				ordinals[receiver+"."+name]++
+				ordinal = ordinals[receiver+"."+name]
+			}
+			exported := fn.Name.IsExported()
+			signature := formatSignature(fn.Type)
+
+			// fn.Pos() is the "func" keyword, so a leading doc comment is not
+			// part of the reported line range; it is exposed via FuncInfo.Doc.
+			// Positions ignore //line directives: lines must index into the
+			// file as stored, since that is what bodies are sliced from.
+			pos := fset.PositionFor(fn.Pos(), false)
+			end := fset.PositionFor(fn.End(), false)
+			startLine := pos.Line
+			endLine := end.Line
+			lineCount := endLine - startLine + 1
+			if lineCount < 0 {
+				lineCount = 0
+			}
+			var lineDirective string
+			if mapped := fset.Position(fn.Pos()); mapped != pos {
+				lineDirective = fmt.Sprintf("%s:%d", filepath.ToSlash(mapped.Filename), mapped.Line)
+			}
+
+			var hash string
+			if fn.Body != nil && !opts.NoBody {
+				from := fset.Position(fn.Body.Lbrace).Offset
+				to := fset.Position(fn.Body.Rbrace).Offset + 1
+				hash = bodyHash(string(src[from:to]), opts.Normalize)
+			}
+			if gofmtHashes != nil {
+				hash = gofmtHashes[declIndex]
+			}
+
+			info := &FuncInfo{
+				Package:   pkgPath,
+				File:      path,
+				Name:      name,
+				Receiver:  receiver,
+				Signature: signature,
+				Exported:  exported,
+				StartLine: startLine,
+				EndLine:   endLine,
+				LineCount: lineCount,
+				Build:     build,
+				BodyHash:  hash,
+
+				LineDirective: lineDirective,
+
+				ParamTypes:  fieldListTypes(fn.Type.Params),
+				ResultTypes: fieldListTypes(fn.Type.Results),
+				TypeParams:  fieldListTypes(fn.Type.TypeParams),
+				Doc:         fn.Doc.Text(),
+				Ordinal:     ordinal,
+			}
+			if !opts.NoBody {
+				analyzeBody(info, fn)
+				countDebtMarkers(info, fn.Body, file.Comments)
+			}
+
+			addFunc(funcs, info, ref)
+			if checked.decls != nil {
+				checked.decls[info] = fn
+			}
+
+			return true
+		})
+	}
+
+	if checked.files != nil {
+		checked.resolve(fset, ref)
+	}
+
+	return funcs, types, failures, nil
+}
+
+// typeCheckSet holds what --typecheck needs after a ref's Go files have been
+// parsed: the files of every package, keyed by package path as returned by
+// goPackagePath, and the declaration each collected function came from.
+type typeCheckSet struct {
+	files map[string][]*ast.File
+	decls map[*FuncInfo]*ast.FuncDecl
+}
+
+// resolve type-checks every package in s and rewrites Signature, ParamTypes
+// and ResultTypes of the collected functions from the resolved types.
+// Packages inside the ref are imported from its own sources; everything
+// else goes through the default importer. Type errors don't stop the check:
+// a function keeps its AST rendering only if one of its types stayed
+// unresolved.
+func (s typeCheckSet) resolve(fset *token.FileSet, ref string) {
+	imp := &refImporter{
+		fset:     fset,
+		ref:      ref,
+		files:    s.files,
+		byImport: make(map[string]string),
+		pkgs:     make(map[string]*types.Package),
+		infos:    make(map[string]*types.Info),
+		fallback: importer.Default(),
+	}
+	pkgPaths := make([]string, 0, len(s.files))
+	for pkgPath := range s.files {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+	for _, pkgPath := range pkgPaths {
+		// When a directory holds several packages (say a //go:build ignore
+		// generator), the first one in sort order is the importable one.
+		if _, ok := imp.byImport[importPathOf(pkgPath)]; !ok {
+			imp.byImport[importPathOf(pkgPath)] = pkgPath
+		}
+	}
+
+	resolved := 0
+	for info, fn := range s.decls {
+		pkg, typesInfo := imp.check(info.Package)
+		obj, ok := typesInfo.Defs[fn.Name].(*types.Func)
+		if !ok {
+			continue
+		}
+		sig := obj.Type().(*types.Signature)
+		qf := func(p *types.Package) string {
+			if p == pkg {
+				return ""
+			}
+			return p.Path()
+		}
+		signature, params, results := typedSignature(sig, qf)
+		if strings.Contains(signature, "invalid type") {
+			continue
+		}
+		info.Signature = signature
+		info.ParamTypes = params
+		info.ResultTypes = results
+		resolved++
+	}
+	logf("info", "", ref, "--typecheck: checked %d packages at %s; %d of %d signatures resolved", len(imp.pkgs), ref, resolved, len(s.decls))
+}
+
+// importPathOf returns the import path of the package whose goPackagePath
+// is pkgPath.
+func importPathOf(pkgPath string) string {
+	return path.Dir(pkgPath)
+}
+
+// refImporter imports packages for --typecheck: those whose sources were
+// collected from the ref are type-checked from them, the rest are handed to
+// fallback.
+type refImporter struct {
+	fset     *token.FileSet
+	ref      string
+	files    map[string][]*ast.File
+	byImport map[string]string // import path -> package path
+	pkgs     map[string]*types.Package
+	infos    map[string]*types.Info
+	fallback types.Importer
+}
+
+func (imp *refImporter) Import(importPath string) (*types.Package, error) {
+	pkgPath, ok := imp.byImport[importPath]
+	if !ok {
+		return imp.fallback.Import(importPath)
+	}
+	pkg, _ := imp.check(pkgPath)
+	if !pkg.Complete() {
+		// Still being checked further up the stack.
+		return nil, fmt.Errorf("import cycle through %s", importPath)
+	}
+	return pkg, nil
+}
+
+// check type-checks the package at pkgPath once and returns the result. The
+// package is returned even if it has errors; the first one is logged.
+func (imp *refImporter) check(pkgPath string) (*types.Package, *types.Info) {
+	if pkg, ok := imp.pkgs[pkgPath]; ok {
+		return pkg, imp.infos[pkgPath]
+	}
+	info := &types.Info{Defs: make(map[*ast.Ident]types.Object)}
+	var firstErr error
+	conf := types.Config{
+		Importer:    imp,
+		FakeImportC: true,
+		Error: func(err error) {
+			if firstErr == nil {
+				firstErr = err
+			}
+		},
+	}
+	// Record an incomplete placeholder first so an import cycle ends instead
+	// of recursing.
+	imp.pkgs[pkgPath] = types.NewPackage(importPathOf(pkgPath), path.Base(pkgPath))
+	imp.infos[pkgPath] = info
+	pkg, _ := conf.Check(importPathOf(pkgPath), imp.fset, imp.files[pkgPath], info)
+	imp.pkgs[pkgPath] = pkg
+	if firstErr != nil {
+		logf("warning", "", imp.ref, "type-checking %s@%s: %v", importPathOf(pkgPath), imp.ref, firstErr)
+	}
+	return pkg, info
+}
+
+// typedSignature renders sig the way formatSignature renders the AST, plus
+// the per-position types fieldListTypes would return.
+func typedSignature(sig *types.Signature, qf types.Qualifier) (signature string, params, results []string) {
+	typeParams := ""
+	if tps := sig.TypeParams(); tps.Len() > 0 {
+		var parts []string
+		for i := 0; i < tps.Len(); i++ {
+			tp := tps.At(i)
+			parts = append(parts, tp.Obj().Name()+" "+typeString(tp.Constraint(), qf))
+		}
+		typeParams = "[" + strings.Join(parts, ", ") + "]"
+	}
+
+	tupleParts := func(t *types.Tuple, variadic bool) (parts, typs []string, named bool) {
+		for i := 0; i < t.Len(); i++ {
+			v := t.At(i)
+			typ := typeString(v.Type(), qf)
+			if variadic && i == t.Len()-1 {
+				typ = "..." + typeString(v.Type().(*types.Slice).Elem(), qf)
+			}
+			typs = append(typs, typ)
+			if v.Name() != "" {
+				named = true
+				typ = v.Name() + " " + typ
+			}
+			parts = append(parts, typ)
+		}
+		return parts, typs, named
+	}
+	paramParts, params, _ := tupleParts(sig.Params(), sig.Variadic())
+	resultParts, results, named := tupleParts(sig.Results(), false)
+
+	paramStr := strings.Join(paramParts, ", ")
+	switch {
+	case len(resultParts) == 0:
+		return fmt.Sprintf("%s(%s)", typeParams, paramStr), params, results
+	case len(resultParts) == 1 && !named:
+		return fmt.Sprintf("%s(%s) %s", typeParams, paramStr, resultParts[0]), params, results
+	}
+	return fmt.Sprintf("%s(%s) (%s)", typeParams, paramStr, strings.Join(resultParts, ", ")), params, results
+}
+
+// typeString is types.TypeString with aliases resolved at every level, so a
+// parameter declared through an alias reads as the type it stands for.
+func typeString(t types.Type, qf types.Qualifier) string {
+	switch t := types.Unalias(t).(type) {
+	case *types.Named:
+		name := t.Obj().Name()
+		if pkg := t.Obj().Pkg(); pkg != nil {
+			if q := qf(pkg); q != "" {
+				name = q + "." + name
+			}
+		}
+		if args := t.TypeArgs(); args.Len() > 0 {
+			var parts []string
+			for i := 0; i < args.Len(); i++ {
+				parts = append(parts, typeString(args.At(i), qf))
+			}
+			name += "[" + strings.Join(parts, ", ") + "]"
+		}
+		return name
+	case *types.Pointer:
+		return "*" + typeString(t.Elem(), qf)
+	case *types.Slice:
+		return "[]" + typeString(t.Elem(), qf)
+	case *types.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), typeString(t.Elem(), qf))
+	case *types.Map:
+		return "map[" + typeString(t.Key(), qf) + "]" + typeString(t.Elem(), qf)
+	case *types.Chan:
+		switch t.Dir() {
+		case types.SendOnly:
+			return "chan<- " + typeString(t.Elem(), qf)
+		case types.RecvOnly:
+			return "<-chan " + typeString(t.Elem(), qf)
+		}
+		return "chan " + typeString(t.Elem(), qf)
+	case *types.Signature:
+		signature, _, _ := typedSignature(t, qf)
+		return "func" + signature
+	case *types.Interface:
+		if t.Empty() {
+			return "any"
+		}
+	}
+	return types.TypeString(t, qf)
+}
+
+// collectTypes adds the package-level struct and interface types declared in
+// file to types. Unexported types follow the same filtering as unexported
+// functions.
+func collectTypes(types TypeSet, fset *token.FileSet, file *ast.File, pkgPath, build string, opts CollectOptions) {
+	for _, decl := range file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Assign.IsValid() {
+				continue
+			}
+			var fields []FieldInfo
+			var iface bool
+			switch x := ts.Type.(type) {
+			case *ast.StructType:
+				fields = structFields(x)
+			case *ast.InterfaceType:
+				fields, iface = interfaceMethods(x), true
+			default:
+				continue
+			}
+			if !ts.Name.IsExported() && (opts.PublicSurface || !opts.keepUnexported(pkgPath)) {
+				continue
+			}
+			t := &TypeInfo{
+				Package:   pkgPath,
+				File:      fset.PositionFor(ts.Pos(), false).Filename,
+				Name:      ts.Name.Name,
+				Build:     build,
+				StartLine: fset.PositionFor(ts.Pos(), false).Line,
+				EndLine:   fset.PositionFor(ts.End(), false).Line,
+				Interface: iface,
+				Fields:    fields,
+			}
+			types[typeKeyOf(t)] = t
+		}
+	}
+}
+
+// structFields flattens the fields of st in declaration order.
+func structFields(st *ast.StructType) []FieldInfo {
+	var fields []FieldInfo
+	for _, f := range st.Fields.List {
+		typ := exprToString(f.Type)
+		var tag string
+		if f.Tag != nil {
+			tag, _ = strconv.Unquote(f.Tag.Value)
+		}
+		if len(f.Names) == 0 {
+			fields = append(fields, FieldInfo{Name: embeddedFieldName(f.Type), Type: typ, Tag: tag, Embedded: true})
+			continue
+		}
+		for _, n := range f.Names {
+			fields = append(fields, FieldInfo{Name: n.Name, Type: typ, Tag: tag})
+		}
+	}
+	return fields
+}
+
+// interfaceMethods lists the methods and embedded types of it in declaration
+// order. Type set terms such as "~int | ~string" are kept as embedded entries.
+func interfaceMethods(it *ast.InterfaceType) []FieldInfo {
+	var fields []FieldInfo
+	for _, m := range it.Methods.List {
+		ft, ok := m.Type.(*ast.FuncType)
+		if !ok || len(m.Names) == 0 {
+			typ := exprToString(m.Type)
+			fields = append(fields, FieldInfo{Name: embeddedFieldName(m.Type), Type: typ, Embedded: true})
+			continue
+		}
+		fields = append(fields, FieldInfo{Name: m.Names[0].Name, Type: methodType(ft)})
+	}
+	return fields
+}
+
+// methodType renders ft like formatSignature but with parameter and result
+// names dropped.
+func methodType(ft *ast.FuncType) string {
+	params := strings.Join(fieldListTypes(ft.Params), ", ")
+	results := fieldListTypes(ft.Results)
+	switch len(results) {
+	case 0:
+		return "(" + params + ")"
+	case 1:
+		return "(" + params + ") " + results[0]
+	}
+	return "(" + params + ") (" + strings.Join(results, ", ") + ")"
+}
+
+// embeddedFieldName returns the implicit name of an embedded field: its type
+// name without pointer, package qualifier or type arguments.
+func embeddedFieldName(e ast.Expr) string {
+	switch t := e.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.StarExpr:
+		return embeddedFieldName(t.X)
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	case *ast.IndexExpr:
+		return embeddedFieldName(t.X)
+	case *ast.IndexListExpr:
+		return embeddedFieldName(t.X)
+	}
+	return exprToString(e)
+}
+
+// typeChange is a struct or interface type whose fields or methods differ
+// between the refs. From and To follow DiffResult (from is the newer side);
+// Retyped and Retagged hold [from, to] pairs. For interfaces, Retyped holds
+// methods whose signature changed and Retagged is always empty.
+type typeChange struct {
+	From, To *TypeInfo
+	Added    []FieldInfo
+	Removed  []FieldInfo
+	Retyped  [][2]FieldInfo
+	Retagged [][2]FieldInfo
+}
+
+// diffTypes compares the struct and interface types present in both refs
+// field by field (method by method for interfaces), matching fields by name,
+// and returns the ones that differ. Reordering fields alone is not reported.
+// Blank (_) fields are matched by their position among the blank fields. A
+// type that changed from struct to interface or back is not reported.
+func diffTypes(from, to TypeSet) []typeChange {
+	var changes []typeChange
+	for key, f := range from {
+		t, ok := to[key]
+		if !ok || f.Interface != t.Interface {
+			continue
+		}
+		toFields := fieldsByName(t.Fields)
+		fromFields := fieldsByName(f.Fields)
+		c := typeChange{From: f, To: t}
+		for i, ff := range f.Fields {
+			tf, ok := toFields[fieldKey(f.Fields, i)]
+			switch {
+			case !ok:
+				c.Added = append(c.Added, ff)
+			case ff.Embedded != tf.Embedded || canonicalType(ff.Type) != canonicalType(tf.Type):
+				c.Retyped = append(c.Retyped, [2]FieldInfo{ff, tf})
+			case ff.Tag != tf.Tag:
+				c.Retagged = append(c.Retagged, [2]FieldInfo{ff, tf})
+			}
+		}
+		for i, tf := range t.Fields {
+			if _, ok := fromFields[fieldKey(t.Fields, i)]; !ok {
+				c.Removed = append(c.Removed, tf)
+			}
+		}
+		if len(c.Added)+len(c.Removed)+len(c.Retyped)+len(c.Retagged) > 0 {
+			changes = append(changes, c)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return typeLess(changes[i].From, changes[j].From)
+	})
+	return changes
+}
+
+// fieldKey identifies fields[i] by name, or as "_#n" for the n-th blank
+// field.
+func fieldKey(fields []FieldInfo, i int) string {
+	if fields[i].Name != "_" {
+		return fields[i].Name
+	}
+	n := 0
+	for _, f := range fields[:i] {
+		if f.Name == "_" {
+			n++
+		}
+	}
+	return fmt.Sprintf("_#%d", n)
+}
+
+func fieldsByName(fields []FieldInfo) map[string]FieldInfo {
+	m := make(map[string]FieldInfo, len(fields))
+	for i, f := range fields {
+		m[fieldKey(fields, i)] = f
+	}
+	return m
+}
+
+// fieldDecl renders f as declared, without its tag.
+func fieldDecl(f FieldInfo) string {
+	if f.Embedded {
+		return f.Type
+	}
+	return f.Name + " " + f.Type
+}
+
+func fieldTag(f FieldInfo) string {
+	if f.Tag == "" {
+		return "_none_"
+	}
+	return "`" + f.Tag + "`"
+}
+
+// splitTypeChanges separates struct changes from interface changes,
+// preserving order.
+func splitTypeChanges(changes []typeChange) (structs, ifaces []typeChange) {
+	for _, c := range changes {
+		if c.From.Interface {
+			ifaces = append(ifaces, c)
+		} else {
+			structs = append(structs, c)
+		}
+	}
+	return structs, ifaces
+}
+
+// writeStructChanges renders the "Struct Changes" section. Like Breaking
+// Changes, arrows read from the old definition to the new one.
+func writeStructChanges(b *strings.Builder, changes []typeChange) {
+	fmt.Fprintf(b, "#### Struct Changes\n\n")
+	for _, c := range changes {
+		fmt.Fprintf(b, "- `%s.%s` (`%s`)\n", c.From.Package, c.From.Name, c.From.File)
+		for _, f := range c.Added {
+			fmt.Fprintf(b, "  - added `%s`\n", fieldDecl(f))
+		}
+		for _, f := range c.Removed {
+			fmt.Fprintf(b, "  - removed `%s`\n", fieldDecl(f))
+		}
+		for _, p := range c.Retyped {
+			fmt.Fprintf(b, "  - `%s`: `%s` → `%s`\n", p[0].Name, p[1].Type, p[0].Type)
+		}
+		for _, p := range c.Retagged {
+			fmt.Fprintf(b, "  - `%s` tag: %s → %s\n", p[0].Name, fieldTag(p[1]), fieldTag(p[0]))
+		}
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// writeInterfaceChanges renders the "Interface Changes" section. Arrows read
+// from the old method signature to the new one.
+func writeInterfaceChanges(b *strings.Builder, changes []typeChange) {
+	fmt.Fprintf(b, "#### Interface Changes\n\n")
+	for _, c := range changes {
+		fmt.Fprintf(b, "- `%s.%s` (`%s`)\n", c.From.Package, c.From.Name, c.From.File)
+		for _, m := range c.Added {
+			fmt.Fprintf(b, "  - added %s\n", methodDecl(m))
+		}
+		for _, m := range c.Removed {
+			fmt.Fprintf(b, "  - removed %s\n", methodDecl(m))
+		}
+		for _, p := range c.Retyped {
+			fmt.Fprintf(b, "  - `%s`: `%s` → `%s`\n", p[0].Name, methodSig(p[1]), methodSig(p[0]))
+		}
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// methodSig renders an interface entry as declared: "Read([]byte) (int,
+// error)" for a method, the type itself for an embedded interface.
+func methodSig(m FieldInfo) string {
+	if m.Embedded {
+		return m.Type
+	}
+	return m.Name + m.Type
+}
+
+func methodDecl(m FieldInfo) string {
+	if m.Embedded {
+		return "embedded `" + m.Type + "`"
+	}
+	return "method `" + methodSig(m) + "`"
+}
+
+// gofmtBodyHashes formats src with gofmt and returns the body hash of every
+// function declaration in the formatted source, in declaration order, so that
+// index i belongs to the i-th FuncDecl of file. Bodies are not standalone
+// units, so the whole file is formatted and re-parsed. Blank lines, which
+// gofmt keeps (collapsed to one), are dropped as well. It returns nil if
+// formatting fails, leaving the caller with the unformatted hashes.
+func gofmtBodyHashes(path string, src []byte, file *ast.File, norm BodyNormalization) []string {
+	formatted, err := format.Source(src)
+	if err != nil {
+		return nil
+	}
+	fset := token.NewFileSet()
+	ff, err := parser.ParseFile(fset, path, formatted, parser.ParseComments)
+	if err != nil {
+		return nil
+	}
+
+	var hashes []string
+	for _, d := range ff.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		var hash string
+		if fn.Body != nil {
+			from := fset.Position(fn.Body.Lbrace).Offset
+			to := fset.Position(fn.Body.Rbrace).Offset + 1
+			hash = bodyHash(dropBlankLines(string(formatted[from:to])), norm)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// gofmt never adds, drops or reorders declarations; bail out if the
+	// two parses somehow disagree rather than mismatch hashes.
+	n := 0
+	for _, d := range file.Decls {
+		if _, ok := d.(*ast.FuncDecl); ok {
+			n++
+		}
+	}
+	if n != len(hashes) {
+		return nil
+	}
+	return hashes
+}
+
+// dropBlankLines removes every whitespace-only line from s.
+func dropBlankLines(s string) string {
+	lines := strings.Split(s, "\n")
+	kept := lines[:0]
+	for _, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			kept = append(kept, l)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// analyzeBody fills the body-derived metrics of info by walking fn's body.
+func analyzeBody(info *FuncInfo, fn *ast.FuncDecl) {
+	body := fn.Body
+	if body == nil {
+		return
+	}
+	self := fn.Name.Name
+	if fn.Recv != nil && len(fn.Recv.List) > 0 && len(fn.Recv.List[0].Names) > 0 {
+		self = fn.Recv.List[0].Names[0].Name + "." + self
+	} else if fn.Recv != nil {
+		self = "" // anonymous receiver: the method can't name itself
+	}
+	info.Complexity = 1
+	info.Stub = stubKind(body)
+	calls := make(map[string]bool)
+	// A switch or select counts one level per case clause, not an extra
+	// level for the braces around the clauses.
+	clauseBodies := make(map[*ast.BlockStmt]bool)
+	var nests []bool // per open node: did it add a level?
+	depth := 0
+	ast.Inspect(body, func(n ast.Node) bool {
+		if n == nil {
+			if nests[len(nests)-1] {
+				depth--
+			}
+			nests = nests[:len(nests)-1]
+			return true
+		}
+		nested := false
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			info.Closures++
+		case *ast.GoStmt:
+			info.Goroutines++
+		case *ast.DeferStmt:
+			info.Defers++
+		case *ast.SwitchStmt:
+			clauseBodies[n.Body] = true
+		case *ast.TypeSwitchStmt:
+			clauseBodies[n.Body] = true
+		case *ast.SelectStmt:
+			clauseBodies[n.Body] = true
+		case *ast.BlockStmt:
+			nested = n != body && !clauseBodies[n]
+		case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt:
+			info.Complexity++
+		case *ast.CaseClause:
+			nested = true
+			if n.List != nil {
+				info.Complexity++
+			}
+		case *ast.CommClause:
+			nested = true
+			if n.Comm != nil {
+				info.Complexity++
+			}
+		case *ast.BinaryExpr:
+			if n.Op == token.LAND || n.Op == token.LOR {
+				info.Complexity++
+			}
+		case *ast.CallExpr:
+			if name := callName(n.Fun); name != "" && !isConversion(n.Fun) {
+				calls[name] = true
+				if name == self {
+					info.Recursive = true
+				}
+				if kind := errorExitKind(name); kind != "" {
+					countErrorExit(info, kind)
+				}
+				countErrorWraps(info, name, n.Args)
+			}
+		case *ast.ReturnStmt:
+			if len(n.Results) > 0 {
+				if id, ok := n.Results[len(n.Results)-1].(*ast.Ident); ok && id.Name == "err" {
+					countErrorExit(info, "return err")
+				}
+			}
+		}
+		if nested {
+			depth++
+			if depth > info.MaxDepth {
+				info.MaxDepth = depth
+			}
+		}
+		nests = append(nests, nested)
+		return true
+	})
+
+	for name := range calls {
+		info.Calls = append(info.Calls, name)
+	}
+	sort.Strings(info.Calls)
+}
+
+// stubKind classifies body as a placeholder (see FuncInfo.Stub), or returns
+// "" for a real body.
+func stubKind(body *ast.BlockStmt) string {
+	switch len(body.List) {
+	case 0:
+		return "empty"
+	case 1:
+	default:
+		return ""
+	}
+	switch st := body.List[0].(type) {
+	case *ast.ExprStmt:
+		if call, ok := st.X.(*ast.CallExpr); ok {
+			if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "panic" {
+				return "panic"
+			}
+		}
+	case *ast.ReturnStmt:
+		for _, r := range st.Results {
+			if !isZeroLiteral(r) {
+				return ""
+			}
+		}
+		return "return"
+	}
+	return ""
+}
+
+// isZeroLiteral reports whether e spells a zero value: nil, false, 0, "",
+// or an empty composite literal such as T{}.
+func isZeroLiteral(e ast.Expr) bool {
+	switch x := e.(type) {
+	case *ast.Ident:
+		return x.Name == "nil" || x.Name == "false"
+	case *ast.BasicLit:
+		switch x.Value {
+		case "0", "0.0", `""`, "``":
+			return true
+		}
+	case *ast.CompositeLit:
+		return len(x.Elts) == 0
+	case *ast.ParenExpr:
+		return isZeroLiteral(x.X)
+	}
+	return false
+}
+
+// stubDescriptions describe FuncInfo.Stub values in reports.
+var stubDescriptions = map[string]string{
+	"empty":  "empty body",
+	"panic":  "only panics",
+	"return": "only returns zero values",
+}
+
+// stubChanges returns the changed functions whose from side became a stub
+// while their to side was not one, and the new functions that are stubs,
+// each by package, file, receiver and name.
+func stubChanges(diff DiffResult) (reduced [][2]*FuncInfo, added []*FuncInfo) {
+	for _, pair := range diff.ChangedFuncs {
+		if pair[0].Stub != "" && pair[1].Stub == "" {
+			reduced = append(reduced, pair)
+		}
+	}
+	for _, f := range diff.NewFuncs {
+		if f.Stub != "" {
+			added = append(added, f)
+		}
+	}
+	sortPairs(reduced)
+	sortFuncs(added)
+	return reduced, added
+}
+
+// writeStubChanges renders the "Functions Reduced to Stubs" warning section.
+func writeStubChanges(b *strings.Builder, reduced [][2]*FuncInfo, added []*FuncInfo, opts ReportOptions) {
+	fmt.Fprintf(b, "#### Functions Reduced to Stubs\n\n")
+	if len(reduced) > 0 {
+		fmt.Fprintf(b, "> **Warning:** these functions had a real body in `%s` but are placeholders in `%s`, which can mean logic was lost in a bad merge.\n\n", opts.ToRef, opts.FromRef)
+		for _, pair := range reduced {
+			f := pair[0]
+			fmt.Fprintf(b, "- `%s.%s` (`%s`): %s (%d → %d LOC)\n", f.Package, qualifiedName(f), f.File, stubDescriptions[f.Stub], pair[1].LineCount, f.LineCount)
+		}
+		fmt.Fprintf(b, "\n")
+	}
+	if len(added) > 0 {
+		fmt.Fprintf(b, "New functions that are already stubs:\n\n")
+		for _, f := range added {
+			fmt.Fprintf(b, "- `%s.%s` (`%s`): %s\n", f.Package, qualifiedName(f), f.File, stubDescriptions[f.Stub])
+		}
+		fmt.Fprintf(b, "\n")
+	}
+}
+
+// debtMarkerRe matches the technical-debt markers counted in DebtMarkers.
+var debtMarkerRe = regexp.MustCompile(`\b(TODO|FIXME|XXX)\b`)
+
+// countDebtMarkers fills info.DebtMarkers from the comments that lie inside
+// body.
+func countDebtMarkers(info *FuncInfo, body *ast.BlockStmt, comments []*ast.CommentGroup) {
+	if body == nil {
+		return
+	}
+	for _, cg := range comments {
+		if cg.Pos() < body.Lbrace || cg.End() > body.Rbrace {
+			continue
+		}
+		for _, c := range cg.List {
+			for _, m := range debtMarkerRe.FindAllString(c.Text, -1) {
+				if info.DebtMarkers == nil {
+					info.DebtMarkers = make(map[string]int)
+				}
+				info.DebtMarkers[m]++
+			}
+		}
+	}
+}
+
+// callName renders the callee of a call by name only: "f", "pkg.F",
+// "x.y.M", "f().M" for a call on a call result, and the generic function
+// itself for an instantiation like f[T]. It returns "" for callees that have
+// no name, such as function literals.
+func callName(fun ast.Expr) string {
+	switch e := fun.(type) {
+	case *ast.Ident:
+		return e.Name
+	case *ast.SelectorExpr:
+		if x := callName(e.X); x != "" {
+			return x + "." + e.Sel.Name
+		}
+		return e.Sel.Name
+	case *ast.CallExpr:
+		if f := callName(e.Fun); f != "" {
+			return f + "()"
+		}
+	case *ast.IndexExpr:
+		return callName(e.X)
+	case *ast.IndexListExpr:
+		return callName(e.X)
+	case *ast.ParenExpr:
+		return callName(e.X)
+	case *ast.StarExpr:
+		return callName(e.X)
+	}
+	return ""
+}
+
+// isConversion reports whether a call of fun is obviously a type conversion:
+// to a predeclared type, as in int(x), or to a type literal, as in []byte(s).
+// Conversions to named types such as T(x) can't be told apart from calls
+// without type information and are kept.
+func isConversion(fun ast.Expr) bool {
+	switch e := fun.(type) {
+	case *ast.Ident:
+		_, ok := types.Universe.Lookup(e.Name).(*types.TypeName)
+		return ok
+	case *ast.ArrayType, *ast.MapType, *ast.ChanType, *ast.FuncType, *ast.InterfaceType, *ast.StructType:
+		return true
+	case *ast.ParenExpr:
+		return isConversion(e.X)
+	}
+	return false
+}
+
+// bodyMetrics are the per-function counters whose deltas are reported for
+// changed functions.
+var bodyMetrics = []struct {
+	label string
+	get   func(*FuncInfo) int
+}{
+	{"closures", func(f *FuncInfo) int { return f.Closures }},
+	{"goroutines", func(f *FuncInfo) int { return f.Goroutines }},
+	{"defers", func(f *FuncInfo) int { return f.Defers }},
+	{"max nesting depth", func(f *FuncInfo) int { return f.MaxDepth }},
+	{"cyclomatic complexity", func(f *FuncInfo) int { return f.Complexity }},
+	{"calls (out-degree)", func(f *FuncInfo) int { return len(f.Calls) }},
+	{"TODOs", func(f *FuncInfo) int { return f.DebtMarkers["TODO"] }},
+	{"FIXMEs", func(f *FuncInfo) int { return f.DebtMarkers["FIXME"] }},
+	{"XXXs", func(f *FuncInfo) int { return f.DebtMarkers["XXX"] }},
+	{"panic calls", func(f *FuncInfo) int { return f.ErrorExits["panic"] }},
+	{"os.Exit calls", func(f *FuncInfo) int { return f.ErrorExits["os.Exit"] }},
+	{"log.Fatal calls", func(f *FuncInfo) int { return f.ErrorExits["log.Fatal"] }},
+	{"`return err` statements", func(f *FuncInfo) int { return f.ErrorExits["return err"] }},
+	{"errors.New calls", func(f *FuncInfo) int { return f.ErrorWraps["errors.New"] }},
+	{"fmt.Errorf calls", func(f *FuncInfo) int { return f.ErrorWraps["fmt.Errorf"] }},
+	{"`%w` verbs", func(f *FuncInfo) int { return f.ErrorWraps["%w"] }},
+}
+
+// errorExitKinds are the constructs counted in FuncInfo.ErrorExits, in
+// report order. log.Fatalf and log.Fatalln count as log.Fatal, and
+// "return err" is any return whose last result is the identifier err.
+var errorExitKinds = []string{"panic", "os.Exit", "log.Fatal", "return err"}
+
+// errorExitKind maps a callee name to its errorExitKinds entry, or "".
+func errorExitKind(callee string) string {
+	switch callee {
+	case "panic", "os.Exit":
+		return callee
+	case "log.Fatal", "log.Fatalf", "log.Fatalln":
+		return "log.Fatal"
+	}
+	return ""
+}
+
+func countErrorExit(info *FuncInfo, kind string) {
+	if info.ErrorExits == nil {
+		info.ErrorExits = make(map[string]int)
+	}
+	info.ErrorExits[kind]++
+}
+
+// errorWrapKinds are the constructs counted in FuncInfo.ErrorWraps, in
+// report order. "%w" counts the wrapping verbs in the format strings of
+// fmt.Errorf calls, when the format is a string literal.
+var errorWrapKinds = []string{"errors.New", "fmt.Errorf", "%w"}
+
+// countErrorWraps counts a call of callee with args in info.ErrorWraps if it
+// builds an error.
+func countErrorWraps(info *FuncInfo, callee string, args []ast.Expr) {
+	if callee != "errors.New" && callee != "fmt.Errorf" {
+		return
+	}
+	if info.ErrorWraps == nil {
+		info.ErrorWraps = make(map[string]int)
+	}
+	info.ErrorWraps[callee]++
+	if callee != "fmt.Errorf" || len(args) == 0 {
+		return
+	}
+	lit, ok := args[0].(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return
+	}
+	if format, err := strconv.Unquote(lit.Value); err == nil {
+		if n := strings.Count(strings.ReplaceAll(format, "%%", ""), "%w"); n > 0 {
+			info.ErrorWraps["%w"] += n
+		}
+	}
+}
+
+// goPackagePath derives a pseudo package path from the file's directory and
+// its package clause, e.g. "internal/foo/foo". Because the package name is
+// part of the path, `package foo` and `package foo_test` living in the same
+// directory end up as distinct packages and never collide in a FuncSet.
+//
+// In a module, the directory part is the import path instead: the path of
+// the nearest enclosing go.mod's module plus the directory relative to it,
+// e.g. "example.com/tools/internal/foo/foo" for internal/foo in a module
+// declared in tools/go.mod. modules maps module root directories ("." for
+// the repository root) to module paths, as returned by readGoModules.
+func goPackagePath(file, pkgName string, modules map[string]string) string {
+	dir := path.Dir(filepath.ToSlash(file))
+	for root := dir; ; root = path.Dir(root) {
+		if mod, ok := modules[root]; ok {
+			rel := ""
+			if root != "." {
+				rel = strings.TrimPrefix(strings.TrimPrefix(dir, root), "/")
+			} else if dir != "." {
+				rel = dir
+			}
+			return path.Join(mod, rel, pkgName)
+		}
+		if root == "." || root == "/" {
+			break
+		}
+	}
+	if dir == "." {
+		return pkgName
+	}
+	return path.Join(dir, pkgName)
+}
+
+// readGoModules reads the module path declared in each of the go.mod files
+// modFiles and returns it keyed by the file's directory. A go.mod that
+// can't be read or declares no module is skipped with a warning; its
+// packages fall back to an enclosing module, or to plain directories.
+func readGoModules(ctx context.Context, source fileSource, modFiles []string, jobs int) map[string]string {
+	modules := make(map[string]string)
+	for i, content := range readFiles(ctx, source, modFiles, jobs) {
+		file := modFiles[i]
+		if content.err != nil {
+			logf("warning", file, source.Name(), "skipping %s@%s: %v", file, source.Name(), content.err)
+			continue
+		}
+		mod := goModulePath(content.data)
+		if mod == "" {
+			logf("warning", file, source.Name(), "%s@%s declares no module; ignoring it", file, source.Name())
+			continue
+		}
+		modules[path.Dir(filepath.ToSlash(file))] = mod
+	}
+	return modules
+}
+
+// goModulePath returns the path of the module directive in a go.mod file,
+// or "" if there is none.
+func goModulePath(gomod []byte) string {
+	for _, line := range strings.Split(string(gomod), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "module" {
+			continue
+		}
+		if mod, err := strconv.Unquote(fields[1]); err == nil {
+			return mod
+		}
+		return fields[1]
+	}
+	return ""
+}
+
+// fileBuildConstraint returns the build constraint that applies to a Go file:
+// its //go:build line (or legacy // +build lines), combined with the implicit
+// GOOS/GOARCH constraint carried by names like foo_linux.go. It returns nil
+// for unconstrained files.
+func fileBuildConstraint(path string, src []byte) (constraint.Expr, error) {
+	var goBuild constraint.Expr
+	var plusBuild []constraint.Expr
+
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "//") {
+			// Constraints must precede the package clause.
+			break
+		}
+		switch {
+		case constraint.IsGoBuild(line):
+			x, err := constraint.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+			goBuild = x
+		case constraint.IsPlusBuild(line):
+			x, err := constraint.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+			plusBuild = append(plusBuild, x)
+		}
+	}
+
+	expr := goBuild
+	if expr == nil {
+		for _, x := range plusBuild {
+			expr = andExpr(expr, x)
+		}
+	}
+	return andExpr(expr, fileNameConstraint(path)), nil
+}
+
+// fileNameConstraint mirrors go/build's file name rules: a _GOOS, _GOARCH or
+// _GOOS_GOARCH suffix restricts the file to that platform.
+func fileNameConstraint(path string) constraint.Expr {
+	name := strings.TrimSuffix(filepath.Base(path), ".go")
+	name = strings.TrimSuffix(name, "_test")
+	i := strings.Index(name, "_")
+	if i < 0 {
+		return nil
+	}
+	parts := strings.Split(name[i:], "_")
+	n := len(parts)
+	if n >= 2 && knownOS[parts[n-2]] && knownArch[parts[n-1]] {
+		return andExpr(&constraint.TagExpr{Tag: parts[n-2]}, &constraint.TagExpr{Tag: parts[n-1]})
+	}
+	if knownOS[parts[n-1]] || knownArch[parts[n-1]] {
+		return &constraint.TagExpr{Tag: parts[n-1]}
+	}
+	return nil
+}
+
+func andExpr(x, y constraint.Expr) constraint.Expr {
+	if x == nil {
+		return y
+	}
+	if y == nil {
+		return x
+	}
+	return &constraint.AndExpr{X: x, Y: y}
+}
+
+// buildTagSet returns the tag predicate used to evaluate constraints: the
+// --tags values, the target GOOS/GOARCH (honoring $GOOS/$GOARCH), "unix" on
+// unix-like systems, and any goX.Y release tag.
+func buildTagSet(tags []string) func(string) bool {
+	goos := os.Getenv("GOOS")
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	goarch := os.Getenv("GOARCH")
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+
+	set := map[string]bool{goos: true, goarch: true}
+	if unixOS[goos] {
+		set["unix"] = true
+	}
+	for _, t := range tags {
+		set[t] = true
+	}
+	return func(tag string) bool {
+		return set[tag] || strings.HasPrefix(tag, "go1.")
+	}
+}
+
+// Lists taken from go/build's syslist.go.
+var (
+	knownOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true,
+		"freebsd": true, "hurd": true, "illumos": true, "ios": true,
+		"js": true, "linux": true, "nacl": true, "netbsd": true,
+		"openbsd": true, "plan9": true, "solaris": true, "wasip1": true,
+		"windows": true, "zos": true,
+	}
+	unixOS = map[string]bool{
+		"aix": true, "android": true, "darwin": true, "dragonfly": true,
+		"freebsd": true, "hurd": true, "illumos": true, "ios": true,
+		"linux": true, "netbsd": true, "openbsd": true, "solaris": true,
+	}
+	knownArch = map[string]bool{
+		"386": true, "amd64": true, "amd64p32": true, "arm": true,
+		"armbe": true, "arm64": true, "arm64be": true, "loong64": true,
+		"mips": true, "mipsle": true, "mips64": true, "mips64le": true,
+		"mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true,
+		"ppc64le": true, "riscv": true, "riscv64": true, "s390": true,
+		"s390x": true, "sparc": true, "sparc64": true, "wasm": true,
+	}
+)
+
+func formatReceiver(fl *ast.FieldList) string {
+	if fl == nil || len(fl.List) == 0 {
+		return ""
+	}
+	// methods have at most one receiver field.
+	return receiverTypeString(fl.List[0].Type)
+}
+
+// receiverTypeString renders a receiver type in one canonical form, so the
+// same receiver always yields the same FuncKey however it is spelled:
+// parentheses are dropped ("(*T)" and "*(T)" become "*T"), a qualified type
+// keeps its qualifier ("pkg.T", as generated code or a dot-import setup may
+// produce), and type parameters are kept ("*List[T]").
+func receiverTypeString(e ast.Expr) string {
+	switch t := e.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.ParenExpr:
+		return receiverTypeString(t.X)
+	case *ast.StarExpr:
+		return "*" + receiverTypeString(t.X)
+	case *ast.SelectorExpr:
+		return receiverTypeString(t.X) + "." + t.Sel.Name
+	case *ast.IndexExpr:
+		return receiverTypeString(t.X) + "[" + exprToString(t.Index) + "]"
+	case *ast.IndexListExpr:
+		args := make([]string, len(t.Indices))
+		for i, idx := range t.Indices {
+			args[i] = exprToString(idx)
+		}
+		return receiverTypeString(t.X) + "[" + strings.Join(args, ", ") + "]"
+	}
+	return exprToString(e)
+}
+
+// formatSignature renders ft in the canonical form used everywhere a
+// signature is shown or stored, matching go doc: "(params)" without results,
+// "(params) T" for a single unnamed result, and "(params) (T, error)" for
+// several or named results. Grouped names are spelled out ("a, b int" becomes
+// "a int, b int"), so regrouping never shows up as a change.
+func formatSignature(ft *ast.FuncType) string {
+	params := fieldListToString(ft.Params)
+	results := fieldListToString(ft.Results)
+
+	// Type parameters of a generic function: [K comparable, V any]
+	typeParams := ""
+	if tp := fieldListToString(ft.TypeParams); tp != "" {
+		typeParams = "[" + tp + "]"
+	}
+
+	switch {
+	case results == "":
+		return fmt.Sprintf("%s(%s)", typeParams, params)
+	case len(ft.Results.List) == 1 && len(ft.Results.List[0].Names) == 0:
+		return fmt.Sprintf("%s(%s) %s", typeParams, params, results)
+	}
+	return fmt.Sprintf("%s(%s) (%s)", typeParams, params, results)
+}
+
+func fieldListToString(fl *ast.FieldList) string {
+	if fl == nil || len(fl.List) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, f := range fl.List {
+		typeStr := exprToString(f.Type)
+		if len(f.Names) == 0 {
+			parts = append(parts, typeStr)
+		} else {
+			for _, name := range f.Names {
+				parts = append(parts, fmt.Sprintf("%s %s", name.Name, typeStr))
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// fieldListTypes returns the type of every entry in fl, repeating the type
+// for grouped names so the slice lines up with positional arguments.
+func fieldListTypes(fl *ast.FieldList) []string {
+	if fl == nil {
+		return nil
+	}
+	var types []string
+	for _, f := range fl.List {
+		typeStr := exprToString(f.Type)
+		n := len(f.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			types = append(types, typeStr)
+		}
+	}
+	return types
+}
+
+// exprToString is a simple printer for AST expressions.
+func exprToString(e ast.Expr) string {
+	switch x := e.(type) {
+	case *ast.Ident:
+		return x.Name
+
+	case *ast.StarExpr:
+		return "*" + exprToString(x.X)
+
+	case *ast.SelectorExpr:
+		return exprToString(x.X) + "." + exprToString(x.Sel)
+
+	case *ast.ArrayType:
+		if x.Len != nil {
+			return "[" + exprToString(x.Len) + "]" + exprToString(x.Elt)
+		}
+		return "[]" + exprToString(x.Elt)
+
+	case *ast.Ellipsis:
+		// Variadic parameter: ...T
+		return "..." + exprToString(x.Elt)
+
+	case *ast.BasicLit:
+		return x.Value
+
+	case *ast.ParenExpr:
+		return "(" + exprToString(x.X) + ")"
+
+	case *ast.UnaryExpr:
+		// Approximation element in a constraint: ~int
+		return x.Op.String() + exprToString(x.X)
+
+	case *ast.BinaryExpr:
+		// Union in a constraint: ~int | ~string
+		return exprToString(x.X) + " " + x.Op.String() + " " + exprToString(x.Y)
+
+	case *ast.IndexExpr:
+		// Generic instantiation with one type argument: List[T]
+		return exprToString(x.X) + "[" + exprToString(x.Index) + "]"
+
+	case *ast.IndexListExpr:
+		// Generic instantiation with several type arguments: Map[K, V]
+		args := make([]string, len(x.Indices))
+		for i, idx := range x.Indices {
+			args[i] = exprToString(idx)
+		}
+		return exprToString(x.X) + "[" + strings.Join(args, ", ") + "]"
+
+	case *ast.MapType:
+		return "map[" + exprToString(x.Key) + "]" + exprToString(x.Value)
+
+	case *ast.FuncType:
+		// Print as: func(params) (results)
+		return "func" + formatSignature(x)
+
+	case *ast.InterfaceType:
+		if x.Methods == nil || len(x.Methods.List) == 0 {
+			return "interface{}"
+		}
+		// Spell out method sets so different interfaces never look equal.
+		return types.ExprString(x)
+
+	case *ast.ChanType:
+		switch x.Dir {
+		case ast.SEND:
+			return "chan<- " + exprToString(x.Value)
+		case ast.RECV:
+			return "<-chan " + exprToString(x.Value)
+		}
+		return "chan " + exprToString(x.Value)
+
+	case nil:
+		return unprintableType
+
+	default:
+		// Anything else (struct types, ...) is rendered by go/types, so
+		// distinct types always get distinct strings.
+		return types.ExprString(e)
+	}
+}
+
+// unprintableType stands in for a missing type expression. Signatures that
+// contain it are never considered equal; see signatureChanged.
+const unprintableType = "<?>"
+
+// signatureChanged compares two signatures semantically rather than as
+// rendered strings: by type parameter constraints and parameter and result
+// types only (parameter names do not matter to callers), with `any` and
+// `interface{}` treated alike and whitespace ignored. Signatures containing
+// unprintableType never compare equal, so two different unknown types can't
+// hide a change.
+func signatureChanged(a, b *FuncInfo) bool {
+	ka, kb := semanticSignature(a), semanticSignature(b)
+	if strings.Contains(ka, unprintableType) || strings.Contains(kb, unprintableType) {
+		return true
+	}
+	return ka != kb
+}
+
+// semanticSignature returns the comparison key used by signatureChanged. It is
+// built from ParamTypes/ResultTypes when the extractor provides them, and
+// from the rendered Signature otherwise (e.g. TypeScript).
+func semanticSignature(f *FuncInfo) string {
+	if f.ParamTypes == nil && f.ResultTypes == nil {
+		return canonicalType(f.Signature)
+	}
+	params := make([]string, len(f.ParamTypes))
+	for i, t := range f.ParamTypes {
+		params[i] = canonicalType(t)
+	}
+	results := make([]string, len(f.ResultTypes))
+	for i, t := range f.ResultTypes {
+		results[i] = canonicalType(t)
+	}
+	key := "(" + strings.Join(params, ",") + ")(" + strings.Join(results, ",") + ")"
+	if len(f.TypeParams) > 0 {
+		constraints := make([]string, len(f.TypeParams))
+		for i, t := range f.TypeParams {
+			constraints[i] = canonicalType(t)
+		}
+		key = "[" + strings.Join(constraints, ",") + "]" + key
+	}
+	return key
+}
+
+// canonicalType normalizes a rendered type for comparison: the predeclared
+// alias `any` becomes `interface{}`, and whitespace is dropped except where
+// it separates two identifiers (as in "chan int").
+func canonicalType(t string) string {
+	isWord := func(r rune) bool { return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) }
+
+	// Split into word and non-word runs so `any` is only replaced as a whole identifier.
+	var out strings.Builder
+	var prev rune
+	pendingSpace := false
+	runes := []rune(t)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		if unicode.IsSpace(r) {
+			pendingSpace = true
+			i++
+			continue
+		}
+		tok := string(r)
+		j := i + 1
+		if isWord(r) {
+			for j < len(runes) && isWord(runes[j]) {
+				j++
+			}
+			tok = string(runes[i:j])
+			if tok == "any" {
+				tok = "interface{}"
+			}
+		}
+		first, _ := utf8.DecodeRuneInString(tok)
+		if pendingSpace && isWord(prev) && isWord(first) {
+			out.WriteByte(' ')
+		}
+		out.WriteString(tok)
+		prev, _ = utf8.DecodeLastRuneInString(tok)
+		pendingSpace = false
+		i = j
+	}
+	return out.String()
+}
+
+type DiffResult struct {
+	NewFuncs     []*FuncInfo
+	RemovedFuncs []*FuncInfo
+	ChangedFuncs [][2]*FuncInfo // [from, to]
+	// UnchangedFuncs holds the from side of functions present and
+	// identical in both refs.
+	UnchangedFuncs []*FuncInfo
+	FromTotal      int
+	ToTotal        int
+	PkgStats       map[string]*PackageStats
+	// PossibleMoves pairs new and removed functions with identical bodies
+	// ([new, removed]); only filled by detectGlobalMoves.
+	PossibleMoves [][2]*FuncInfo
+	// ReceiverRenames pairs methods that moved to a renamed receiver type
+	// ([new, removed]); only filled by detectReceiverRenames. They are not
+	// in NewFuncs or RemovedFuncs.
+	ReceiverRenames [][2]*FuncInfo
+	// ReceiverPointerChanges pairs ([from, to]) methods whose receiver
+	// switched between T and *T, which would otherwise show up as a removed
+	// and a new method. They are not in NewFuncs or RemovedFuncs.
+	ReceiverPointerChanges [][2]*FuncInfo
+	// PackageMoves pairs functions that moved unchanged to another package
+	// ([new, removed]); only filled by detectPackageMoves. They are not in
+	// NewFuncs or RemovedFuncs.
+	PackageMoves [][2]*FuncInfo
+	// MethodConversions pairs a function that became a method, or a method
+	// that became a function ([new, removed]); only filled by
+	// detectFuncMethodConversions. They are not in NewFuncs or RemovedFuncs.
+	MethodConversions [][2]*FuncInfo
+	// ParseFailures lists files left out of either side because they did
+	// not parse; the diff may be incomplete for them.
+	ParseFailures []ParseFailure
+	// ChangedTypes lists struct and interface types present in both refs
+	// whose fields or methods differ (Go only).
+	ChangedTypes []typeChange
+	// DeprecationChanges pairs ([from, to]) functions present in both refs
+	// that gained or lost a "Deprecated:" paragraph in their doc comment,
+	// whether or not they count as changed otherwise.
+	DeprecationChanges [][2]*FuncInfo
+	// DocChanges pairs ([from, to]) exported functions present in both refs
+	// whose doc comment appeared or disappeared, whether or not they count
+	// as changed otherwise. See docRequired.
+	DocChanges [][2]*FuncInfo
+}
+
+func diffFuncs(from, to FuncSet, opts DiffOptions) DiffResult {
+	result := DiffResult{
+		PkgStats: make(map[string]*PackageStats),
+	}
+
+	result.FromTotal = len(from)
+	result.ToTotal = len(to)
+
+	// Helper to get or create stats for a package.
+	getStats := func(pkg string) *PackageStats {
+		if s, ok := result.PkgStats[pkg]; ok {
+			return s
+		}
+		s := &PackageStats{}
+		result.PkgStats[pkg] = s
+		return s
+	}
+
+	// Identify new and changed
+	for key, fromInfo := range from {
+		toInfo, exists := to[key]
+		if !exists {
+			result.NewFuncs = append(result.NewFuncs, fromInfo)
+			getStats(fromInfo.Package).addNew(fromInfo)
+			continue
+		}
+
+		if isDeprecated(fromInfo) != isDeprecated(toInfo) {
+			result.DeprecationChanges = append(result.DeprecationChanges, [2]*FuncInfo{fromInfo, toInfo})
+		}
+		if docRequired(fromInfo) && (fromInfo.Doc == "") != (toInfo.Doc == "") {
+			result.DocChanges = append(result.DocChanges, [2]*FuncInfo{fromInfo, toInfo})
+		}
+
+		if len(changeReasons(fromInfo, toInfo, opts)) > 0 {
+			result.ChangedFuncs = append(result.ChangedFuncs, [2]*FuncInfo{fromInfo, toInfo})
+			getStats(fromInfo.Package).addChanged(fromInfo, toInfo)
+			continue
+		}
+		result.UnchangedFuncs = append(result.UnchangedFuncs, fromInfo)
+	}
+
+	// Identify removed
+	for key, toInfo := range to {
+		if _, exists := from[key]; !exists {
+			result.RemovedFuncs = append(result.RemovedFuncs, toInfo)
+			getStats(toInfo.Package).addRemoved(toInfo)
+		}
+	}
+
+	// The loops above range over maps; sort so every consumer sees the
+	// same order on every run.
+	sortFuncs(result.NewFuncs)
+	sortFuncs(result.RemovedFuncs)
+	sortFuncs(result.UnchangedFuncs)
+	sortPairs(result.ChangedFuncs)
+	sortPairs(result.DeprecationChanges)
+	sortPairs(result.DocChanges)
+
+	detectReceiverPointerChanges(&result)
+	return result
+}
+
+// funcLess orders functions by funcSortKey, then by build, line and
+// ordinal, so even declarations sharing a key sort the same way every time.
+func funcLess(a, b *FuncInfo) bool {
+	if ka, kb := funcSortKey(a), funcSortKey(b); ka != kb {
+		return ka < kb
+	}
+	if a.Build != b.Build {
+		return a.Build < b.Build
+	}
+	if a.StartLine != b.StartLine {
+		return a.StartLine < b.StartLine
+	}
+	return a.Ordinal < b.Ordinal
+}
+
+// sortFuncs sorts funcs in place by funcLess.
+func sortFuncs(funcs []*FuncInfo) {
+	sort.Slice(funcs, func(i, j int) bool { return funcLess(funcs[i], funcs[j]) })
+}
+
+// sortPairs sorts pairs in place by funcLess of their first element.
+func sortPairs(pairs [][2]*FuncInfo) {
+	sort.Slice(pairs, func(i, j int) bool { return funcLess(pairs[i][0], pairs[j][0]) })
+}
+
+// detectReceiverPointerChanges pairs a removed and a new method of the same
+// package, build and base type with the same name, one on T and the other on
+// *T, and moves them into ReceiverPointerChanges. Go forbids declaring both,
+// so a pair is unambiguous.
+func detectReceiverPointerChanges(diff *DiffResult) {
+	type methodKey struct{ pkg, build, base, name string }
+	removed := make(map[methodKey]*FuncInfo)
+	for _, f := range diff.RemovedFuncs {
+		if f.Receiver != "" && f.Duplicate == 0 {
+			removed[methodKey{f.Package, f.Build, receiverBaseType(f.Receiver), f.Name}] = f
+		}
+	}
+
+	paired := make(map[*FuncInfo]bool)
+	for _, nf := range diff.NewFuncs {
+		if nf.Receiver == "" || nf.Duplicate != 0 {
+			continue
+		}
+		rf := removed[methodKey{nf.Package, nf.Build, receiverBaseType(nf.Receiver), nf.Name}]
+		if rf == nil || strings.HasPrefix(nf.Receiver, "*") == strings.HasPrefix(rf.Receiver, "*") {
+			continue
+		}
+		paired[nf], paired[rf] = true, true
+		diff.ReceiverPointerChanges = append(diff.ReceiverPointerChanges, [2]*FuncInfo{nf, rf})
+	}
+	if len(paired) == 0 {
+		return
+	}
+	diff.dropNewAndRemoved(paired)
+	sort.Slice(diff.ReceiverPointerChanges, func(i, j int) bool {
+		return funcSortKey(diff.ReceiverPointerChanges[i][1]) < funcSortKey(diff.ReceiverPointerChanges[j][1])
+	})
+}
+
+// isPointerReceiverChange reports whether a [from, to] pair is a method that
+// moved between T and *T, as opposed to one on a renamed type.
+func isPointerReceiverChange(from, to *FuncInfo) bool {
+	return from.Receiver != to.Receiver && receiverBaseType(from.Receiver) == receiverBaseType(to.Receiver)
+}
+
+// dropNewAndRemoved removes the functions in drop from NewFuncs and
+// RemovedFuncs, along with their PkgStats counts.
+func (diff *DiffResult) dropNewAndRemoved(drop map[*FuncInfo]bool) {
+	keep := func(funcs []*FuncInfo, dropped func(*PackageStats, *FuncInfo)) []*FuncInfo {
+		var out []*FuncInfo
+		for _, f := range funcs {
+			if drop[f] {
+				dropped(diff.PkgStats[f.Package], f)
+				continue
+			}
+			out = append(out, f)
+		}
+		return out
+	}
+	diff.NewFuncs = keep(diff.NewFuncs, func(s *PackageStats, f *FuncInfo) {
+		s.New--
+		s.LOCAdded -= f.LineCount
+	})
+	diff.RemovedFuncs = keep(diff.RemovedFuncs, func(s *PackageStats, f *FuncInfo) {
+		s.Removed--
+		s.LOCRemoved -= f.LineCount
+	})
+	for pkg, s := range diff.PkgStats {
+		if s.New == 0 && s.Removed == 0 && s.Changed == 0 {
+			delete(diff.PkgStats, pkg)
+		}
+	}
+}
+
+// deprecationNote finds the first paragraph of doc that starts with
+// "Deprecated:", the Go convention, and returns its text after the prefix on
+// one line. ok reports whether there was such a paragraph.
+func deprecationNote(doc string) (note string, ok bool) {
+	for _, para := range strings.Split(doc, "\n\n") {
+		if rest, found := strings.CutPrefix(strings.TrimSpace(para), "Deprecated:"); found {
+			return strings.Join(strings.Fields(rest), " "), true
+		}
+	}
+	return "", false
+}
+
+func isDeprecated(f *FuncInfo) bool {
+	_, ok := deprecationNote(f.Doc)
+	return ok
+}
+
+// writeDeprecations renders the "Deprecations" section.
+func writeDeprecations(b *strings.Builder, changes [][2]*FuncInfo) {
+	sorted := append([][2]*FuncInfo(nil), changes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return funcSortKey(sorted[i][0]) < funcSortKey(sorted[j][0])
+	})
+	fmt.Fprintf(b, "#### Deprecations\n\n")
+	for _, pair := range sorted {
+		name := pair[0].Package + "." + qualifiedName(pair[0])
+		note, deprecated := deprecationNote(pair[0].Doc)
+		switch {
+		case !deprecated:
+			fmt.Fprintf(b, "- `%s`: no longer deprecated\n", name)
+		case note == "":
+			fmt.Fprintf(b, "- `%s`: newly deprecated\n", name)
+		default:
+			fmt.Fprintf(b, "- `%s`: newly deprecated: %s\n", name, note)
+		}
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// docRequired reports whether linters such as golint and revive expect f to
+// have a doc comment: it is exported, and so is its receiver type if it is a
+// method.
+func docRequired(f *FuncInfo) bool {
+	if !f.Exported {
+		return false
+	}
+	if f.Receiver == "" {
+		return true
+	}
+	recv, _, _ := strings.Cut(strings.TrimPrefix(f.Receiver, "*"), "[")
+	return token.IsExported(recv)
+}
+
+// writeDocChanges renders the "Documentation Regressions" section: exported
+// functions whose doc comment was dropped, then the ones that gained one.
+func writeDocChanges(b *strings.Builder, changes [][2]*FuncInfo, opts ReportOptions) {
+	var lost, gained [][2]*FuncInfo
+	for _, pair := range changes {
+		if pair[0].Doc == "" {
+			lost = append(lost, pair)
+		} else {
+			gained = append(gained, pair)
+		}
+	}
+	fmt.Fprintf(b, "#### Documentation Regressions\n\n")
+	if len(lost) > 0 {
+		fmt.Fprintf(b, "Exported functions documented in `%s` but not in `%s`:\n\n", opts.ToRef, opts.FromRef)
+		for _, pair := range lost {
+			fmt.Fprintf(b, "- `%s.%s` (`%s`)\n", pair[0].Package, qualifiedName(pair[0]), pair[0].File)
+		}
+		fmt.Fprintf(b, "\n")
+	}
+	if len(gained) > 0 {
+		fmt.Fprintf(b, "Exported functions that gained a doc comment in `%s`:\n\n", opts.FromRef)
+		for _, pair := range gained {
+			fmt.Fprintf(b, "- `%s.%s` (`%s`)\n", pair[0].Package, qualifiedName(pair[0]), pair[0].File)
+		}
+		fmt.Fprintf(b, "\n")
+	}
+}
+
+// changeReasons lists why diffFuncs considers two versions of a function
+// different: "signature", "file", and then either "body" (by BodyHash, with
+// opts.CompareBodies when both sides have one) or "start line"/"end line".
+// An empty result means unchanged.
+func changeReasons(from, to *FuncInfo, opts DiffOptions) []string {
+	var reasons []string
+	if signatureChanged(from, to) {
+		reasons = append(reasons, "signature")
+	}
+	if from.File != to.File {
+		reasons = append(reasons, "file")
+	}
+	if opts.CompareBodies && from.BodyHash != "" && to.BodyHash != "" {
+		if from.BodyHash != to.BodyHash {
+			reasons = append(reasons, "body")
+		}
+		return reasons
+	}
+	if from.StartLine != to.StartLine {
+		reasons = append(reasons, "start line")
+	}
+	if from.EndLine != to.EndLine {
+		reasons = append(reasons, "end line")
+	}
+	return reasons
+}
+
+// changeKinds lists the kinds changeKind returns, in report order: what a
+// reviewer triages first comes first.
+var changeKinds = []struct{ kind, title string }{
+	{"signature", "Signature Changes"},
+	{"body", "Body Changes"},
+	{"moved", "Moved to Another File"},
+	{"shifted", "Shifted Only"},
+}
+
+// changeKind classifies a changed function by its most significant change:
+// "signature"; else "body" when the body hash (or, without hashes, the line
+// count) differs; else "moved" when it changed file; else "shifted".
+func changeKind(from, to *FuncInfo) string {
+	switch {
+	case signatureChanged(from, to):
+		return "signature"
+	case from.BodyHash != "" && to.BodyHash != "" && from.BodyHash != to.BodyHash,
+		(from.BodyHash == "" || to.BodyHash == "") && from.LineCount != to.LineCount:
+		return "body"
+	case from.File != to.File:
+		return "moved"
+	}
+	return "shifted"
+}
+
+// explainChange renders changeReasons for --explain, adding a caveat when
+// the function was flagged although its signature and body fingerprint are
+// the same on both sides: then it most likely only shifted or moved.
+func explainChange(from, to *FuncInfo, opts DiffOptions) string {
+	why := strings.Join(changeReasons(from, to, opts), ", ")
+	if !signatureChanged(from, to) && from.BodyHash != "" && from.BodyHash == to.BodyHash {
+		why += "; body unchanged, likely only shifted or moved"
+	}
+	return why
+}
+
+// funcSelector is one --only entry: a file plus either a function name or a
+// line inside the function.
+type funcSelector struct {
+	Spec string
+	File string
+	Name string
+	Line int
+}
+
+// parseFuncSelectors parses --only entries of the form "file.go:Name" or
+// "file.go:line". Name may be "Func", "Type.Method" or "(*Type).Method".
+func parseFuncSelectors(specs []string) ([]funcSelector, error) {
+	var out []funcSelector
+	for _, spec := range specs {
+		i := strings.LastIndexByte(spec, ':')
+		if i <= 0 || i == len(spec)-1 {
+			return nil, fmt.Errorf("invalid --only entry %q (want file.go:FuncName or file.go:line)", spec)
+		}
+		sel := funcSelector{Spec: spec, File: path.Clean(filepath.ToSlash(spec[:i]))}
+		if line, err := strconv.Atoi(spec[i+1:]); err == nil {
+			sel.Line = line
+		} else {
+			sel.Name = spec[i+1:]
+		}
+		out = append(out, sel)
+	}
+	return out, nil
+}
+
+func (s funcSelector) matches(f *FuncInfo) bool {
+	if f.File != s.File {
+		return false
+	}
+	if s.Line > 0 {
+		return f.StartLine <= s.Line && s.Line <= f.EndLine
+	}
+	if s.Name == f.Name || s.Name == qualifiedName(f) {
+		return true
+	}
+	return f.Receiver != "" && s.Name == receiverBaseType(f.Receiver)+"."+f.Name
+}
+
+// rebasePaths rewrites every file path in diff to be relative to dir, a
+// slash-separated directory relative to the repo root (--relative-to).
+// Unless keepOutside is set, functions, struct types and parse failures
+// entirely outside dir are dropped (a moved function stays if either side
+// is inside); kept paths outside dir start with "../".
+func rebasePaths(diff *DiffResult, dir string, keepOutside bool) {
+	rebase := func(file string) (string, bool) {
+		rel, err := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(file))
+		if err != nil {
+			return file, false
+		}
+		rel = filepath.ToSlash(rel)
+		return rel, rel != ".." && !strings.HasPrefix(rel, "../")
+	}
+
+	inside := make(map[*FuncInfo]bool)
+	visit := func(fs ...*FuncInfo) {
+		for _, f := range fs {
+			if _, done := inside[f]; !done {
+				f.File, inside[f] = rebase(f.File)
+			}
+		}
+	}
+	visit(diff.NewFuncs...)
+	visit(diff.RemovedFuncs...)
+	visit(diff.UnchangedFuncs...)
+	for _, pairs := range [][][2]*FuncInfo{diff.ChangedFuncs, diff.ReceiverRenames, diff.ReceiverPointerChanges, diff.PackageMoves, diff.MethodConversions, diff.DeprecationChanges, diff.DocChanges} {
+		for _, pair := range pairs {
+			visit(pair[0], pair[1])
+		}
+	}
+
+	var types []typeChange
+	for _, c := range diff.ChangedTypes {
+		var fromIn, toIn bool
+		c.From.File, fromIn = rebase(c.From.File)
+		c.To.File, toIn = rebase(c.To.File)
+		if keepOutside || fromIn || toIn {
+			types = append(types, c)
+		}
+	}
+	diff.ChangedTypes = types
+
+	var failures []ParseFailure
+	for _, f := range diff.ParseFailures {
+		var in bool
+		if f.File, in = rebase(f.File); keepOutside || in {
+			failures = append(failures, f)
+		}
+	}
+	diff.ParseFailures = failures
+
+	if keepOutside {
+		return
+	}
+	anyInside := func(fs ...*FuncInfo) bool {
+		for _, f := range fs {
+			if inside[f] {
+				return true
+			}
+		}
+		return false
+	}
+	keepFuncs(diff, anyInside)
+	var unchanged []*FuncInfo
+	for _, f := range diff.UnchangedFuncs {
+		if inside[f] {
+			unchanged = append(unchanged, f)
+		}
+	}
+	diff.UnchangedFuncs = unchanged
+}
+
+// NarrowOptions selects the part of a diff that is reported; see narrowDiff.
+type NarrowOptions struct {
+	// Only restricts the diff to these functions (--only). Their files are
+	// relative to RelativeTo, like the reported paths.
+	Only []funcSelector
+	// Receivers restricts the diff to methods on these receivers
+	// (--only-receivers); see filterReceivers.
+	Receivers           []string
+	IncludeConstructors bool
+	// GlobalMoves pairs new and removed functions with the same body
+	// (--detect-moves-global).
+	GlobalMoves bool
+	// RelativeTo is the --relative-to directory as returned by
+	// relativeToDir; "" leaves paths alone. KeepOutside keeps functions
+	// outside it (--relative-outside=keep).
+	RelativeTo  string
+	KeepOutside bool
+}
+
+// narrowDiff applies opts to diff, filters first and --relative-to last, and
+// returns diffHash of the result as it was before --relative-to rewrote or
+// dropped anything, so the hash doesn't depend on it.
+func narrowDiff(diff *DiffResult, opts NarrowOptions) string {
+	if len(opts.Only) > 0 {
+		repoSels := make([]funcSelector, len(opts.Only))
+		for i, s := range opts.Only {
+			s.File = path.Join(opts.RelativeTo, s.File)
+			repoSels[i] = s
+		}
+		filterDiff(diff, repoSels)
+	}
+	if len(opts.Receivers) > 0 {
+		filterReceivers(diff, opts.Receivers, opts.IncludeConstructors)
+	}
+	if opts.GlobalMoves {
+		detectGlobalMoves(diff)
+	}
+	hash := diffHash(*diff)
+	if opts.RelativeTo != "" {
+		rebasePaths(diff, opts.RelativeTo, opts.KeepOutside)
+	}
+	return hash
+}
+
+// rebasedSource serves files named relative to dir (see rebasePaths and
+// stripSidePath) from a source that names them relative to the repo root.
+// name, if set, replaces the source's own name in reports.
+type rebasedSource struct {
+	fileSource
+	dir  string
+	name string
+}
+
+func (s rebasedSource) Name() string {
+	if s.name != "" {
+		return s.name
+	}
+	return s.fileSource.Name()
+}
+
+// unwrapRebased returns the source under any rebasedSource wrappers of src,
+// and the directory, relative to that source's root, that src's file names
+// are relative to ("" if src is not rebased).
+func unwrapRebased(src fileSource) (fileSource, string) {
+	dir := ""
+	for {
+		rs, ok := src.(rebasedSource)
+		if !ok {
+			return src, dir
+		}
+		src, dir = rs.fileSource, path.Join(rs.dir, dir)
+	}
+}
+
+func (s rebasedSource) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	return s.fileSource.ReadFile(ctx, path.Join(s.dir, p))
+}
+
+// sideIncludePaths returns the IncludePaths that collect one side of a
+// --from-path/--to-path comparison: dir itself, or each of include (the
+// --include-paths values) taken relative to dir.
+func sideIncludePaths(dir string, include []string) []string {
+	if len(include) == 0 {
+		return []string{dir}
+	}
+	paths := make([]string, len(include))
+	for i, p := range include {
+		paths[i] = path.Join(dir, p)
+	}
+	return paths
+}
+
+// stripSidePath makes the functions, types and parse failures collected
+// under dir (--from-path or --to-path) look as if dir were the repo root:
+// dir is dropped from file paths and from package paths, so the same
+// function on both sides gets the same key. It returns funcs and types
+// re-keyed accordingly.
+func stripSidePath(funcs FuncSet, types TypeSet, failures []ParseFailure, dir string) (FuncSet, TypeSet) {
+	stripFile := func(file string) string {
+		return strings.TrimPrefix(file, dir+"/")
+	}
+	stripPkg := func(pkg string) string {
+		if rest, ok := strings.CutPrefix(pkg, dir+"/"); ok {
+			return rest
+		}
+		if i := strings.Index(pkg, "/"+dir+"/"); i >= 0 {
+			return pkg[:i] + pkg[i+len(dir)+1:]
+		}
+		return pkg
+	}
+
+	// Every file is under dir, so stripping it keeps keys distinct.
+	strippedFuncs := make(FuncSet, len(funcs))
+	for _, f := range funcs {
+		f.File, f.Package = stripFile(f.File), stripPkg(f.Package)
+		strippedFuncs[funcKeyOf(f)] = f
+	}
+
+	strippedTypes := make(TypeSet, len(types))
+	for _, t := range types {
+		t.File, t.Package = stripFile(t.File), stripPkg(t.Package)
+		strippedTypes[typeKeyOf(t)] = t
+	}
+	for i := range failures {
+		failures[i].File = stripFile(failures[i].File)
+	}
+	return strippedFuncs, strippedTypes
+}
+
+// relativeToDir turns a --relative-to value into a slash-separated path
+// relative to repoRoot; "" means no rebasing. Relative values are taken
+// relative to the repo root, like every reported path.
+func relativeToDir(repoRoot, dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	if filepath.IsAbs(dir) {
+		rel, err := filepath.Rel(repoRoot, dir)
+		if err != nil {
+			return "", fmt.Errorf("--relative-to %s: %w", dir, err)
+		}
+		dir = rel
+	}
+	dir = path.Clean(filepath.ToSlash(dir))
+	if dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", fmt.Errorf("--relative-to %s is outside the repository", dir)
+	}
+	if dir == "." {
+		return "", nil
+	}
+	return dir, nil
+}
+
+// keepFuncs drops the new, removed, changed, renamed and deprecation entries
+// of diff for which keep returns false (pairs pass both sides), and possible
+// moves unless keep holds for both functions, and recomputes PkgStats. Totals
+// are left alone.
+func keepFuncs(diff *DiffResult, keep func(fs ...*FuncInfo) bool) {
+	stats := make(map[string]*PackageStats)
+	getStats := func(pkg string) *PackageStats {
+		if stats[pkg] == nil {
+			stats[pkg] = &PackageStats{}
+		}
+		return stats[pkg]
+	}
+	keepPairs := func(pairs [][2]*FuncInfo) [][2]*FuncInfo {
+		var out [][2]*FuncInfo
+		for _, pair := range pairs {
+			if keep(pair[0], pair[1]) {
+				out = append(out, pair)
+			}
+		}
+		return out
+	}
+
+	var newFuncs, removedFuncs []*FuncInfo
+	for _, f := range diff.NewFuncs {
+		if keep(f) {
+			newFuncs = append(newFuncs, f)
+			getStats(f.Package).addNew(f)
+		}
+	}
+	for _, f := range diff.RemovedFuncs {
+		if keep(f) {
+			removedFuncs = append(removedFuncs, f)
+			getStats(f.Package).addRemoved(f)
+		}
+	}
+	diff.ChangedFuncs = keepPairs(diff.ChangedFuncs)
+	for _, pair := range diff.ChangedFuncs {
+		getStats(pair[0].Package).addChanged(pair[0], pair[1])
+	}
+	diff.NewFuncs, diff.RemovedFuncs = newFuncs, removedFuncs
+	diff.ReceiverRenames = keepPairs(diff.ReceiverRenames)
+	diff.ReceiverPointerChanges = keepPairs(diff.ReceiverPointerChanges)
+	diff.PackageMoves = keepPairs(diff.PackageMoves)
+	diff.MethodConversions = keepPairs(diff.MethodConversions)
+	diff.DeprecationChanges = keepPairs(diff.DeprecationChanges)
+	diff.DocChanges = keepPairs(diff.DocChanges)
+	var moves [][2]*FuncInfo
+	for _, pair := range diff.PossibleMoves {
+		if keep(pair[0]) && keep(pair[1]) {
+			moves = append(moves, pair)
+		}
+	}
+	diff.PossibleMoves = moves
+	diff.PkgStats = stats
+}
+
+// filterDiff restricts the new, removed and changed functions of diff to the
+// ones matched by sels (a changed function matches on either side) and
+// recomputes PkgStats. Struct changes are dropped and totals are left alone.
+// It warns about selectors that match nothing that changed.
+func filterDiff(diff *DiffResult, sels []funcSelector) {
+	used := make([]bool, len(sels))
+	match := func(fs ...*FuncInfo) bool {
+		ok := false
+		for i, s := range sels {
+			for _, f := range fs {
+				if s.matches(f) {
+					used[i], ok = true, true
+				}
+			}
+		}
+		return ok
+	}
+
+	keepFuncs(diff, match)
+	diff.ChangedTypes = nil
+
+	for i, s := range sels {
+		if !used[i] {
+			logf("warning", "", "", "--only=%s matches no new, removed or changed function", s.Spec)
+		}
+	}
+}
+
+// filterReceivers restricts the new, removed and changed functions of diff
+// to methods whose receiver is one of receivers, compared without type
+// parameters ("*Box" matches "*Box[K, V]"), and recomputes PkgStats. With
+// constructors it also keeps plain functions with a result of one of the
+// receivers' base types, pointer or not. Struct changes are kept only for
+// those types.
+func filterReceivers(diff *DiffResult, receivers []string, constructors bool) {
+	exact := make(map[string]bool)
+	bases := make(map[string]bool)
+	for _, r := range receivers {
+		exact[stripTypeParams(r)] = true
+		bases[receiverBaseType(r)] = true
+	}
+	match := func(fs ...*FuncInfo) bool {
+		for _, f := range fs {
+			if f.Receiver != "" {
+				if exact[stripTypeParams(f.Receiver)] {
+					return true
+				}
+				continue
+			}
+			if !constructors {
+				continue
+			}
+			for _, t := range f.ResultTypes {
+				if bases[receiverBaseType(t)] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	keepFuncs(diff, match)
+	var types []typeChange
+	for _, tc := range diff.ChangedTypes {
+		if bases[tc.From.Name] {
+			types = append(types, tc)
+		}
+	}
+	diff.ChangedTypes = types
+}
+
+// stripTypeParams drops the type parameters of a receiver or type, keeping
+// any pointer: "*Box[K, V]" becomes "*Box".
+func stripTypeParams(recv string) string {
+	if i := strings.IndexByte(recv, '['); i >= 0 {
+		return recv[:i]
+	}
+	return recv
+}
+
+// detectReceiverRenames pairs removed and new methods of the same package
+// that have the same name, signature, pointer-ness and body hash but a
+// different receiver type, as left behind by renaming a type. Paired methods
+// move from NewFuncs/RemovedFuncs (and their PkgStats counts) into
+// ReceiverRenames. A removed method with more than one candidate is left
+// alone, as are functions without a body hash (TypeScript, --no-body).
+func detectReceiverRenames(diff *DiffResult) {
+	type methodKey struct{ pkg, name, hash string }
+	candidates := make(map[methodKey][]*FuncInfo)
+	for _, f := range diff.NewFuncs {
+		if f.Receiver != "" && f.BodyHash != "" {
+			k := methodKey{f.Package, f.Name, f.BodyHash}
+			candidates[k] = append(candidates[k], f)
+		}
+	}
+
+	paired := make(map[*FuncInfo]bool)
+	for _, rf := range diff.RemovedFuncs {
+		if rf.Receiver == "" || rf.BodyHash == "" {
+			continue
+		}
+		var match *FuncInfo
+		n := 0
+		for _, nf := range candidates[methodKey{rf.Package, rf.Name, rf.BodyHash}] {
+			if paired[nf] || signatureChanged(nf, rf) ||
+				strings.HasPrefix(nf.Receiver, "*") != strings.HasPrefix(rf.Receiver, "*") ||
+				receiverBaseType(nf.Receiver) == receiverBaseType(rf.Receiver) {
+				continue
+			}
+			match = nf
+			n++
+		}
+		if n != 1 {
+			continue
+		}
+		paired[match], paired[rf] = true, true
+		diff.ReceiverRenames = append(diff.ReceiverRenames, [2]*FuncInfo{match, rf})
+	}
+	if len(paired) == 0 {
+		return
+	}
+	diff.dropNewAndRemoved(paired)
+	sort.Slice(diff.ReceiverRenames, func(i, j int) bool {
+		return funcSortKey(diff.ReceiverRenames[i][1]) < funcSortKey(diff.ReceiverRenames[j][1])
+	})
+}
+
+// detectPackageMoves pairs removed and new functions of different packages
+// that have the same receiver, name, signature and body hash, as left behind
+// by moving code between packages. Paired functions move from
+// NewFuncs/RemovedFuncs (and their PkgStats counts) into PackageMoves. Only
+// unique matches are paired, and trivial bodies and functions without a body
+// hash (TypeScript, --no-body) are left alone.
+func detectPackageMoves(diff *DiffResult) {
+	type moveKey struct{ recv, name, hash string }
+	candidates := make(map[moveKey][]*FuncInfo)
+	for _, f := range diff.NewFuncs {
+		if f.BodyHash != "" && f.BodyHash != trivialBodyHash {
+			k := moveKey{f.Receiver, f.Name, f.BodyHash}
+			candidates[k] = append(candidates[k], f)
+		}
+	}
+	removedCount := make(map[moveKey]int)
+	for _, f := range diff.RemovedFuncs {
+		removedCount[moveKey{f.Receiver, f.Name, f.BodyHash}]++
+	}
+
+	paired := make(map[*FuncInfo]bool)
+	for _, rf := range diff.RemovedFuncs {
+		k := moveKey{rf.Receiver, rf.Name, rf.BodyHash}
+		if rf.BodyHash == "" || removedCount[k] != 1 {
+			continue
+		}
+		var match *FuncInfo
+		n := 0
+		for _, nf := range candidates[k] {
+			if nf.Package == rf.Package || signatureChanged(nf, rf) {
+				continue
+			}
+			match = nf
+			n++
+		}
+		if n != 1 {
+			continue
+		}
+		paired[match], paired[rf] = true, true
+		diff.PackageMoves = append(diff.PackageMoves, [2]*FuncInfo{match, rf})
+	}
+	if len(paired) == 0 {
+		return
+	}
+	diff.dropNewAndRemoved(paired)
+	sort.Slice(diff.PackageMoves, func(i, j int) bool {
+		return funcSortKey(diff.PackageMoves[i][1]) < funcSortKey(diff.PackageMoves[j][1])
+	})
+}
+
+// minConversionSimilarity is how alike (see bodySimilarity) the bodies of a
+// removed function and a new method must be to count as one conversion.
+const minConversionSimilarity = 0.8
+
+// detectFuncMethodConversions pairs a removed function with a new method of
+// the same package and name, or a removed method with a new function, as
+// left behind by turning func Process(c *Client) into func (c *Client)
+// Process(). To pair, the method's receiver type must be the function's
+// first parameter type (pointer-ness aside) and the bodies, declaration
+// line excluded, must be at least minConversionSimilarity alike. Only
+// unique matches are paired; paired functions move from
+// NewFuncs/RemovedFuncs (and their PkgStats counts) into MethodConversions.
+func detectFuncMethodConversions(ctx context.Context, diff *DiffResult, fromSrc, toSrc fileSource) {
+	type nameKey struct{ pkg, name string }
+	byName := func(funcs []*FuncInfo) map[nameKey][]*FuncInfo {
+		m := make(map[nameKey][]*FuncInfo)
+		for _, f := range funcs {
+			k := nameKey{f.Package, f.Name}
+			m[k] = append(m[k], f)
+		}
+		return m
+	}
+	added, removed := byName(diff.NewFuncs), byName(diff.RemovedFuncs)
+
+	converts := func(fn, method *FuncInfo) bool {
+		return fn.Receiver == "" && method.Receiver != "" && len(fn.ParamTypes) > 0 &&
+			receiverBaseType(fn.ParamTypes[0]) == receiverBaseType(method.Receiver)
+	}
+	body := func(src fileSource, f *FuncInfo) string {
+		if f.BodyHash == "" {
+			return ""
+		}
+		text, err := loadFuncBody(ctx, src, f)
+		if err != nil {
+			return ""
+		}
+		// Drop the declaration line, which differs by construction.
+		_, text, _ = strings.Cut(normalizeBody(text, BodyNormalization{Indent: true}), "\n")
+		return text
+	}
+
+	paired := make(map[*FuncInfo]bool)
+	for k, rs := range removed {
+		as := added[k]
+		if len(rs) != 1 || len(as) != 1 {
+			continue
+		}
+		rf, nf := rs[0], as[0]
+		if !converts(rf, nf) && !converts(nf, rf) {
+			continue
+		}
+		if rf.BodyHash == "" || nf.BodyHash != rf.BodyHash {
+			fromBody, toBody := body(fromSrc, nf), body(toSrc, rf)
+			if fromBody == "" || toBody == "" || bodySimilarity(fromBody, toBody) < minConversionSimilarity {
+				continue
+			}
+		}
+		paired[nf], paired[rf] = true, true
+		diff.MethodConversions = append(diff.MethodConversions, [2]*FuncInfo{nf, rf})
+	}
+	if len(paired) == 0 {
+		return
+	}
+	diff.dropNewAndRemoved(paired)
+	sort.Slice(diff.MethodConversions, func(i, j int) bool {
+		return funcSortKey(diff.MethodConversions[i][1]) < funcSortKey(diff.MethodConversions[j][1])
+	})
+}
+
+// bodySimilarity returns how alike two texts are by line: twice the number
+// of lines they have in common (as diffLineOps aligns them) over the total
+// number of lines, from 0 to 1.
+func bodySimilarity(a, b string) float64 {
+	la, lb := strings.Split(a, "\n"), strings.Split(b, "\n")
+	common := 0
+	for _, op := range diffLineOps(la, lb) {
+		if op.kind == ' ' {
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(la)+len(lb))
+}
+
+// writeMethodConversions renders the "Function/Method Conversions" section.
+func writeMethodConversions(b *strings.Builder, conversions [][2]*FuncInfo) {
+	fmt.Fprintf(b, "#### Function/Method Conversions\n\n")
+	fmt.Fprintf(b, "Functions that became methods, or the reverse (same package and name, similar body); callers must be updated:\n\n")
+	for _, pair := range conversions {
+		nf, rf := pair[0], pair[1]
+		kind := "function → method"
+		if nf.Receiver == "" {
+			kind = "method → function"
+		}
+		fmt.Fprintf(b, "- `%s`: %s: `%s` → `%s`\n", rf.Package, kind, formatFuncHeader(rf), formatFuncHeader(nf))
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// writePackageMoves renders the "Moved Between Packages" section.
+func writePackageMoves(b *strings.Builder, moves [][2]*FuncInfo) {
+	fmt.Fprintf(b, "#### Moved Between Packages\n\n")
+	fmt.Fprintf(b, "Functions that only moved to another package (same name, signature and body):\n\n")
+	for _, pair := range moves {
+		nf, rf := pair[0], pair[1]
+		fmt.Fprintf(b, "- `%s`: `%s` → `%s` (`%s` → `%s`)\n", qualifiedName(nf), rf.Package, nf.Package, rf.File, nf.File)
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// writeReceiverRenames renders the "Receiver Renames" section: one bullet
+// per renamed type (old → new), listing the methods that moved with it.
+func writeReceiverRenames(b *strings.Builder, renames [][2]*FuncInfo) {
+	type rename struct{ pkg, from, to string }
+	var order []rename
+	methods := make(map[rename][]string)
+	for _, pair := range renames {
+		r := rename{pair[1].Package, receiverBaseType(pair[1].Receiver), receiverBaseType(pair[0].Receiver)}
+		if methods[r] == nil {
+			order = append(order, r)
+		}
+		methods[r] = append(methods[r], pair[0].Name)
+	}
+
+	fmt.Fprintf(b, "#### Receiver Renames\n\n")
+	fmt.Fprintf(b, "Methods that only moved to a renamed type (same name, signature and body):\n\n")
+	for _, r := range order {
+		fmt.Fprintf(b, "- `%s`: `%s` → `%s`: %s\n", r.pkg, r.from, r.to, codeList(methods[r]))
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// writeReceiverPointerChanges renders the "Receiver Pointer Changes" section.
+// A method moved from T to *T is no longer in the method set of T values,
+// which can break interface satisfaction; the reverse only copies the
+// receiver.
+func writeReceiverPointerChanges(b *strings.Builder, changes [][2]*FuncInfo) {
+	fmt.Fprintf(b, "#### Receiver Pointer Changes\n\n")
+	for _, pair := range changes {
+		from, to := pair[0], pair[1]
+		note := "now has a value receiver, which works on a copy"
+		if strings.HasPrefix(from.Receiver, "*") {
+			note = fmt.Sprintf("now has a pointer receiver; `%s` values no longer satisfy interfaces that need it", to.Receiver)
+		}
+		fmt.Fprintf(b, "- `%s.%s` → `%s`: %s\n", to.Package, qualifiedName(to), qualifiedName(from), note)
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// detectGlobalMoves cross-references every new function with every removed
+// function, regardless of package, and records pairs whose bodies hash the
+// same as possible relocations or copy-pasted duplicates. Trivial bodies
+// (e.g. "{}") are ignored since they would match everything.
+func detectGlobalMoves(diff *DiffResult) {
+	removedByHash := make(map[string][]*FuncInfo)
+	for _, f := range diff.RemovedFuncs {
+		if f.BodyHash != "" && f.BodyHash != trivialBodyHash {
+			removedByHash[f.BodyHash] = append(removedByHash[f.BodyHash], f)
+		}
+	}
+
+	diff.PossibleMoves = nil
+	for _, nf := range diff.NewFuncs {
+		for _, rf := range removedByHash[nf.BodyHash] {
+			diff.PossibleMoves = append(diff.PossibleMoves, [2]*FuncInfo{nf, rf})
+		}
+	}
+
+	sort.Slice(diff.PossibleMoves, func(i, j int) bool {
+		a, b := diff.PossibleMoves[i], diff.PossibleMoves[j]
+		if ka, kb := funcSortKey(a[0]), funcSortKey(b[0]); ka != kb {
+			return ka < kb
+		}
+		return funcSortKey(a[1]) < funcSortKey(b[1])
+	})
+}
+
+// diffHash returns a SHA-256 over a canonical, sorted rendering of the diff:
+// change kind, identity, location, signature and body fingerprint of every
+// function entry, the deprecation note of every deprecation change, whether
+// each side of a doc change is documented, and identity, location and fields
+// of every changed type. It does not depend on map iteration order or on any
+// output flag.
+func diffHash(diff DiffResult) string {
+	entry := func(kind string, f *FuncInfo) string {
+		return strings.Join([]string{
+			kind, f.Package, f.Receiver, f.Name, f.Build, f.File,
+			fmt.Sprintf("%d-%d", f.StartLine, f.EndLine), f.Signature, f.BodyHash,
+		}, "\t")
+	}
+	typeEntry := func(kind string, t *TypeInfo) string {
+		fields := make([]string, len(t.Fields))
+		for i, f := range t.Fields {
+			fields[i] = fmt.Sprintf("%s %s %q %t", f.Name, f.Type, f.Tag, f.Embedded)
+		}
+		return strings.Join([]string{
+			kind, t.Package, t.Name, t.Build, t.File,
+			fmt.Sprintf("%d-%d", t.StartLine, t.EndLine), strings.Join(fields, ";"),
+		}, "\t")
+	}
+
+	var lines []string
+	for _, f := range diff.NewFuncs {
+		lines = append(lines, entry("new", f))
+	}
+	for _, f := range diff.RemovedFuncs {
+		lines = append(lines, entry("removed", f))
+	}
+	for _, pair := range diff.ChangedFuncs {
+		lines = append(lines, entry("changed", pair[0])+"\t"+entry("to", pair[1]))
+	}
+	for _, c := range diff.ChangedTypes {
+		lines = append(lines, typeEntry("type", c.From)+"\t"+typeEntry("to", c.To))
+	}
+	for _, pair := range diff.DeprecationChanges {
+		fromNote, _ := deprecationNote(pair[0].Doc)
+		toNote, _ := deprecationNote(pair[1].Doc)
+		lines = append(lines, entry("deprecation", pair[0])+"\t"+fromNote+"\t"+entry("to", pair[1])+"\t"+toNote)
+	}
+	for _, pair := range diff.DocChanges {
+		lines = append(lines, fmt.Sprintf("%s\t%t\t%s\t%t", entry("doc", pair[0]), pair[0].Doc != "", entry("to", pair[1]), pair[1].Doc != ""))
+	}
+	for _, pair := range diff.ReceiverRenames {
+		lines = append(lines, entry("renamed", pair[0])+"\t"+entry("from", pair[1]))
+	}
+	for _, pair := range diff.ReceiverPointerChanges {
+		lines = append(lines, entry("pointer", pair[0])+"\t"+entry("from", pair[1]))
+	}
+	for _, pair := range diff.PackageMoves {
+		lines = append(lines, entry("moved", pair[0])+"\t"+entry("from", pair[1]))
+	}
+	for _, pair := range diff.MethodConversions {
+		lines = append(lines, entry("converted", pair[0])+"\t"+entry("from", pair[1]))
+	}
+	sort.Strings(lines)
+
+	h := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return fmt.Sprintf("%x", h)
+}
+
+// funcSortKey orders functions by package, file, receiver and name.
+func funcSortKey(f *FuncInfo) string {
+	return strings.Join([]string{f.Package, f.File, f.Receiver, f.Name}, "\x00")
+}
+
+// qualifiedName renders a function as "Name" or "(Receiver).Name".
+func qualifiedName(f *FuncInfo) string {
+	if f.Receiver != "" {
+		return fmt.Sprintf("(%s).%s", f.Receiver, f.Name)
+	}
+	return f.Name
+}
+
+// ReportOptions controls how a DiffResult is rendered.
+type ReportOptions struct {
+	FromRef string
+	ToRef   string
+	// FromSource and ToSource load full files for function bodies.
+	FromSource  fileSource
+	ToSource    fileSource
+	SummaryOnly bool
+	// NoSummary leaves the title, summary and package table out of the
+	// Markdown report (--no-summary).
+	NoSummary bool
+	OutDir    string
+	// ThresholdLOC, when positive, highlights changed functions whose line
+	// count grew or shrank by more than this many lines.
+	ThresholdLOC int
+	// GroupBy is "package" (default), "file" or "change-kind".
+	GroupBy string
+	// OnlyChanged drops everything about new and removed functions.
+	OnlyChanged bool
+	// HeadOnly reports the new functions alone, with their bodies.
+	HeadOnly bool
+	// Collapsible wraps the function listings in <details> blocks per
+	// package (--format=markdown-collapsible).
+	Collapsible bool
+	// DryRun computes per-function report names without writing anything.
+	DryRun bool
+	// MaxBodyBytes caps each rendered function body; 0 means unlimited.
+	MaxBodyBytes int
+	// FailOn holds the --fail-on condition names, which some renderers
+	// reflect (e.g. JUnit failures vs skips).
+	FailOn []string
+	// FilenameTemplate, when set, names per-function files instead of the
+	// default path__recv__name.md scheme.
+	FilenameTemplate *template.Template
+	// RequiredInterfaces come from --require-interface.
+	RequiredInterfaces []requiredInterface
+	// Explain annotates changed functions with why they were flagged,
+	// judged with Diff, the options the diff was computed with.
+	Explain bool
+	Diff    DiffOptions
+	// NoBody leaves function bodies out of per-function reports, so no file
+	// contents are loaded for rendering.
+	NoBody bool
+	// Mermaid adds Mermaid charts of the counts after the Markdown summary.
+	Mermaid bool
+	// Sort is the --sort order ChangedFuncs is in: "name" or "impact".
+	// Renderers that reorder functions keep it for changed functions.
+	Sort string
+	// ImpactWeights weigh the impact score shown for changed functions.
+	ImpactWeights impactWeights
+	// Normalize is what body hashes ignored, so a per-function report can
+	// tell that two bodies are the same in those terms.
+	Normalize BodyNormalization
+	// MaxFunctions, when positive, caps the functions listed in each
+	// Markdown and HTML section (new, removed, changed); see capFuncs.
+	MaxFunctions int
+	// SlackTop and SlackMaxChars bound --format=slack: functions listed per
+	// section, and characters in the whole message.
+	SlackTop      int
+	SlackMaxChars int
+	// Theme ("light" or "dark") and HTMLFragment only affect --format=html.
+	Theme        string
+	HTMLFragment bool
+	// Canonical keeps everything that depends on when or where funcdiff
+	// runs out of the output (--canonical): dates are absolute and the
+	// terminal report is never colored.
+	Canonical bool
+	// TSVHeader starts --format=tsv with a line of column names (--header).
+	TSVHeader bool
+	// Links turns function locations into links to the repository's web
+	// UI (--repo-url); nil leaves them as plain text.
+	Links *sourceLinks
+	// Blame holds, by the to side of each changed function, the most recent
+	// commit among its lines (--blame); nil when blame is off.
+	Blame map[*FuncInfo]blameInfo
+}
+
+// failsOn reports whether cond was requested via --fail-on.
+func (o ReportOptions) failsOn(cond string) bool {
+	for _, c := range o.FailOn {
+		if c == cond {
+			return true
+		}
+	}
+	return false
+}
+
+// isPublicAPI reports whether f is part of a package's importable API: an
+// exported name outside package main, _test packages and internal/ trees.
+// Methods are judged by their own name only.
+func isPublicAPI(f *FuncInfo) bool {
+	return f.Exported && isPublicPackage(f.Package)
+}
+
+// isPublicPackage reports whether pkg can be imported by other modules: it is
+// not a main or _test package and has no internal path element.
+func isPublicPackage(pkg string) bool {
+	pkgName := path.Base(pkg)
+	if pkgName == "main" || strings.HasSuffix(pkgName, "_test") {
+		return false
+	}
+	for _, elem := range strings.Split(pkg, "/") {
+		if elem == "internal" {
+			return false
+		}
+	}
+	return true
+}
+
+// publicInterfaceChanges returns the changes to exported interfaces of public
+// packages. Any change to their method set breaks either callers (removed or
+// changed methods) or implementations outside the package (added methods).
+func publicInterfaceChanges(diff DiffResult) []typeChange {
+	var out []typeChange
+	for _, c := range diff.ChangedTypes {
+		if c.From.Interface && ast.IsExported(c.From.Name) && isPublicPackage(c.From.Package) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// semverImpact suggests the semver bump the diff calls for, judged on the
+// public API: removed functions or changed signatures mean "major", new or
+// newly deprecated functions "minor", and any other difference "patch". It
+// returns "none" for an empty diff. reason summarizes what decided the level,
+// or is "" for "patch" and "none". The suggestion is advisory: it can't see
+// changes to types, constants or behavior.
+func semverImpact(diff DiffResult) (level, reason string) {
+	var added, deprecated, removed, sigChanged, renamed, toPointer, moved, converted int
+	ifaces := len(publicInterfaceChanges(diff))
+	for _, f := range diff.NewFuncs {
+		if isPublicAPI(f) {
+			added++
+		}
+	}
+	for _, pair := range diff.DeprecationChanges {
+		if isPublicAPI(pair[0]) && isDeprecated(pair[0]) {
+			deprecated++
+		}
+	}
+	for _, bc := range breakingChanges(diff) {
+		switch {
+		case bc.New == nil:
+			removed++
+		case isPointerReceiverChange(bc.New, bc.Old):
+			toPointer++
+		case bc.New.Package != bc.Old.Package:
+			moved++
+		case (bc.New.Receiver == "") != (bc.Old.Receiver == ""):
+			converted++
+		case bc.New.Receiver != bc.Old.Receiver:
+			renamed++
+		default:
+			sigChanged++
+		}
+	}
+
+	switch {
+	case removed > 0 || sigChanged > 0 || renamed > 0 || toPointer > 0 || moved > 0 || converted > 0 || ifaces > 0:
+		var parts []string
+		if removed > 0 {
+			parts = append(parts, fmt.Sprintf("removed exported functions: %d", removed))
+		}
+		if sigChanged > 0 {
+			parts = append(parts, fmt.Sprintf("changed exported signatures: %d", sigChanged))
+		}
+		if renamed > 0 {
+			parts = append(parts, fmt.Sprintf("exported methods on a renamed receiver: %d", renamed))
+		}
+		if toPointer > 0 {
+			parts = append(parts, fmt.Sprintf("exported methods moved to a pointer receiver: %d", toPointer))
+		}
+		if moved > 0 {
+			parts = append(parts, fmt.Sprintf("exported functions moved to another package: %d", moved))
+		}
+		if converted > 0 {
+			parts = append(parts, fmt.Sprintf("exported functions turned into methods or back: %d", converted))
+		}
+		if ifaces > 0 {
+			parts = append(parts, fmt.Sprintf("changed exported interfaces: %d", ifaces))
+		}
+		return "major", strings.Join(parts, ", ")
+	case added > 0 || deprecated > 0:
+		var parts []string
+		if added > 0 {
+			parts = append(parts, fmt.Sprintf("new exported functions: %d", added))
+		}
+		if deprecated > 0 {
+			parts = append(parts, fmt.Sprintf("newly deprecated exported functions: %d", deprecated))
+		}
+		return "minor", strings.Join(parts, ", ")
+	case len(diff.NewFuncs)+len(diff.RemovedFuncs)+len(diff.ChangedFuncs)+len(diff.DeprecationChanges)+len(diff.ReceiverRenames)+len(diff.ReceiverPointerChanges)+len(diff.PackageMoves)+len(diff.MethodConversions) > 0:
+		return "patch", ""
+	}
+	return "none", ""
+}
+
+// apiChange is one line of the --api-check report: a public API function
+// (named as in its package) and what happened to it, in apidiff's words.
+type apiChange struct {
+	Package, Name, Message string
+	Compatible             bool
+}
+
+// apiChanges classifies the public API differences in diff the way apidiff
+// does. Incompatible: removed functions, changed signatures, a function
+// that became a method of the same name or the reverse, methods that moved
+// to a renamed receiver, and methods moved from T to *T. Compatible: added
+// functions and methods moved from *T to T. Every change to the method set
+// of an exported interface is incompatible.
+func apiChanges(diff DiffResult) []apiChange {
+	var out []apiChange
+	add := func(f *FuncInfo, compatible bool, format string, args ...any) {
+		out = append(out, apiChange{f.Package, qualifiedName(f), fmt.Sprintf(format, args...), compatible})
+	}
+
+	// A removed function and a new method of the same package and name (or
+	// the reverse) are reported as one conversion when the match is unique.
+	type nameKey struct{ pkg, name string }
+	count := func(funcs []*FuncInfo, methods bool) map[nameKey][]*FuncInfo {
+		m := make(map[nameKey][]*FuncInfo)
+		for _, f := range funcs {
+			if isPublicAPI(f) && (f.Receiver != "") == methods {
+				k := nameKey{f.Package, f.Name}
+				m[k] = append(m[k], f)
+			}
+		}
+		return m
+	}
+	converted := make(map[*FuncInfo]bool)
+	for _, methods := range []bool{true, false} {
+		removed, added := count(diff.RemovedFuncs, !methods), count(diff.NewFuncs, methods)
+		for k, rs := range removed {
+			if as := added[k]; len(rs) == 1 && len(as) == 1 {
+				converted[rs[0]], converted[as[0]] = true, true
+				if methods {
+					add(rs[0], false, "changed from function to method %s", qualifiedName(as[0]))
+				} else {
+					add(rs[0], false, "changed from method to function %s", qualifiedName(as[0]))
+				}
+			}
+		}
+	}
+
+	for _, f := range diff.RemovedFuncs {
+		if isPublicAPI(f) && !converted[f] {
+			add(f, false, "removed")
+		}
+	}
+	for _, pair := range diff.ChangedFuncs {
+		if isPublicAPI(pair[1]) && signatureChanged(pair[0], pair[1]) {
+			add(pair[1], false, "changed from func%s to func%s", pair[1].Signature, pair[0].Signature)
+		}
+	}
+	for _, pair := range diff.ReceiverRenames {
+		if isPublicAPI(pair[1]) {
+			add(pair[1], false, "moved to %s", qualifiedName(pair[0]))
+		}
+	}
+	for _, pair := range diff.ReceiverPointerChanges {
+		if isPublicAPI(pair[1]) {
+			add(pair[1], !strings.HasPrefix(pair[0].Receiver, "*"), "receiver changed from %s to %s", pair[1].Receiver, pair[0].Receiver)
+		}
+	}
+	for _, pair := range diff.PackageMoves {
+		if isPublicAPI(pair[1]) {
+			add(pair[1], false, "moved to package %s", pair[0].Package)
+		}
+	}
+	for _, pair := range diff.MethodConversions {
+		if !isPublicAPI(pair[1]) {
+			continue
+		}
+		if pair[0].Receiver != "" {
+			add(pair[1], false, "changed from function to method %s", qualifiedName(pair[0]))
+		} else {
+			add(pair[1], false, "changed from method to function %s", qualifiedName(pair[0]))
+		}
+	}
+	for _, f := range diff.NewFuncs {
+		if isPublicAPI(f) && !converted[f] {
+			add(f, true, "added")
+		}
+	}
+	for _, c := range publicInterfaceChanges(diff) {
+		change := func(format string, args ...any) {
+			out = append(out, apiChange{c.From.Package, c.From.Name, fmt.Sprintf(format, args...), false})
+		}
+		for _, m := range c.Added {
+			change("added %s", strings.ReplaceAll(methodDecl(m), "`", ""))
+		}
+		for _, m := range c.Removed {
+			change("removed %s", strings.ReplaceAll(methodDecl(m), "`", ""))
+		}
+		for _, p := range c.Retyped {
+			change("method %s changed from func%s to func%s", p[0].Name, p[1].Type, p[0].Type)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Package != out[j].Package {
+			return out[i].Package < out[j].Package
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// buildAPICheckReport renders apiChanges package by package, with
+// "Incompatible changes:" and "Compatible changes:" lists in apidiff's
+// format, and returns how many changes are incompatible.
+func buildAPICheckReport(diff DiffResult) (string, int) {
+	changes := apiChanges(diff)
+	if len(changes) == 0 {
+		return "No API changes.", 0
+	}
+
+	var b strings.Builder
+	incompatible := 0
+	for i := 0; i < len(changes); {
+		pkg := changes[i].Package
+		j := i
+		for j < len(changes) && changes[j].Package == pkg {
+			j++
+		}
+		if i > 0 {
+			fmt.Fprintf(&b, "\n")
+		}
+		fmt.Fprintf(&b, "%s\n", pkg)
+		for _, compatible := range []bool{false, true} {
+			header := "Incompatible changes:"
+			if compatible {
+				header = "Compatible changes:"
+			}
+			wrote := false
+			for _, c := range changes[i:j] {
+				if c.Compatible != compatible {
+					continue
+				}
+				if !wrote {
+					fmt.Fprintf(&b, "%s\n", header)
+					wrote = true
+				}
+				fmt.Fprintf(&b, "- %s: %s\n", c.Name, c.Message)
+				if !compatible {
+					incompatible++
+				}
+			}
+		}
+		i = j
+	}
+	return strings.TrimSuffix(b.String(), "\n"), incompatible
+}
+
+// requiredInterface is one --require-interface entry: an interface, named
+// however the user likes, and the method names it requires.
+type requiredInterface struct {
+	Name    string
+	Methods []string
+}
+
+// parseRequiredInterfaces parses "Name=M1,M2;Other=M3".
+func parseRequiredInterfaces(s string) ([]requiredInterface, error) {
+	var out []requiredInterface
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, methods, ok := strings.Cut(entry, "=")
+		iface := requiredInterface{Name: strings.TrimSpace(name), Methods: splitList(methods)}
+		if !ok || iface.Name == "" || len(iface.Methods) == 0 {
+			return nil, fmt.Errorf("invalid --require-interface entry %q (want Name=Method,Method)", entry)
+		}
+		out = append(out, iface)
+	}
+	return out, nil
+}
+
+// methodSetChange describes a receiver type whose exported methods were
+// removed or changed signature. Either can stop the type from satisfying an
+// interface it used to implement.
+type methodSetChange struct {
+	Package string
+	Type    string // base type name, without "*" or type parameters
+	Changed [][2]*FuncInfo
+	Removed []*FuncInfo
+	// Interfaces lists the --require-interface entries whose methods the
+	// type had on the to side and of which at least one is affected.
+	Interfaces []string
+}
+
+// receiverBaseType strips the pointer and type parameters from a receiver:
+// "*Box[K, V]" becomes "Box".
+func receiverBaseType(recv string) string {
+	recv = strings.TrimPrefix(recv, "*")
+	if i := strings.IndexByte(recv, '['); i >= 0 {
+		recv = recv[:i]
+	}
+	return recv
+}
+
+// methodSetChanges finds the types whose exported methods were removed or
+// had their signature changed, sorted by package and type. Methods are
+// matched by name only; value and pointer receivers count as one type.
+func methodSetChanges(diff DiffResult, required []requiredInterface) []methodSetChange {
+	type typeKey struct{ pkg, name string }
+	byType := make(map[typeKey]*methodSetChange)
+	get := func(f *FuncInfo) *methodSetChange {
+		k := typeKey{f.Package, receiverBaseType(f.Receiver)}
+		c, ok := byType[k]
+		if !ok {
+			c = &methodSetChange{Package: k.pkg, Type: k.name}
+			byType[k] = c
+		}
+		return c
+	}
+
+	for _, pair := range diff.ChangedFuncs {
+		to := pair[1]
+		if to.Receiver != "" && to.Exported && signatureChanged(pair[0], to) {
+			c := get(to)
+			c.Changed = append(c.Changed, pair)
+		}
+	}
+	for _, f := range diff.RemovedFuncs {
+		if f.Receiver != "" && f.Exported {
+			c := get(f)
+			c.Removed = append(c.Removed, f)
+		}
+	}
+	if len(byType) == 0 {
+		return nil
+	}
+
+	if len(required) > 0 {
+		// Method names each type had on the to side.
+		had := make(map[typeKey]map[string]bool)
+		add := func(f *FuncInfo) {
+			if f.Receiver == "" {
+				return
+			}
+			k := typeKey{f.Package, receiverBaseType(f.Receiver)}
+			if had[k] == nil {
+				had[k] = make(map[string]bool)
+			}
+			had[k][f.Name] = true
+		}
+		for _, f := range diff.UnchangedFuncs {
+			add(f)
+		}
+		for _, pair := range diff.ChangedFuncs {
+			add(pair[1])
+		}
+		for _, f := range diff.RemovedFuncs {
+			add(f)
+		}
+
+		for k, c := range byType {
+			affected := make(map[string]bool)
+			for _, pair := range c.Changed {
+				affected[pair[1].Name] = true
+			}
+			for _, f := range c.Removed {
+				affected[f.Name] = true
+			}
+			for _, iface := range required {
+				hadAll, hit := true, false
+				for _, m := range iface.Methods {
+					hadAll = hadAll && had[k][m]
+					hit = hit || affected[m]
+				}
+				if hadAll && hit {
+					c.Interfaces = append(c.Interfaces, iface.Name)
+				}
+			}
+		}
+	}
+
+	out := make([]methodSetChange, 0, len(byType))
+	for _, c := range byType {
+		sort.Slice(c.Changed, func(i, j int) bool { return c.Changed[i][1].Name < c.Changed[j][1].Name })
+		sort.Slice(c.Removed, func(i, j int) bool { return c.Removed[i].Name < c.Removed[j].Name })
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Package != out[j].Package {
+			return out[i].Package < out[j].Package
+		}
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
+
+// writeMethodSetChanges renders the "Method Set Changes" section.
+func writeMethodSetChanges(b *strings.Builder, changes []methodSetChange) {
+	fmt.Fprintf(b, "#### Method Set Changes\n\n")
+	fmt.Fprintf(b, "These types changed or lost exported methods, so they may no longer satisfy interfaces they used to implement.\n\n")
+	for _, c := range changes {
+		fmt.Fprintf(b, "- **`%s.%s`**", c.Package, c.Type)
+		if len(c.Interfaces) > 0 {
+			fmt.Fprintf(b, ": may no longer implement %s", codeList(c.Interfaces))
+		}
+		fmt.Fprintf(b, "\n")
+		for _, pair := range c.Changed {
+			fmt.Fprintf(b, "  - `%s`: `%s` → `%s`\n", qualifiedName(pair[1]), pair[1].Signature, pair[0].Signature)
+		}
+		for _, f := range c.Removed {
+			fmt.Fprintf(b, "  - `%s`: removed\n", qualifiedName(f))
+		}
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// breakingChange is a public-API function that was removed (New is nil),
+// whose signature changed, that moved to a renamed receiver type or to
+// another package, that became a method or a function, or whose receiver
+// changed from T to *T. Old is the to side.
+type breakingChange struct {
+	Old, New *FuncInfo
+}
+
+// breakingChanges flattens every removed public function and every changed
+// public signature across all packages, sorted by package, receiver and name.
+func breakingChanges(diff DiffResult) []breakingChange {
+	var out []breakingChange
+	for _, f := range diff.RemovedFuncs {
+		if isPublicAPI(f) {
+			out = append(out, breakingChange{Old: f})
+		}
+	}
+	for _, pair := range diff.ChangedFuncs {
+		if isPublicAPI(pair[1]) && signatureChanged(pair[0], pair[1]) {
+			out = append(out, breakingChange{Old: pair[1], New: pair[0]})
+		}
+	}
+	for _, pair := range diff.ReceiverRenames {
+		if isPublicAPI(pair[1]) {
+			out = append(out, breakingChange{Old: pair[1], New: pair[0]})
+		}
+	}
+	for _, pairs := range [][][2]*FuncInfo{diff.PackageMoves, diff.MethodConversions} {
+		for _, pair := range pairs {
+			if isPublicAPI(pair[1]) {
+				out = append(out, breakingChange{Old: pair[1], New: pair[0]})
+			}
+		}
+	}
+	// Moving from *T to T only grows T's method set, so it breaks nobody.
+	for _, pair := range diff.ReceiverPointerChanges {
+		if isPublicAPI(pair[1]) && strings.HasPrefix(pair[0].Receiver, "*") {
+			out = append(out, breakingChange{Old: pair[1], New: pair[0]})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return funcSortKey(out[i].Old) < funcSortKey(out[j].Old)
+	})
+	return out
+}
+
+// writeBreakingChanges renders the "Breaking Changes" section. Removals are
+// left out when the report omits removed functions (--only-changed).
+func writeBreakingChanges(b *strings.Builder, diff DiffResult, opts ReportOptions) {
+	fmt.Fprintf(b, "#### Breaking Changes\n\n")
+	n := 0
+	for _, bc := range breakingChanges(diff) {
+		name := bc.Old.Package + "." + qualifiedName(bc.Old)
+		switch {
+		case bc.New != nil && bc.New.Receiver != "" && bc.Old.Receiver == "":
+			fmt.Fprintf(b, "- `%s`: now a method, `%s`\n", name, formatFuncHeader(bc.New))
+		case bc.New != nil && bc.New.Receiver == "" && bc.Old.Receiver != "":
+			fmt.Fprintf(b, "- `%s`: now a function, `%s`\n", name, formatFuncHeader(bc.New))
+		case bc.New != nil && isPointerReceiverChange(bc.New, bc.Old):
+			fmt.Fprintf(b, "- `%s`: receiver is now `%s`, so `%s` values no longer have this method\n", name, bc.New.Receiver, bc.Old.Receiver)
+		case bc.New != nil && bc.New.Receiver != bc.Old.Receiver:
+			fmt.Fprintf(b, "- `%s`: receiver renamed, now `%s`\n", name, qualifiedName(bc.New))
+		case bc.New != nil && bc.New.Package != bc.Old.Package:
+			fmt.Fprintf(b, "- `%s`: moved to package `%s`\n", name, bc.New.Package)
+		case bc.New != nil:
+			var notes []string
+			if change, _ := contextParamChange(bc.New, bc.Old); change != "" {
+				notes = append(notes, change+" `context.Context`")
+			}
+			notes = append(notes, pointerReturnChanges(bc.Old.ResultTypes, bc.New.ResultTypes)...)
+			note := ""
+			if len(notes) > 0 {
+				note = " (" + strings.Join(notes, "; ") + ")"
+			}
+			fmt.Fprintf(b, "- `%s`: `%s` → `%s`%s\n", name, bc.Old.Signature, bc.New.Signature, note)
+		case !opts.OnlyChanged:
+			fmt.Fprintf(b, "- `%s`: removed (was `%s`)\n", name, bc.Old.Signature)
+		default:
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		fmt.Fprintf(b, "_None_\n")
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// contextParamIndex returns the position of the first context.Context
+// parameter in params, or -1 if there is none.
+func contextParamIndex(params []string) int {
+	for i, t := range params {
+		if canonicalType(t) == "context.Context" {
+			return i
+		}
+	}
+	return -1
+}
+
+// contextParamChange reports whether the from side of a changed function
+// gained ("added") or lost ("removed") a context.Context parameter compared
+// to the to side, with its position on the side that has it (0-based). It
+// returns "" when both or neither side take one.
+func contextParamChange(from, to *FuncInfo) (change string, pos int) {
+	fi, ti := contextParamIndex(from.ParamTypes), contextParamIndex(to.ParamTypes)
+	switch {
+	case fi >= 0 && ti < 0:
+		return "added", fi
+	case fi < 0 && ti >= 0:
+		return "removed", ti
+	}
+	return "", -1
+}
+
+// contextChanges returns the changed functions that gained or lost a
+// context.Context parameter, by package, file, receiver and name.
+func contextChanges(changed [][2]*FuncInfo) [][2]*FuncInfo {
+	var out [][2]*FuncInfo
+	for _, pair := range changed {
+		if change, _ := contextParamChange(pair[0], pair[1]); change != "" {
+			out = append(out, pair)
+		}
+	}
+	sortPairs(out)
+	return out
+}
+
+// writeContextChanges renders the "Context Propagation Changes" section.
+func writeContextChanges(b *strings.Builder, changes [][2]*FuncInfo, opts ReportOptions) {
+	fmt.Fprintf(b, "#### Context Propagation Changes\n\n")
+	for _, pair := range changes {
+		name := pair[0].Package + "." + qualifiedName(pair[0])
+		change, pos := contextParamChange(pair[0], pair[1])
+		where := fmt.Sprintf("parameter %d", pos+1)
+		if pos == 0 {
+			where = "the first parameter"
+		}
+		if change == "added" {
+			fmt.Fprintf(b, "- `%s`: now takes a `context.Context` (%s in `%s`)\n", name, where, opts.FromRef)
+		} else {
+			fmt.Fprintf(b, "- `%s`: dropped its `context.Context` (%s in `%s`)\n", name, where, opts.ToRef)
+		}
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+// largeChanges returns the changed functions whose |fromLOC - toLOC| exceeds
+// threshold.
+func largeChanges(changed [][2]*FuncInfo, threshold int) [][2]*FuncInfo {
+	var large [][2]*FuncInfo
+	for _, pair := range changed {
+		delta := pair[0].LineCount - pair[1].LineCount
+		if delta < 0 {
+			delta = -delta
+		}
+		if delta > threshold {
+			large = append(large, pair)
+		}
+	}
+	sort.Slice(large, func(i, j int) bool {
+		return funcSortKey(large[i][0]) < funcSortKey(large[j][0])
+	})
+	return large
+}
+
+// capFuncs returns the new or removed functions a section lists under
+// --max-functions, and how many it leaves out. With --sort=impact public API
+// functions come first, then longer ones; otherwise they are taken by
+// package, file, receiver and name.
+func capFuncs(funcs []*FuncInfo, opts ReportOptions) ([]*FuncInfo, int) {
+	if opts.MaxFunctions <= 0 || len(funcs) <= opts.MaxFunctions {
+		return funcs, 0
+	}
+	sorted := append([]*FuncInfo(nil), funcs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if opts.Sort == "impact" {
+			if pa, pb := isPublicAPI(a), isPublicAPI(b); pa != pb {
+				return pa
+			}
+			if a.LineCount != b.LineCount {
+				return a.LineCount > b.LineCount
+			}
+		}
+		return funcSortKey(a) < funcSortKey(b)
+	})
+	return sorted[:opts.MaxFunctions], len(funcs) - opts.MaxFunctions
+}
+
+// capPairs keeps the first n changed functions (ChangedFuncs is already in
+// --sort order), or all of them when n is not positive.
+func capPairs(pairs [][2]*FuncInfo, n int) ([][2]*FuncInfo, int) {
+	if n <= 0 || len(pairs) <= n {
+		return pairs, 0
+	}
+	return pairs[:n], len(pairs) - n
+}
+
+// writeOmitted notes how many functions --max-functions left out of a
+// Markdown section.
+func writeOmitted(b *strings.Builder, omitted int) {
+	if omitted > 0 {
+		fmt.Fprintf(b, "_… and %d more_\n\n", omitted)
+	}
+}
+
+// impactWeights are the coefficients of impactScore, set with
+// --impact-weights.
+type impactWeights struct {
+	Signature  float64 // added when the signature changed
+	LOC        float64 // per line of LOC delta
+	Complexity float64 // per point of cyclomatic complexity delta
+	Exported   float64 // multiplies the score of public API functions
+}
+
+var defaultImpactWeights = impactWeights{Signature: 10, LOC: 0.1, Complexity: 1, Exported: 2}
+
+// parseImpactWeights parses "signature=10,loc=0.1"; omitted keys keep their
+// defaults.
+func parseImpactWeights(s string) (impactWeights, error) {
+	w := defaultImpactWeights
+	fields := map[string]*float64{
+		"signature":  &w.Signature,
+		"loc":        &w.LOC,
+		"complexity": &w.Complexity,
+		"exported":   &w.Exported,
+	}
+	for _, entry := range splitList(s) {
+		key, value, ok := strings.Cut(entry, "=")
+		field := fields[strings.TrimSpace(key)]
+		if !ok || field == nil {
+			return w, fmt.Errorf("invalid --impact-weights entry %q (keys: signature, loc, complexity, exported)", entry)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || v < 0 {
+			return w, fmt.Errorf("invalid --impact-weights entry %q (weights are non-negative numbers)", entry)
+		}
+		*field = v
+	}
+	return w, nil
+}
+
+// impactScore rates how risky a change is, so the riskiest can be reviewed
+// first: w.Signature if the signature changed, plus w.LOC per line the
+// function grew or shrank and w.Complexity per point its cyclomatic
+// complexity moved, all multiplied by w.Exported for public API.
+func impactScore(from, to *FuncInfo, w impactWeights) float64 {
+	score := w.LOC*math.Abs(float64(from.LineCount-to.LineCount)) +
+		w.Complexity*math.Abs(float64(from.Complexity-to.Complexity))
+	if signatureChanged(from, to) {
+		score += w.Signature
+	}
+	if isPublicAPI(from) || isPublicAPI(to) {
+		score *= w.Exported
+	}
+	return score
+}
+
+// roundImpact rounds an impact score to the one decimal reports show.
+func roundImpact(score float64) float64 {
+	return math.Round(score*10) / 10
+}
+
+func formatImpact(score float64) string {
+	return strconv.FormatFloat(roundImpact(score), 'f', -1, 64)
+}
+
+// sortChanged orders changed functions for --sort: by package, file,
+// receiver and name, or by descending impact score (ties by name).
+func sortChanged(changed [][2]*FuncInfo, by string, w impactWeights) {
+	sort.SliceStable(changed, func(i, j int) bool {
+		if by == "impact" {
+			si, sj := impactScore(changed[i][0], changed[i][1], w), impactScore(changed[j][0], changed[j][1], w)
+			if si != sj {
+				return si > sj
+			}
+		}
+		return funcSortKey(changed[i][0]) < funcSortKey(changed[j][0])
+	})
+}
+
+// mermaidMaxPackages caps the per-package bar chart; the packages with the
+// most churn are kept.
+const mermaidMaxPackages = 15
+
+// writeMermaidCharts renders a Mermaid pie chart of the new, removed and
+// changed counts and, when more than one package changed, a bar chart of
+// each package's churn (new + removed + changed). Nothing is written for an
+// empty diff.
+func writeMermaidCharts(b *strings.Builder, diff DiffResult) {
+	if len(diff.NewFuncs)+len(diff.RemovedFuncs)+len(diff.ChangedFuncs) == 0 {
+		return
+	}
+	counts := []struct {
+		label string
+		n     int
+	}{
+		{"New", len(diff.NewFuncs)},
+		{"Removed", len(diff.RemovedFuncs)},
+		{"Changed", len(diff.ChangedFuncs)},
+	}
+	fmt.Fprintf(b, "```mermaid\npie title Function changes\n")
+	for _, c := range counts {
+		// Mermaid draws zero-sized slices as empty legend entries.
+		if c.n > 0 {
+			fmt.Fprintf(b, "    %q : %d\n", c.label, c.n)
+		}
+	}
+	fmt.Fprintf(b, "```\n\n")
+
+	type pkgChurn struct {
+		pkg   string
+		churn int
+	}
+	var pkgs []pkgChurn
+	for pkg, s := range diff.PkgStats {
+		if n := s.New + s.Removed + s.Changed; n > 0 {
+			pkgs = append(pkgs, pkgChurn{pkg, n})
+		}
+	}
+	if len(pkgs) < 2 {
+		return
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		if pkgs[i].churn != pkgs[j].churn {
+			return pkgs[i].churn > pkgs[j].churn
+		}
+		return pkgs[i].pkg < pkgs[j].pkg
+	})
+	title := "Churn by package"
+	if len(pkgs) > mermaidMaxPackages {
+		pkgs = pkgs[:mermaidMaxPackages]
+		title = fmt.Sprintf("Churn by package (top %d)", mermaidMaxPackages)
+	}
+	labels := make([]string, len(pkgs))
+	values := make([]string, len(pkgs))
+	for i, p := range pkgs {
+		labels[i] = strconv.Quote(strings.ReplaceAll(p.pkg, `"`, "'"))
+		values[i] = strconv.Itoa(p.churn)
+	}
+	fmt.Fprintf(b, "```mermaid\nxychart-beta\n    title %q\n", title)
+	fmt.Fprintf(b, "    x-axis [%s]\n", strings.Join(labels, ", "))
+	fmt.Fprintf(b, "    y-axis \"Functions\"\n")
+	fmt.Fprintf(b, "    bar [%s]\n```\n\n", strings.Join(values, ", "))
+}
+
+func buildMarkdownReport(ctx context.Context, diff DiffResult, opts ReportOptions) string {
+	if opts.HeadOnly {
+		return buildHeadOnlyReport(ctx, diff, opts)
+	}
+	var b strings.Builder
+
+	// Header
+	if !opts.NoSummary {
+		fmt.Fprintf(&b, "### Function Diff: `%s` → `%s`\n\n", opts.FromRef, opts.ToRef)
+	}
+
+	if opts.ThresholdLOC > 0 {
+		if large := largeChanges(diff.ChangedFuncs, opts.ThresholdLOC); len(large) > 0 {
+			fmt.Fprintf(&b, "#### Large Changes (more than %d lines)\n\n", opts.ThresholdLOC)
+			for _, pair := range large {
+				from, to := pair[0], pair[1]
+				fmt.Fprintf(&b, "- **`%s.%s`** (`%s`): %d → %d LOC (%+d)\n",
+					from.Package, qualifiedName(from), from.File,
+					to.LineCount, from.LineCount, from.LineCount-to.LineCount)
+			}
+			fmt.Fprintf(&b, "\n")
+		}
+	}
+
+	if changes := methodSetChanges(diff, opts.RequiredInterfaces); len(changes) > 0 {
+		writeMethodSetChanges(&b, changes)
+	}
+
+	// Summary
+	if !opts.NoSummary {
+		fmt.Fprintf(&b, "#### Summary\n")
+		fmt.Fprintf(&b, "- Total functions in `%s`: %d\n", opts.FromRef, diff.FromTotal)
+		fmt.Fprintf(&b, "- Total functions in `%s`: %d\n", opts.ToRef, diff.ToTotal)
+		fmt.Fprintf(&b, "\n")
+		if !opts.OnlyChanged {
+			fmt.Fprintf(&b, "- New functions in `%s` only: %d\n", opts.FromRef, len(diff.NewFuncs))
+			fmt.Fprintf(&b, "- Removed functions (only in `%s`): %d\n", opts.ToRef, len(diff.RemovedFuncs))
+		}
+		fmt.Fprintf(&b, "- Changed functions: %d\n", len(diff.ChangedFuncs))
+		if len(diff.PossibleMoves) > 0 && !opts.OnlyChanged {
+			fmt.Fprintf(&b, "- Possibly relocated/duplicated: %d\n", len(diff.PossibleMoves))
+		}
+		if len(diff.ReceiverRenames) > 0 {
+			fmt.Fprintf(&b, "- Methods on a renamed receiver: %d\n", len(diff.ReceiverRenames))
+		}
+		if len(diff.ReceiverPointerChanges) > 0 {
+			fmt.Fprintf(&b, "- Receiver pointer changes: %d\n", len(diff.ReceiverPointerChanges))
+		}
+		if len(diff.PackageMoves) > 0 {
+			fmt.Fprintf(&b, "- Moved between packages: %d\n", len(diff.PackageMoves))
+		}
+		if len(diff.MethodConversions) > 0 {
+			fmt.Fprintf(&b, "- Function/method conversions: %d\n", len(diff.MethodConversions))
+		}
+		if n := len(contextChanges(diff.ChangedFuncs)); n > 0 {
+			fmt.Fprintf(&b, "- Context propagation changes: %d\n", n)
+		}
+		if level, reason := semverImpact(diff); reason != "" {
+			fmt.Fprintf(&b, "- Suggested version impact: **%s** (%s)\n", level, reason)
+		} else {
+			fmt.Fprintf(&b, "- Suggested version impact: **%s**\n", level)
+		}
+		fmt.Fprintf(&b, "\n")
+
+		if opts.Mermaid {
+			writeMermaidCharts(&b, diff)
+		}
+	}
+
+	if len(diff.ParseFailures) > 0 {
+		writeParseFailures(&b, diff.ParseFailures)
+	}
+
+	writeBreakingChanges(&b, diff, opts)
+
+	if changes := contextChanges(diff.ChangedFuncs); len(changes) > 0 {
+		writeContextChanges(&b, changes, opts)
+	}
+
+	reduced, stubs := stubChanges(diff)
+	if opts.OnlyChanged {
+		stubs = nil
+	}
+	if len(reduced)+len(stubs) > 0 {
+		writeStubChanges(&b, reduced, stubs, opts)
+	}
+
+	structs, ifaces := splitTypeChanges(diff.ChangedTypes)
+	if len(structs) > 0 {
+		writeStructChanges(&b, structs)
+	}
+	if len(ifaces) > 0 {
+		writeInterfaceChanges(&b, ifaces)
+	}
+
+	if len(diff.DeprecationChanges) > 0 {
+		writeDeprecations(&b, diff.DeprecationChanges)
+	}
+
+	if len(diff.DocChanges) > 0 {
+		writeDocChanges(&b, diff.DocChanges, opts)
+	}
+
+	// High-level changes by package (or by file)
+	if !opts.NoSummary {
+		groupStats, groupTitle := diff.PkgStats, "Package"
+		if opts.GroupBy == "file" {
+			groupStats, groupTitle = statsByFile(diff), "File"
+		}
+		fmt.Fprintf(&b, "#### High-Level Changes by %s\n\n", groupTitle)
+		if opts.OnlyChanged {
+			fmt.Fprintf(&b, "| %s | Changed |\n", groupTitle)
+			fmt.Fprintf(&b, "|---------|---------|\n")
+		} else {
+			fmt.Fprintf(&b, "| %s | New | Removed | Changed | Net LOC |\n", groupTitle)
+			fmt.Fprintf(&b, "|---------|-----|---------|---------|---------|\n")
+		}
+
+		pkgs := make([]string, 0, len(groupStats))
+		for pkg := range groupStats {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+
+		for _, pkg := range pkgs {
+			stats := groupStats[pkg]
+			if opts.OnlyChanged {
+				if stats.Changed > 0 {
+					fmt.Fprintf(&b, "| `%s` | %d |\n", pkg, stats.Changed)
+				}
+				continue
+			}
+			fmt.Fprintf(&b, "| `%s` | %d | %d | %d | %s |\n", pkg, stats.New, stats.Removed, stats.Changed, formatNetLOC(stats.NetLOC()))
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+
+	if opts.SummaryOnly {
+		if opts.OutDir != "" {
+			changed, omitted := capPairs(diff.ChangedFuncs, opts.MaxFunctions)
+			files := writeAllChangedFuncFiles(ctx, opts, changed)
+			addChangedFilesIndex(&b, opts, files)
+			writeOmitted(&b, omitted)
+		}
+		return b.String()
+	}
+
+	if opts.Collapsible {
+		writeCollapsiblePackages(ctx, &b, diff, opts)
+	} else {
+		if !opts.OnlyChanged {
+			// New functions section
+			fmt.Fprintf(&b, "#### New Functions in `%s` (not in `%s`)\n\n", opts.FromRef, opts.ToRef)
+			if len(diff.NewFuncs) == 0 {
+				fmt.Fprintf(&b, "_None_\n\n")
+			} else {
+				funcs, omitted := capFuncs(diff.NewFuncs, opts)
+				printFuncList(&b, funcs, opts.GroupBy, opts.Links)
+				writeOmitted(&b, omitted)
+			}
+
+			// Removed functions section
+			fmt.Fprintf(&b, "#### Removed Functions (only in `%s`)\n\n", opts.ToRef)
+			if len(diff.RemovedFuncs) == 0 {
+				fmt.Fprintf(&b, "_None_\n\n")
+			} else {
+				funcs, omitted := capFuncs(diff.RemovedFuncs, opts)
+				printFuncList(&b, funcs, opts.GroupBy, opts.Links)
+				writeOmitted(&b, omitted)
+			}
+		}
+
+		// Changed functions – only an index in the main report; details go to files
+		fmt.Fprintf(&b, "#### Changed Functions\n\n")
+		if len(diff.ChangedFuncs) == 0 {
+			fmt.Fprintf(&b, "_None_\n\n")
+		} else {
+			changed, omitted := capPairs(diff.ChangedFuncs, opts.MaxFunctions)
+			item := func(indent string, pair [2]*FuncInfo) {
+				fi := pair[0]
+				name := fi.Name
+				if fi.Receiver != "" {
+					name = fmt.Sprintf("(%s).%s", fi.Receiver, fi.Name)
+				}
+				impact := formatImpact(impactScore(fi, pair[1], opts.ImpactWeights))
+				if opts.Explain {
+					impact += "; changed: " + explainChange(fi, pair[1], opts.Diff)
+				}
+				if bl, ok := opts.Blame[pair[1]]; ok {
+					impact += "; last touched by " + bl.describe(opts.Canonical)
+				}
+				fmt.Fprintf(&b, "%s- %s: `%s` (impact %s)\n", indent, opts.Links.link(fi, "`"+fi.File+"`"), name, impact)
+			}
+			switch {
+			case opts.GroupBy == "change-kind":
+				writeChangedByKind(&b, changed, item)
+				if opts.OutDir != "" {
+					files := writeAllChangedFuncFiles(ctx, opts, changed)
+					addChangedFilesIndex(&b, opts, files)
+				}
+			case opts.OutDir != "":
+				files := writeAllChangedFuncFiles(ctx, opts, changed)
+				addChangedFilesIndex(&b, opts, files)
+			default:
+				// If no out dir, we can at least list the names
+				for _, pair := range changed {
+					item("", pair)
+				}
+				fmt.Fprintf(&b, "\n")
+			}
+			writeOmitted(&b, omitted)
+		}
+	}
+
+	if len(diff.ReceiverRenames) > 0 {
+		writeReceiverRenames(&b, diff.ReceiverRenames)
+	}
+
+	if len(diff.ReceiverPointerChanges) > 0 {
+		writeReceiverPointerChanges(&b, diff.ReceiverPointerChanges)
+	}
+
+	if len(diff.PackageMoves) > 0 {
+		writePackageMoves(&b, diff.PackageMoves)
+	}
+
+	if len(diff.MethodConversions) > 0 {
+		writeMethodConversions(&b, diff.MethodConversions)
+	}
+
+	if len(diff.PossibleMoves) > 0 && !opts.OnlyChanged {
+		fmt.Fprintf(&b, "#### Possibly Relocated/Duplicated\n\n")
+		fmt.Fprintf(&b, "New functions whose body is identical to a removed function:\n\n")
+		for _, pair := range diff.PossibleMoves {
+			nf, rf := pair[0], pair[1]
+			fmt.Fprintf(&b, "- `%s.%s` (`%s` lines %d–%d in `%s`) ↔ `%s.%s` (`%s` lines %d–%d in `%s`)\n",
+				nf.Package, qualifiedName(nf), nf.File, nf.StartLine, nf.EndLine, opts.FromRef,
+				rf.Package, qualifiedName(rf), rf.File, rf.StartLine, rf.EndLine, opts.ToRef)
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+
+	return b.String()
+}
+
+// buildHeadOnlyReport renders --head-only: the new functions of the from
+// side, sorted by package, file, receiver and name, each with its body. With
+// --out-dir the bodies go to per-function files and the report indexes them.
+func buildHeadOnlyReport(ctx context.Context, diff DiffResult, opts ReportOptions) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### New Functions: `%s` (not in `%s`)\n\n", opts.FromRef, opts.ToRef)
+	fmt.Fprintf(&b, "- New functions: %d\n\n", len(diff.NewFuncs))
+	if len(diff.NewFuncs) == 0 {
+		fmt.Fprintf(&b, "_None_\n")
+		return b.String()
+	}
+
+	funcs, omitted := capFuncs(diff.NewFuncs, opts)
+	sort.Slice(funcs, func(i, j int) bool { return funcSortKey(funcs[i]) < funcSortKey(funcs[j]) })
+	if opts.OutDir != "" {
+		pairs := make([][2]*FuncInfo, len(funcs))
+		for i, f := range funcs {
+			pairs[i] = [2]*FuncInfo{f, nil}
+		}
+		files := writeAllChangedFuncFiles(ctx, opts, pairs)
+		addChangedFilesIndex(&b, opts, files)
+		writeOmitted(&b, omitted)
+		return b.String()
+	}
+	for _, f := range funcs {
+		fmt.Fprintf(&b, "#### `%s.%s`\n\n", f.Package, qualifiedName(f))
+		fmt.Fprintf(&b, "- file: `%s`\n", f.File)
+		fmt.Fprintf(&b, "- lines: %d–%d (%d LOC)\n\n", f.StartLine, f.EndLine, f.LineCount)
+		writeFuncBody(ctx, &b, opts, opts.FromRef, opts.FromSource, f)
+	}
+	writeOmitted(&b, omitted)
+	return b.String()
+}
+
+// writeFuncBody writes info's header and, unless opts.NoBody, its body read
+// from src (truncated to opts.MaxBodyBytes) as Go code blocks.
+func writeFuncBody(ctx context.Context, b *strings.Builder, opts ReportOptions, ref string, src fileSource, info *FuncInfo) {
+	if opts.NoBody {
+		fmt.Fprintf(b, "```go\n%s\n```\n\n", formatFuncHeader(info))
+		return
+	}
+	body, err := loadFuncBody(ctx, src, info)
+	if strings.TrimSpace(body) == "" {
+		fmt.Fprintf(b, "```go\n%s\n```\n\n%s\n\n", formatFuncHeader(info), bodyUnavailableNote(ref, info, err))
+		return
+	}
+	fmt.Fprintf(b, "```go\n%s\n```\n\n", truncateBody(body, opts.MaxBodyBytes))
+}
+
+// writeChangedByKind lists changed (in its order) under one heading per
+// change kind, in changeKinds order, and within each kind by package.
+func writeChangedByKind(b *strings.Builder, changed [][2]*FuncInfo, item func(indent string, pair [2]*FuncInfo)) {
+	byKind := make(map[string][][2]*FuncInfo)
+	for _, pair := range changed {
+		k := changeKind(pair[0], pair[1])
+		byKind[k] = append(byKind[k], pair)
+	}
+	for _, k := range changeKinds {
+		pairs := byKind[k.kind]
+		if len(pairs) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "##### %s (%d)\n\n", k.title, len(pairs))
+		byPkg := make(map[string][][2]*FuncInfo)
+		var pkgs []string
+		for _, pair := range pairs {
+			pkg := pair[0].Package
+			if byPkg[pkg] == nil {
+				pkgs = append(pkgs, pkg)
+			}
+			byPkg[pkg] = append(byPkg[pkg], pair)
+		}
+		sort.Strings(pkgs)
+		for _, pkg := range pkgs {
+			fmt.Fprintf(b, "- `%s`\n", pkg)
+			for _, pair := range byPkg[pkg] {
+				item("  ", pair)
+			}
+		}
+		fmt.Fprintf(b, "\n")
+	}
+}
+
+// writeCollapsiblePackages renders the function listings of
+// --format=markdown-collapsible: one <details> block per package, its
+// summary line giving the package's counts, holding the new, removed and
+// changed functions. Each changed function is a nested <details> block with
+// its signatures, locations and why it was flagged. --max-functions caps
+// each kind across all packages; --out-dir files are indexed after the
+// blocks.
+func writeCollapsiblePackages(ctx context.Context, b *strings.Builder, diff DiffResult, opts ReportOptions) {
+	var newFuncs, removedFuncs []*FuncInfo
+	var omitted int
+	if !opts.OnlyChanged {
+		var n int
+		newFuncs, n = capFuncs(diff.NewFuncs, opts)
+		omitted += n
+		removedFuncs, n = capFuncs(diff.RemovedFuncs, opts)
+		omitted += n
+	}
+	changed, n := capPairs(diff.ChangedFuncs, opts.MaxFunctions)
+	omitted += n
+
+	type pkgFuncs struct {
+		added, removed []*FuncInfo
+		changed        [][2]*FuncInfo
+	}
+	byPkg := make(map[string]*pkgFuncs)
+	get := func(pkg string) *pkgFuncs {
+		if byPkg[pkg] == nil {
+			byPkg[pkg] = &pkgFuncs{}
+		}
+		return byPkg[pkg]
+	}
+	for _, f := range newFuncs {
+		get(f.Package).added = append(get(f.Package).added, f)
+	}
+	for _, f := range removedFuncs {
+		get(f.Package).removed = append(get(f.Package).removed, f)
+	}
+	for _, pair := range changed {
+		get(pair[0].Package).changed = append(get(pair[0].Package).changed, pair)
+	}
+	pkgs := make([]string, 0, len(byPkg))
+	for pkg := range byPkg {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+
+	esc := html.EscapeString
+	fmt.Fprintf(b, "#### Functions by Package\n\n")
+	if len(pkgs) == 0 {
+		fmt.Fprintf(b, "_None_\n\n")
+	}
+	for _, pkg := range pkgs {
+		p := byPkg[pkg]
+		stats := diff.PkgStats[pkg]
+		if stats == nil {
+			stats = &PackageStats{}
+		}
+		counts := fmt.Sprintf("%d changed", stats.Changed)
+		if !opts.OnlyChanged {
+			counts = fmt.Sprintf("%d new, %d removed, %d changed", stats.New, stats.Removed, stats.Changed)
+		}
+		fmt.Fprintf(b, "<details>\n<summary><code>%s</code>: %s</summary>\n\n", esc(pkg), counts)
+		if len(p.added) > 0 {
+			fmt.Fprintf(b, "**New in `%s`**\n\n", opts.FromRef)
+			sortFuncs(p.added)
+			for _, f := range p.added {
+				printFuncEntry(b, f, "", opts.Links)
+			}
+			fmt.Fprintf(b, "\n")
+		}
+		if len(p.removed) > 0 {
+			fmt.Fprintf(b, "**Removed (only in `%s`)**\n\n", opts.ToRef)
+			sortFuncs(p.removed)
+			for _, f := range p.removed {
+				printFuncEntry(b, f, "", opts.Links)
+			}
+			fmt.Fprintf(b, "\n")
+		}
+		if len(p.changed) > 0 {
+			fmt.Fprintf(b, "**Changed**\n\n")
+			// Kept in ChangedFuncs (--sort) order.
+			for _, pair := range p.changed {
+				from, to := pair[0], pair[1]
+				fmt.Fprintf(b, "<details>\n<summary><code>%s</code> (impact %s)</summary>\n\n",
+					esc(qualifiedName(from)), formatImpact(impactScore(from, to, opts.ImpactWeights)))
+				fmt.Fprintf(b, "- changed: %s\n", explainChange(from, to, opts.Diff))
+				fmt.Fprintf(b, "- `%s`: `%s` (%s)\n", opts.FromRef, from.Signature,
+					opts.Links.link(from, fmt.Sprintf("`%s` lines %d–%d", from.File, from.StartLine, from.EndLine)))
+				fmt.Fprintf(b, "- `%s`: `%s` (%s)\n\n", opts.ToRef, to.Signature,
+					opts.Links.link(to, fmt.Sprintf("`%s` lines %d–%d", to.File, to.StartLine, to.EndLine)))
+				fmt.Fprintf(b, "</details>\n\n")
+			}
+		}
+		fmt.Fprintf(b, "</details>\n\n")
+	}
+	writeOmitted(b, omitted)
+
+	if opts.OutDir != "" {
+		files := writeAllChangedFuncFiles(ctx, opts, changed)
+		addChangedFilesIndex(b, opts, files)
+	}
+}
+
+// writeParseFailures lists files that failed to parse, grouped by ref, so
+// readers know which parts of the diff may be incomplete.
+func writeParseFailures(b *strings.Builder, failures []ParseFailure) {
+	fmt.Fprintf(b, "#### Files That Failed to Parse\n\n")
+	fmt.Fprintf(b, "Functions in these files are missing from the diff, so changes in them may show up as new or removed:\n\n")
+
+	byRef := make(map[string][]ParseFailure)
+	var refs []string
+	for _, f := range failures {
+		if _, ok := byRef[f.Ref]; !ok {
+			refs = append(refs, f.Ref)
+		}
+		byRef[f.Ref] = append(byRef[f.Ref], f)
+	}
+
+	for _, ref := range refs {
+		fmt.Fprintf(b, "- `%s`\n", ref)
+		list := byRef[ref]
+		sort.Slice(list, func(i, j int) bool { return list[i].File < list[j].File })
+		for _, f := range list {
+			fmt.Fprintf(b, "  - `%s`: %s\n", f.File, f.Err)
+		}
+	}
+	fmt.Fprintf(b, "\n")
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// buildJUnitReport renders diff as a JUnit testsuite, one testcase per
+// function (classname = package). Removed exported functions fail; changed
+// signatures fail with --fail-on=signature and are skipped otherwise; new,
+// unchanged and body-only changes pass.
+func buildJUnitReport(diff DiffResult, opts ReportOptions) (string, error) {
+	suite := junitTestSuite{Name: fmt.Sprintf("funcdiff %s → %s", opts.FromRef, opts.ToRef)}
+
+	newCase := func(f *FuncInfo) junitTestCase {
+		return junitTestCase{ClassName: f.Package, Name: qualifiedName(f), File: f.File, Line: f.StartLine}
+	}
+	location := func(f *FuncInfo) string {
+		return fmt.Sprintf("%s:%d-%d", f.File, f.StartLine, f.EndLine)
+	}
+
+	for _, f := range diff.NewFuncs {
+		suite.Cases = append(suite.Cases, newCase(f))
+	}
+	for _, f := range diff.UnchangedFuncs {
+		suite.Cases = append(suite.Cases, newCase(f))
+	}
+	for _, f := range diff.RemovedFuncs {
+		tc := newCase(f)
+		if f.Exported {
+			tc.Failure = &junitMessage{
+				Message: "exported function removed",
+				Text:    fmt.Sprintf("%s was removed (only in %s at %s)", qualifiedName(f), opts.ToRef, location(f)),
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	for _, pair := range diff.ChangedFuncs {
+		from, to := pair[0], pair[1]
+		tc := newCase(from)
+		if signatureChanged(from, to) {
+			msg := &junitMessage{
+				Message: "signature changed",
+				Text: fmt.Sprintf("%s: %s (%s at %s) → %s (%s at %s)", qualifiedName(from),
+					to.Signature, opts.ToRef, location(to), from.Signature, opts.FromRef, location(from)),
+			}
+			if opts.failsOn("signature") {
+				tc.Failure = msg
+			} else {
+				tc.Skipped = msg
+			}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	sort.Slice(suite.Cases, func(i, j int) bool {
+		a, b := suite.Cases[i], suite.Cases[j]
+		if a.ClassName != b.ClassName {
+			return a.ClassName < b.ClassName
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.File < b.File
+	})
+	for _, tc := range suite.Cases {
+		suite.Tests++
+		if tc.Failure != nil {
+			suite.Failures++
+		}
+		if tc.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+
+	out, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("marshal junit report: %w", err)
+	}
+	return xml.Header + string(out), nil
+}
+
+// codeQualityIssue is one entry of a GitLab Code Quality report, see
+// https://docs.gitlab.com/ee/ci/testing/code_quality.html#implement-a-custom-tool.
+type codeQualityIssue struct {
+	Description string              `json:"description"`
+	CheckName   string              `json:"check_name"`
+	Fingerprint string              `json:"fingerprint"`
+	Severity    string              `json:"severity"`
+	Location    codeQualityLocation `json:"location"`
+}
+
+type codeQualityLocation struct {
+	Path  string `json:"path"`
+	Lines struct {
+		Begin int `json:"begin"`
+	} `json:"lines"`
+}
+
+// codeQualityFingerprint identifies an issue by package, qualified name,
+// build constraint and kind only, so GitLab matches it across pipelines even
+// when lines move, yet keeps per-platform variants of a function apart.
+func codeQualityFingerprint(f *FuncInfo, kind string) string {
+	h := sha256.Sum256([]byte(f.Package + "\x00" + qualifiedName(f) + "\x00" + f.Build + "\x00" + kind))
+	return fmt.Sprintf("%x", h[:16])
+}
+
+// buildGitLabCodeQualityReport renders diff as the JSON array GitLab's merge
+// request widget reads: removed exported functions are major, signature
+// changes minor and body-only changes info. New and removed unexported
+// functions are not reported. Issues are sorted by package, file, receiver
+// and name.
+func buildGitLabCodeQualityReport(diff DiffResult, opts ReportOptions) (string, error) {
+	issues := []codeQualityIssue{}
+	add := func(f *FuncInfo, kind, severity, description string) {
+		issue := codeQualityIssue{
+			Description: description,
+			CheckName:   "funcdiff/" + kind,
+			Fingerprint: codeQualityFingerprint(f, kind),
+			Severity:    severity,
+		}
+		issue.Location.Path = filepath.ToSlash(f.File)
+		issue.Location.Lines.Begin = f.StartLine
+		issues = append(issues, issue)
+	}
+
+	removed := append([]*FuncInfo(nil), diff.RemovedFuncs...)
+	sort.Slice(removed, func(i, j int) bool { return funcSortKey(removed[i]) < funcSortKey(removed[j]) })
+	for _, f := range removed {
+		if f.Exported {
+			add(f, "removed", "major", fmt.Sprintf("Exported function %s was removed (present in %s)", qualifiedName(f), opts.ToRef))
+		}
+	}
+	changed := append([][2]*FuncInfo(nil), diff.ChangedFuncs...)
+	sort.Slice(changed, func(i, j int) bool { return funcSortKey(changed[i][0]) < funcSortKey(changed[j][0]) })
+	for _, pair := range changed {
+		from, to := pair[0], pair[1]
+		if signatureChanged(from, to) {
+			add(from, "signature", "minor", fmt.Sprintf("Signature of %s changed: %s → %s", qualifiedName(from), to.Signature, from.Signature))
+		} else {
+			add(from, "body", "info", fmt.Sprintf("Body of %s changed", qualifiedName(from)))
+		}
+	}
+
+	out, err := json.MarshalIndent(issues, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("marshal gitlab-codequality report: %w", err)
+	}
+	return string(out), nil
+}
+
+// ANSI color codes used by the terminal renderer.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+// useColor reports whether colored output should be written to f: only when
+// f is a terminal and NO_COLOR (https://no-color.org) is not set.
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isTerminal(f)
+}
+
+// isTerminal reports whether f is a character device such as a TTY.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func colorize(s, code string, enabled bool) string {
+	if !enabled || code == "" {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+// patchContext is the number of unchanged lines around each patch hunk, as
+// in diff -u.
+const patchContext = 3
+
+// buildPatchReport renders every changed function as a unified diff from the
+// to side (a/) to the from side (b/), using the functions' real line numbers
+// so the result applies to the to side's files with git apply or patch.
+// Functions of the same file share one file header. Functions whose text is
+// identical (pure line shifts) produce no hunk; functions whose body can't be
+// read are skipped with a warning.
+func buildPatchReport(ctx context.Context, diff DiffResult, opts ReportOptions) string {
+	changed := append([][2]*FuncInfo(nil), diff.ChangedFuncs...)
+	sort.Slice(changed, func(i, j int) bool {
+		a, b := changed[i][1], changed[j][1]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.StartLine < b.StartLine
+	})
+
+	var b strings.Builder
+	lastHeader := ""
+	for _, pair := range changed {
+		fromInfo, toInfo := pair[0], pair[1]
+		fromBody, fromErr := loadFuncBody(ctx, opts.FromSource, fromInfo)
+		toBody, toErr := loadFuncBody(ctx, opts.ToSource, toInfo)
+		if fromErr != nil || toErr != nil {
+			err := fromErr
+			if err == nil {
+				err = toErr
+			}
+			logf("warning", fromInfo.File, "", "no patch for %s: %v", qualifiedName(fromInfo), err)
+			continue
+		}
+
+		hunks := unifiedHunks(strings.Split(toBody, "\n"), strings.Split(fromBody, "\n"),
+			toInfo.StartLine, fromInfo.StartLine, formatFuncHeader(toInfo))
+		if hunks == "" {
+			continue
+		}
+		header := fmt.Sprintf("--- a/%s\n+++ b/%s\n", toInfo.File, fromInfo.File)
+		if header != lastHeader {
+			b.WriteString(header)
+			lastHeader = header
+		}
+		b.WriteString(hunks)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// lineOp is one line of a line diff: ' ' kept, '-' only in a, '+' only in b.
+type lineOp struct {
+	kind byte
+	text string
+}
+
+// maxLineDiffCells caps the LCS table size; larger inputs are diffed as one
+// block replacement instead.
+const maxLineDiffCells = 4 << 20
+
+// diffLineOps computes a minimal line diff of a and b via longest common
+// subsequence.
+func diffLineOps(a, b []string) []lineOp {
+	n, m := len(a), len(b)
+	if (n+1)*(m+1) > maxLineDiffCells {
+		ops := make([]lineOp, 0, n+m)
+		for _, l := range a {
+			ops = append(ops, lineOp{'-', l})
+		}
+		for _, l := range b {
+			ops = append(ops, lineOp{'+', l})
+		}
+		return ops
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:].
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []lineOp
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[i] == b[j]:
+			ops = append(ops, lineOp{' ', a[i]})
+			i++
+			j++
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, lineOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, lineOp{'+', b[j]})
+			j++
+		}
+	}
+	return ops
+}
+
+// unifiedHunks diffs a against b and renders the differences as unified diff
+// hunks with patchContext lines of context. aStart and bStart are the file
+// line numbers of a[0] and b[0]; section is shown after each "@@" header. It
+// returns "" when a and b are equal.
+func unifiedHunks(a, b []string, aStart, bStart int, section string) string {
+	ops := diffLineOps(a, b)
+
+	var out strings.Builder
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Hunk from patchContext lines before this change up to the first
+		// run of more than 2*patchContext unchanged lines after it.
+		start := i - patchContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*patchContext {
+				end += min(patchContext, run-end)
+				break
+			}
+			end = run
+		}
+
+		// Line numbers of the hunk's first line on each side.
+		aLine, bLine := aStart, bStart
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				aLine++
+			}
+			if op.kind != '-' {
+				bLine++
+			}
+		}
+		var aCount, bCount int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		// diff -u numbers an empty side by the line before it.
+		if aCount == 0 {
+			aLine--
+		}
+		if bCount == 0 {
+			bLine--
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@ %s\n", aLine, aCount, bLine, bCount, section)
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.text)
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// htmlStyle is the stylesheet of --format=html. Every selector is scoped to
+// the .funcdiff root and every class carries the fd- prefix, so a fragment
+// can sit inside a page with its own stylesheet. Colors come from the
+// --theme class on the root. The view toggle is pure CSS: the radio buttons
+// precede .fd-main, which hides the unselected view.
+const htmlStyle = `.funcdiff { font: 14px/1.4 -apple-system, "Segoe UI", sans-serif; color: var(--fd-fg); background: var(--fd-bg); }
+.fd-theme-light { --fd-fg: #1f2328; --fd-bg: #ffffff; --fd-muted: #6e7781; --fd-border: #d0d7de; --fd-from: #e6ffec; --fd-from-num: #ccffd8; --fd-to: #ffebe9; --fd-to-num: #ffd7d5; --fd-empty: #f6f8fa; }
+.fd-theme-dark { --fd-fg: #e6edf3; --fd-bg: #0d1117; --fd-muted: #7d8590; --fd-border: #30363d; --fd-from: #12261e; --fd-from-num: #1b4721; --fd-to: #25171c; --fd-to-num: #542426; --fd-empty: #161b22; }
+.funcdiff code, .funcdiff td.fd-code { font-family: ui-monospace, SFMono-Regular, Menlo, monospace; font-size: 12px; }
+.funcdiff h1 { font-size: 20px; } .funcdiff h2 { font-size: 16px; margin-top: 2em; }
+.funcdiff .fd-toggle { margin: 1em 0; }
+.funcdiff #fd-view-split:checked ~ .fd-main .fd-unified, .funcdiff #fd-view-unified:checked ~ .fd-main .fd-split { display: none; }
+.funcdiff table.fd-diff { border-collapse: collapse; width: 100%; table-layout: fixed; border: 1px solid var(--fd-border); }
+.funcdiff table.fd-diff td { padding: 0 6px; vertical-align: top; white-space: pre-wrap; word-break: break-all; }
+.funcdiff td.fd-num { width: 4em; text-align: right; color: var(--fd-muted); user-select: none; }
+.funcdiff table.fd-diff td.fd-code { width: 50%; }
+.funcdiff table.fd-unified td.fd-code { width: auto; }
+.funcdiff .fd-from { background: var(--fd-from); } .funcdiff .fd-from.fd-num { background: var(--fd-from-num); }
+.funcdiff .fd-to { background: var(--fd-to); } .funcdiff .fd-to.fd-num { background: var(--fd-to-num); }
+.funcdiff .fd-empty { background: var(--fd-empty); }
+.funcdiff .fd-note { color: var(--fd-muted); font-style: italic; }`
+
+// htmlPageStyle is added to htmlStyle for a full page, where the report
+// fills the window.
+const htmlPageStyle = `body { margin: 0; }
+.funcdiff { padding: 2em; min-height: 100vh; box-sizing: border-box; }`
+
+// buildHTMLReport renders diff as a standalone HTML page: the summary, the
+// new and removed functions, and every changed function as a split
+// (side-by-side) or unified line diff, switchable on the page. The split
+// view shows the from side on the left and the to side on the right; lines
+// only in from are green and lines only in to are red, as in the term format.
+// With opts.HTMLFragment only the root <div> (with its <style>) is written,
+// for embedding in an existing page.
+func buildHTMLReport(ctx context.Context, diff DiffResult, opts ReportOptions) string {
+	var b strings.Builder
+	esc := html.EscapeString
+
+	theme := opts.Theme
+	if theme == "" {
+		theme = "light"
+	}
+	if !opts.HTMLFragment {
+		fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+		fmt.Fprintf(&b, "<title>funcdiff: %s → %s</title>\n<style>\n%s\n</style>\n</head>\n<body>\n", esc(opts.FromRef), esc(opts.ToRef), htmlPageStyle)
+	}
+	fmt.Fprintf(&b, "<div class=\"funcdiff fd-theme-%s\">\n<style>\n%s\n</style>\n", theme, htmlStyle)
+	fmt.Fprintf(&b, "<h1>Function Diff: <code>%s</code> → <code>%s</code></h1>\n", esc(opts.FromRef), esc(opts.ToRef))
+	fmt.Fprintf(&b, "<p>%d new, %d removed, %d changed (%d → %d functions)</p>\n",
+		len(diff.NewFuncs), len(diff.RemovedFuncs), len(diff.ChangedFuncs), diff.FromTotal, diff.ToTotal)
+
+	writeList := func(title string, funcs []*FuncInfo) {
+		if len(funcs) == 0 {
+			return
+		}
+		sorted, omitted := capFuncs(funcs, opts)
+		sort.Slice(sorted, func(i, j int) bool { return funcSortKey(sorted[i]) < funcSortKey(sorted[j]) })
+		fmt.Fprintf(&b, "<h2>%s</h2>\n<ul>\n", esc(title))
+		for _, f := range sorted {
+			fmt.Fprintf(&b, "<li><code>%s.%s%s</code> (<code>%s</code>)</li>\n",
+				esc(f.Package), esc(qualifiedName(f)), esc(f.Signature), esc(f.File))
+		}
+		if omitted > 0 {
+			fmt.Fprintf(&b, "<li>… and %d more</li>\n", omitted)
+		}
+		fmt.Fprintf(&b, "</ul>\n")
+	}
+	writeList(fmt.Sprintf("New in %s", opts.FromRef), diff.NewFuncs)
+	writeList(fmt.Sprintf("Removed (only in %s)", opts.ToRef), diff.RemovedFuncs)
+
+	fmt.Fprintf(&b, "<div class=\"fd-toggle\">View:</div>\n")
+	fmt.Fprintf(&b, "<input type=\"radio\" name=\"fd-view\" id=\"fd-view-split\" checked> <label for=\"fd-view-split\">split</label>\n")
+	fmt.Fprintf(&b, "<input type=\"radio\" name=\"fd-view\" id=\"fd-view-unified\"> <label for=\"fd-view-unified\">unified</label>\n")
+	fmt.Fprintf(&b, "<div class=\"fd-main\">\n")
+
+	// ChangedFuncs is already in --sort order.
+	changed, omitted := capPairs(diff.ChangedFuncs, opts.MaxFunctions)
+	for _, pair := range changed {
+		fromInfo, toInfo := pair[0], pair[1]
+		fmt.Fprintf(&b, "<h2><code>%s.%s</code></h2>\n", esc(fromInfo.Package), esc(qualifiedName(fromInfo)))
+		fmt.Fprintf(&b, "<p><code>%s</code> lines %d–%d → <code>%s</code> lines %d–%d</p>\n",
+			esc(fromInfo.File), fromInfo.StartLine, fromInfo.EndLine, esc(toInfo.File), toInfo.StartLine, toInfo.EndLine)
+
+		fromBody, fromErr := loadFuncBody(ctx, opts.FromSource, fromInfo)
+		toBody, toErr := loadFuncBody(ctx, opts.ToSource, toInfo)
+		if fromErr != nil || toErr != nil {
+			note := bodyUnavailableNote(opts.FromRef, fromInfo, fromErr)
+			if fromErr == nil {
+				note = bodyUnavailableNote(opts.ToRef, toInfo, toErr)
+			}
+			// The note is Markdown; drop its emphasis and code markers.
+			fmt.Fprintf(&b, "<p class=\"fd-note\">%s</p>\n", esc(strings.ReplaceAll(strings.Trim(note, "_"), "`", "")))
+			continue
+		}
+		if fromBody == toBody {
+			fmt.Fprintf(&b, "<p class=\"fd-note\">body unchanged, likely only shifted or moved</p>\n")
+			continue
+		}
+		ops := diffLineOps(strings.Split(fromBody, "\n"), strings.Split(toBody, "\n"))
+		writeSplitDiff(&b, ops, fromInfo.StartLine, toInfo.StartLine, opts)
+		writeUnifiedDiff(&b, ops, fromInfo.StartLine, toInfo.StartLine, opts)
+	}
+	if omitted > 0 {
+		fmt.Fprintf(&b, "<p class=\"fd-note\">… and %d more changed functions</p>\n", omitted)
+	}
+	fmt.Fprintf(&b, "</div>\n</div>")
+	if !opts.HTMLFragment {
+		fmt.Fprintf(&b, "\n</body>\n</html>")
+	}
+	return b.String()
+}
+
+// writeSplitDiff renders ops (a = from, b = to) as a two-column table.
+// Within a run of changes, removed and added lines are paired row by row,
+// and the shorter side is padded with empty cells.
+func writeSplitDiff(b *strings.Builder, ops []lineOp, fromLine, toLine int, opts ReportOptions) {
+	esc := html.EscapeString
+	fmt.Fprintf(b, "<table class=\"fd-diff fd-split\">\n")
+	fmt.Fprintf(b, "<tr><th></th><th>%s</th><th></th><th>%s</th></tr>\n", esc(opts.FromRef), esc(opts.ToRef))
+	cell := func(class string, line int, text string) string {
+		if line == 0 {
+			return "<td class=\"fd-num fd-empty\"></td><td class=\"fd-code fd-empty\"></td>"
+		}
+		return fmt.Sprintf("<td class=\"fd-num %s\">%d</td><td class=\"fd-code %s\">%s</td>", class, line, class, esc(text))
+	}
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			fmt.Fprintf(b, "<tr>%s%s</tr>\n", cell("", fromLine, ops[i].text), cell("", toLine, ops[i].text))
+			fromLine++
+			toLine++
+			i++
+			continue
+		}
+		var left, right []string
+		for ; i < len(ops) && ops[i].kind != ' '; i++ {
+			if ops[i].kind == '-' {
+				left = append(left, ops[i].text)
+			} else {
+				right = append(right, ops[i].text)
+			}
+		}
+		for r := 0; r < max(len(left), len(right)); r++ {
+			l, rt := cell("", 0, ""), cell("", 0, "")
+			if r < len(left) {
+				l = cell("fd-from", fromLine, left[r])
+				fromLine++
+			}
+			if r < len(right) {
+				rt = cell("fd-to", toLine, right[r])
+				toLine++
+			}
+			fmt.Fprintf(b, "<tr>%s%s</tr>\n", l, rt)
+		}
+	}
+	fmt.Fprintf(b, "</table>\n")
+}
+
+// writeUnifiedDiff renders ops (a = from, b = to) as a single column with
+// both line numbers, like a unified diff of the whole function.
+func writeUnifiedDiff(b *strings.Builder, ops []lineOp, fromLine, toLine int, opts ReportOptions) {
+	esc := html.EscapeString
+	fmt.Fprintf(b, "<table class=\"fd-diff fd-unified\">\n")
+	fmt.Fprintf(b, "<tr><th>%s</th><th>%s</th><th></th></tr>\n", esc(opts.FromRef), esc(opts.ToRef))
+	for _, op := range ops {
+		class, from, to := "", "", ""
+		switch op.kind {
+		case '-':
+			class, from = "fd-from", strconv.Itoa(fromLine)
+			fromLine++
+		case '+':
+			class, to = "fd-to", strconv.Itoa(toLine)
+			toLine++
+		default:
+			from, to = strconv.Itoa(fromLine), strconv.Itoa(toLine)
+			fromLine++
+			toLine++
+		}
+		fmt.Fprintf(b, "<tr><td class=\"fd-num %s\">%s</td><td class=\"fd-num %s\">%s</td><td class=\"fd-code %s\">%s</td></tr>\n",
+			class, from, class, to, class, esc(op.text))
+	}
+	fmt.Fprintf(b, "</table>\n")
+}
+
+// jsonlSide is one side of a function in --format=jsonl.
+type jsonlSide struct {
+	File      string `json:"file"`
+	Signature string `json:"signature"`
+	StartLine int    `json:"startLine"`
+	EndLine   int    `json:"endLine"`
+	Build     string `json:"build,omitempty"`
+	BodyHash  string `json:"bodyHash,omitempty"`
+}
+
+// jsonlRecord is one line of --format=jsonl. From is absent for removed
+// functions and To for new ones; a renamed receiver keeps its old one in To.
+type jsonlRecord struct {
+	Category string     `json:"category"` // new, removed, changed, receiver_renamed, receiver_pointer_changed, moved_package or method_converted
+	Package  string     `json:"package"`
+	Receiver string     `json:"receiver,omitempty"`
+	Name     string     `json:"name"`
+	Reasons  []string   `json:"reasons,omitempty"`
+	Impact   *float64   `json:"impact,omitempty"` // changed only
+	From     *jsonlSide `json:"from,omitempty"`
+	To       *jsonlSide `json:"to,omitempty"`
+}
+
+func newJSONLSide(f *FuncInfo) *jsonlSide {
+	return &jsonlSide{
+		File:      f.File,
+		Signature: f.Signature,
+		StartLine: f.StartLine,
+		EndLine:   f.EndLine,
+		Build:     f.Build,
+		BodyHash:  f.BodyHash,
+	}
+}
+
+// writeJSONLReport writes diff to w as one JSON object per function change,
+// in the order of forEachFuncChange. Records are encoded one at a time, but
+// diff itself is already complete, so memory use is not bounded by this.
+func writeJSONLReport(w io.Writer, diff DiffResult, opts ReportOptions) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return forEachFuncChange(diff, opts, func(category string, from, to *FuncInfo) error {
+		id := from
+		if id == nil {
+			id = to
+		}
+		rec := jsonlRecord{Category: category, Package: id.Package, Receiver: id.Receiver, Name: id.Name}
+		if from != nil {
+			rec.From = newJSONLSide(from)
+		}
+		if to != nil {
+			rec.To = newJSONLSide(to)
+		}
+		if category == "changed" {
+			rec.Reasons = changeReasons(from, to, opts.Diff)
+			impact := roundImpact(impactScore(from, to, opts.ImpactWeights))
+			rec.Impact = &impact
+		}
+		return enc.Encode(rec)
+	})
+}
+
+// forEachFuncChange calls emit for every function change in diff, by
+// category: new, then removed, then changed, then receiver renames, pointer
+// changes, package moves and function/method conversions, each sorted by
+// package, file, receiver and name (changed functions keep the --sort=impact
+// order). from is nil for removed functions and to for new ones.
+func forEachFuncChange(diff DiffResult, opts ReportOptions, emit func(category string, from, to *FuncInfo) error) error {
+	byKey := func(funcs []*FuncInfo) []*FuncInfo {
+		sorted := append([]*FuncInfo(nil), funcs...)
+		sort.Slice(sorted, func(i, j int) bool { return funcSortKey(sorted[i]) < funcSortKey(sorted[j]) })
+		return sorted
+	}
+	pairsByKey := func(pairs [][2]*FuncInfo) [][2]*FuncInfo {
+		sorted := append([][2]*FuncInfo(nil), pairs...)
+		sort.Slice(sorted, func(i, j int) bool { return funcSortKey(sorted[i][0]) < funcSortKey(sorted[j][0]) })
+		return sorted
+	}
+
+	for _, f := range byKey(diff.NewFuncs) {
+		if err := emit("new", f, nil); err != nil {
+			return err
+		}
+	}
+	for _, f := range byKey(diff.RemovedFuncs) {
+		if err := emit("removed", nil, f); err != nil {
+			return err
+		}
+	}
+	changed := diff.ChangedFuncs
+	if opts.Sort != "impact" {
+		changed = pairsByKey(changed)
+	}
+	for _, pair := range changed {
+		if err := emit("changed", pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	for _, pair := range pairsByKey(diff.ReceiverRenames) {
+		if err := emit("receiver_renamed", pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	for _, pair := range pairsByKey(diff.ReceiverPointerChanges) {
+		if err := emit("receiver_pointer_changed", pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	for _, pair := range pairsByKey(diff.PackageMoves) {
+		if err := emit("moved_package", pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	for _, pair := range pairsByKey(diff.MethodConversions) {
+		if err := emit("method_converted", pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvFunctionHeader names the columns of --csv-kind=functions. The from_
+// and to_ columns are empty for new and removed functions respectively;
+// reasons is semicolon-separated.
+var csvFunctionHeader = []string{
+	"category", "package", "receiver", "name",
+	"from_file", "from_start_line", "from_end_line", "from_loc",
+	"to_file", "to_start_line", "to_end_line", "to_loc",
+	"impact", "reasons",
+}
+
+// writeFunctionsCSV writes one row per function change, with the categories
+// and order of --format=jsonl.
+func writeFunctionsCSV(w io.Writer, diff DiffResult, opts ReportOptions) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvFunctionHeader); err != nil {
+		return err
+	}
+	side := func(f *FuncInfo) []string {
+		if f == nil {
+			return []string{"", "", "", ""}
+		}
+		return []string{f.File, strconv.Itoa(f.StartLine), strconv.Itoa(f.EndLine), strconv.Itoa(f.LineCount)}
+	}
+	err := forEachFuncChange(diff, opts, func(category string, from, to *FuncInfo) error {
+		id := from
+		if id == nil {
+			id = to
+		}
+		row := []string{category, id.Package, id.Receiver, id.Name}
+		row = append(row, side(from)...)
+		row = append(row, side(to)...)
+		var impact, reasons string
+		if category == "changed" {
+			impact = strconv.FormatFloat(roundImpact(impactScore(from, to, opts.ImpactWeights)), 'f', -1, 64)
+			reasons = strings.Join(changeReasons(from, to, opts.Diff), ";")
+		}
+		return cw.Write(append(row, impact, reasons))
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// tsvHeader names the columns of --format=tsv.
+var tsvHeader = []string{"category", "package", "file", "receiver", "name", "from_loc", "to_loc"}
+
+// tsvField makes s safe as one --format=tsv field: tabs and line breaks
+// become spaces.
+var tsvField = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace
+
+// writeTSVReport writes one tab-separated line per function change, with the
+// categories and order of --format=jsonl. file is the from side's, or the
+// to side's for removed functions; a LOC column is empty where its side
+// doesn't exist.
+func writeTSVReport(w io.Writer, diff DiffResult, opts ReportOptions) error {
+	bw := bufio.NewWriter(w)
+	if opts.TSVHeader {
+		fmt.Fprintln(bw, strings.Join(tsvHeader, "\t"))
+	}
+	loc := func(f *FuncInfo) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.Itoa(f.LineCount)
+	}
+	err := forEachFuncChange(diff, opts, func(category string, from, to *FuncInfo) error {
+		id := from
+		if id == nil {
+			id = to
+		}
+		fields := []string{category, id.Package, id.File, id.Receiver, id.Name, loc(from), loc(to)}
+		for i := range fields {
+			fields[i] = tsvField(fields[i])
+		}
+		_, err := fmt.Fprintln(bw, strings.Join(fields, "\t"))
+		return err
+	})
+	if err != nil {
+		return err
 	}
-
-	return funcs, nil
+	return bw.Flush()
 }
 
-func formatReceiver(fl *ast.FieldList) string {
-	if fl == nil || len(fl.List) == 0 {
-		return ""
+// writePackagesCSV writes one row per package of diff.PkgStats, sorted by
+// package: package, new, removed, changed, net_loc.
+func writePackagesCSV(w io.Writer, diff DiffResult) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"package", "new", "removed", "changed", "net_loc"}); err != nil {
+		return err
 	}
-	// methods have at most one receiver field.
-	field := fl.List[0]
-	var buf bytes.Buffer
-	switch t := field.Type.(type) {
-	case *ast.Ident:
-		buf.WriteString(t.Name)
-	case *ast.StarExpr:
-		if id, ok := t.X.(*ast.Ident); ok {
-			buf.WriteString("*" + id.Name)
+	pkgs := make([]string, 0, len(diff.PkgStats))
+	for pkg := range diff.PkgStats {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		s := diff.PkgStats[pkg]
+		row := []string{pkg, strconv.Itoa(s.New), strconv.Itoa(s.Removed), strconv.Itoa(s.Changed), strconv.Itoa(s.NetLOC())}
+		if err := cw.Write(row); err != nil {
+			return err
 		}
-	default:
-		// fallback to source slice (less pretty but OK)
-		buf.WriteString(exprToString(field.Type))
 	}
-	return buf.String()
+	cw.Flush()
+	return cw.Error()
 }
 
-func formatSignature(ft *ast.FuncType) string {
-	params := fieldListToString(ft.Params)
-	results := fieldListToString(ft.Results)
-
-	if results == "" {
-		return fmt.Sprintf("(%s)", params)
+// writeCSVFiles writes functions.csv and packages.csv into dir
+// (--csv-kind=both).
+func writeCSVFiles(dir string, diff DiffResult, opts ReportOptions) error {
+	root, err := resolveOutDir(dir)
+	if err != nil {
+		return fmt.Errorf("--out-dir %s: %w", dir, err)
+	}
+	err = streamReport(filepath.Join(root, "functions.csv"), func(w io.Writer) error {
+		return writeFunctionsCSV(w, diff, opts)
+	})
+	if err != nil {
+		return err
 	}
-	return fmt.Sprintf("(%s) (%s)", params, results)
+	return streamReport(filepath.Join(root, "packages.csv"), func(w io.Writer) error {
+		return writePackagesCSV(w, diff)
+	})
 }
 
-func fieldListToString(fl *ast.FieldList) string {
-	if fl == nil || len(fl.List) == 0 {
-		return ""
-	}
-	var parts []string
-	for _, f := range fl.List {
-		typeStr := exprToString(f.Type)
-		if len(f.Names) == 0 {
-			parts = append(parts, typeStr)
-		} else {
-			for _, name := range f.Names {
-				parts = append(parts, fmt.Sprintf("%s %s", name.Name, typeStr))
-			}
+// streamReport runs write against path (created with its parent
+// directories) or, when path is "", buffered stdout.
+func streamReport(path string, write func(io.Writer) error) error {
+	if path == "" {
+		bw := bufio.NewWriter(os.Stdout)
+		if err := write(bw); err != nil {
+			return err
 		}
+		return bw.Flush()
 	}
-	return strings.Join(parts, ", ")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create directory for --out: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("write --out: %w", err)
+	}
+	bw := bufio.NewWriter(f)
+	if err := write(bw); err != nil {
+		f.Close()
+		return fmt.Errorf("write --out: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("write --out: %w", err)
+	}
+	return f.Close()
 }
 
-// exprToString is a simple printer for AST expressions.
-func exprToString(e ast.Expr) string {
-	switch x := e.(type) {
-	case *ast.Ident:
-		return x.Name
+// buildTermReport renders a compact, column-aligned summary of diff for
+// interactive use: green for new, red for removed, yellow for changed.
+func buildTermReport(diff DiffResult, opts ReportOptions, color bool) string {
+	var b strings.Builder
 
-	case *ast.StarExpr:
-		return "*" + exprToString(x.X)
+	fmt.Fprintf(&b, "%s %s → %s (%d → %d functions)\n",
+		colorize("funcdiff", ansiBold, color), opts.FromRef, opts.ToRef, diff.FromTotal, diff.ToTotal)
+	fmt.Fprintf(&b, "  %s  %s  %s\n\n",
+		colorize(fmt.Sprintf("+%d new", len(diff.NewFuncs)), ansiGreen, color),
+		colorize(fmt.Sprintf("-%d removed", len(diff.RemovedFuncs)), ansiRed, color),
+		colorize(fmt.Sprintf("~%d changed", len(diff.ChangedFuncs)), ansiYellow, color))
 
-	case *ast.SelectorExpr:
-		return exprToString(x.X) + "." + exprToString(x.Sel)
+	if n := len(diff.ParseFailures); n > 0 {
+		fmt.Fprintf(&b, "  %s\n\n", colorize(fmt.Sprintf("! %d files failed to parse; the diff may be incomplete", n), ansiRed, color))
+	}
 
-	case *ast.ArrayType:
-		return "[]" + exprToString(x.Elt)
+	level, _ := semverImpact(diff)
+	fmt.Fprintf(&b, "  suggested version impact: %s\n\n", colorize(level, ansiBold, color))
 
-	case *ast.MapType:
-		return "map[" + exprToString(x.Key) + "]" + exprToString(x.Value)
+	if changes := methodSetChanges(diff, opts.RequiredInterfaces); len(changes) > 0 {
+		types := make([]string, len(changes))
+		for i, c := range changes {
+			types[i] = c.Package + "." + c.Type
+		}
+		fmt.Fprintf(&b, "  %s %s\n\n",
+			colorize("! exported methods changed or removed on:", ansiRed, color), strings.Join(types, ", "))
+	}
 
-	case *ast.FuncType:
-		// Print as: func(params) (results)
-		return "func" + formatSignature(x)
+	structs, ifaces := splitTypeChanges(diff.ChangedTypes)
+	for _, group := range []struct {
+		label   string
+		changes []typeChange
+	}{{"struct", structs}, {"interface", ifaces}} {
+		if len(group.changes) == 0 {
+			continue
+		}
+		names := make([]string, len(group.changes))
+		for i, c := range group.changes {
+			names[i] = c.From.Package + "." + c.From.Name
+		}
+		fmt.Fprintf(&b, "  %s %s\n\n",
+			colorize(fmt.Sprintf("~%d %s types changed:", len(names), group.label), ansiYellow, color), strings.Join(names, ", "))
+	}
 
-	case *ast.InterfaceType:
-		// For now, just "interface{}"
-		return "interface{}"
+	if len(diff.PkgStats) == 0 {
+		fmt.Fprintf(&b, "  no differences\n")
+		return b.String()
+	}
 
-	case *ast.ChanType:
-		// Very simple: "chan <T>"
-		return "chan " + exprToString(x.Value)
+	pkgs := make([]string, 0, len(diff.PkgStats))
+	width := len("PACKAGE")
+	for pkg := range diff.PkgStats {
+		pkgs = append(pkgs, pkg)
+		if len(pkg) > width {
+			width = len(pkg)
+		}
+	}
+	sort.Strings(pkgs)
 
-	default:
-		// Fallback: we don't know how to pretty-print this AST node;
-		// return a generic placeholder so code still compiles and runs.
-		return "<?>"
+	// Pad before colorizing so escape codes don't break the alignment.
+	cell := func(n int, sign, code string) string {
+		if n == 0 {
+			return fmt.Sprintf("%8s", "")
+		}
+		return colorize(fmt.Sprintf("%8s", fmt.Sprintf("%s%d", sign, n)), code, color)
 	}
-}
 
-type DiffResult struct {
-	NewFuncs     []*FuncInfo
-	RemovedFuncs []*FuncInfo
-	ChangedFuncs [][2]*FuncInfo // [from, to]
-	FromTotal    int
-	ToTotal      int
-	PkgStats     map[string]*PackageStats
+	fmt.Fprintf(&b, "  %-*s %8s %8s %8s %8s\n", width, "PACKAGE", "NEW", "REMOVED", "CHANGED", "NET LOC")
+	for _, pkg := range pkgs {
+		stats := diff.PkgStats[pkg]
+		fmt.Fprintf(&b, "  %-*s %s %s %s %8s\n", width, pkg,
+			cell(stats.New, "+", ansiGreen),
+			cell(stats.Removed, "-", ansiRed),
+			cell(stats.Changed, "~", ansiYellow),
+			formatNetLOC(stats.NetLOC()))
+	}
+
+	return b.String()
 }
 
-func diffFuncs(from, to FuncSet) DiffResult {
-	result := DiffResult{
-		PkgStats: make(map[string]*PackageStats),
+// slackEscape escapes the characters Slack's mrkdwn treats as markup for
+// links and mentions.
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// buildSlackReport renders a compact Slack mrkdwn message: the summary
+// counts, then up to opts.SlackTop changed and removed functions each. Lists
+// are cut short with a "+N more" line so that the message stays within
+// opts.SlackMaxChars characters.
+func buildSlackReport(diff DiffResult, opts ReportOptions) string {
+	var lines []string
+	lines = append(lines,
+		fmt.Sprintf("*funcdiff* `%s` → `%s` (%d → %d functions)",
+			slackEscape.Replace(opts.FromRef), slackEscape.Replace(opts.ToRef), diff.FromTotal, diff.ToTotal),
+		fmt.Sprintf("*+%d* new, *-%d* removed, *~%d* changed",
+			len(diff.NewFuncs), len(diff.RemovedFuncs), len(diff.ChangedFuncs)))
+	if level, reason := semverImpact(diff); reason != "" {
+		lines = append(lines, fmt.Sprintf("Suggested version impact: *%s* (%s)", level, reason))
+	} else {
+		lines = append(lines, fmt.Sprintf("Suggested version impact: *%s*", level))
+	}
+	if n := len(diff.ParseFailures); n > 0 {
+		lines = append(lines, fmt.Sprintf(":warning: %d files failed to parse; the diff may be incomplete", n))
 	}
 
-	result.FromTotal = len(from)
-	result.ToTotal = len(to)
-
-	// Helper to get or create stats for a package.
-	getStats := func(pkg string) *PackageStats {
-		if s, ok := result.PkgStats[pkg]; ok {
-			return s
-		}
-		s := &PackageStats{}
-		result.PkgStats[pkg] = s
-		return s
+	removed := append([]*FuncInfo(nil), diff.RemovedFuncs...)
+	sort.Slice(removed, func(i, j int) bool { return funcSortKey(removed[i]) < funcSortKey(removed[j]) })
+	var changed, gone []string
+	for _, pair := range diff.ChangedFuncs {
+		changed = append(changed, pair[0].Package+"."+qualifiedName(pair[0]))
+	}
+	for _, f := range removed {
+		gone = append(gone, f.Package+"."+qualifiedName(f))
 	}
 
-	// Identify new and changed
-	for key, fromInfo := range from {
-		toInfo, exists := to[key]
-		if !exists {
-			result.NewFuncs = append(result.NewFuncs, fromInfo)
-			getStats(fromInfo.Package).New++
+	// Room kept free for a "+N more" line whenever something is added.
+	const moreRoom = len("\n• +99999 more")
+	size := utf8.RuneCountInString(strings.Join(lines, "\n"))
+	fits := func(line string) bool {
+		return size+1+utf8.RuneCountInString(line)+moreRoom <= opts.SlackMaxChars
+	}
+	add := func(line string) {
+		lines = append(lines, line)
+		size += 1 + utf8.RuneCountInString(line)
+	}
+	for _, section := range []struct {
+		title string
+		names []string
+	}{{"Changed", changed}, {"Removed", gone}} {
+		if len(section.names) == 0 {
 			continue
 		}
-
-		// Check if signature or file/lines differ:
-		if fromInfo.Signature != toInfo.Signature ||
-			fromInfo.File != toInfo.File ||
-			fromInfo.StartLine != toInfo.StartLine ||
-			fromInfo.EndLine != toInfo.EndLine {
-			result.ChangedFuncs = append(result.ChangedFuncs, [2]*FuncInfo{fromInfo, toInfo})
-			getStats(fromInfo.Package).Changed++
+		title := fmt.Sprintf("*%s*", section.title)
+		if !fits(title) {
+			break
 		}
-	}
-
-	// Identify removed
-	for key, toInfo := range to {
-		if _, exists := from[key]; !exists {
-			result.RemovedFuncs = append(result.RemovedFuncs, toInfo)
-			getStats(toInfo.Package).Removed++
+		add(title)
+		shown := 0
+		for _, name := range section.names {
+			item := "• `" + slackEscape.Replace(name) + "`"
+			if shown == opts.SlackTop || !fits(item) {
+				break
+			}
+			add(item)
+			shown++
+		}
+		if rest := len(section.names) - shown; rest > 0 {
+			add(fmt.Sprintf("• +%d more", rest))
 		}
 	}
 
-	return result
+	msg := strings.Join(lines, "\n")
+	// Only a limit too small for the summary itself can still overflow.
+	if r := []rune(msg); len(r) > opts.SlackMaxChars {
+		msg = string(r[:max(opts.SlackMaxChars-1, 0)]) + "…"
+	}
+	return msg
 }
 
-func buildMarkdownReport(fromRef, toRef string, fromFuncs, toFuncs FuncSet, summaryOnly bool, outDir string) string {
-	diff := diffFuncs(fromFuncs, toFuncs)
-
-	var b strings.Builder
-
-	// Header
-	fmt.Fprintf(&b, "### Function Diff: `%s` → `%s`\n\n", fromRef, toRef)
-
-	// Summary
-	fmt.Fprintf(&b, "#### Summary\n")
-	fmt.Fprintf(&b, "- Total functions in `%s`: %d\n", fromRef, diff.FromTotal)
-	fmt.Fprintf(&b, "- Total functions in `%s`: %d\n", toRef, diff.ToTotal)
-	fmt.Fprintf(&b, "\n")
-	fmt.Fprintf(&b, "- New functions in `%s` only: %d\n", fromRef, len(diff.NewFuncs))
-	fmt.Fprintf(&b, "- Removed functions (only in `%s`): %d\n", toRef, len(diff.RemovedFuncs))
-	fmt.Fprintf(&b, "- Changed functions: %d\n\n", len(diff.ChangedFuncs))
-
-	// High-level changes by package
-	fmt.Fprintf(&b, "#### High-Level Changes by Package\n\n")
-	fmt.Fprintf(&b, "| Package | New | Removed | Changed |\n")
-	fmt.Fprintf(&b, "|---------|-----|---------|---------|\n")
-
-	pkgs := make([]string, 0, len(diff.PkgStats))
-	for pkg := range diff.PkgStats {
-		pkgs = append(pkgs, pkg)
+// statsByFile is the per-file counterpart of DiffResult.PkgStats. Changed
+// functions are counted under their file in the from ref.
+func statsByFile(diff DiffResult) map[string]*PackageStats {
+	stats := make(map[string]*PackageStats)
+	get := func(file string) *PackageStats {
+		if s, ok := stats[file]; ok {
+			return s
+		}
+		s := &PackageStats{}
+		stats[file] = s
+		return s
 	}
-	sort.Strings(pkgs)
-
-	for _, pkg := range pkgs {
-		stats := diff.PkgStats[pkg]
-		fmt.Fprintf(&b, "| `%s` | %d | %d | %d |\n", pkg, stats.New, stats.Removed, stats.Changed)
+	for _, f := range diff.NewFuncs {
+		get(f.File).addNew(f)
 	}
-	fmt.Fprintf(&b, "\n")
+	for _, f := range diff.RemovedFuncs {
+		get(f.File).addRemoved(f)
+	}
+	for _, pair := range diff.ChangedFuncs {
+		get(pair[0].File).addChanged(pair[0], pair[1])
+	}
+	return stats
+}
 
-	if summaryOnly {
-		if outDir != "" {
-			files := writeAllChangedFuncFiles(outDir, fromRef, toRef, diff.ChangedFuncs)
-			addChangedFilesIndex(&b, outDir, files)
-		}
-		return b.String()
+// printFuncList renders funcs grouped according to --group-by.
+func printFuncList(b *strings.Builder, funcs []*FuncInfo, groupBy string, links *sourceLinks) {
+	if groupBy == "file" {
+		printFuncListByFile(b, funcs, links)
+		return
 	}
+	printFuncListByPackage(b, funcs, links)
+}
 
-	// New functions section
-	fmt.Fprintf(&b, "#### New Functions in `%s` (not in `%s`)\n\n", fromRef, toRef)
-	if len(diff.NewFuncs) == 0 {
-		fmt.Fprintf(&b, "_None_\n\n")
-	} else {
-		printFuncListByPackage(&b, diff.NewFuncs)
+// printFuncListByFile groups funcs by file (alphabetically) and lists each
+// file's functions in source order.
+func printFuncListByFile(b *strings.Builder, funcs []*FuncInfo, links *sourceLinks) {
+	fileMap := make(map[string][]*FuncInfo)
+	for _, f := range funcs {
+		fileMap[f.File] = append(fileMap[f.File], f)
 	}
 
-	// Removed functions section
-	fmt.Fprintf(&b, "#### Removed Functions (only in `%s`)\n\n", toRef)
-	if len(diff.RemovedFuncs) == 0 {
-		fmt.Fprintf(&b, "_None_\n\n")
-	} else {
-		printFuncListByPackage(&b, diff.RemovedFuncs)
+	files := make([]string, 0, len(fileMap))
+	for file := range fileMap {
+		files = append(files, file)
 	}
+	sort.Strings(files)
 
-	// Changed functions – only an index in the main report; details go to files
-	fmt.Fprintf(&b, "#### Changed Functions\n\n")
-	if len(diff.ChangedFuncs) == 0 {
-		fmt.Fprintf(&b, "_None_\n\n")
-	} else {
-		if outDir != "" {
-			files := writeAllChangedFuncFiles(outDir, fromRef, toRef, diff.ChangedFuncs)
-			addChangedFilesIndex(&b, outDir, files)
-		} else {
-			// If no outDir, we can at least list the names
-			for _, pair := range diff.ChangedFuncs {
-				fi := pair[0]
-				name := fi.Name
-				if fi.Receiver != "" {
-					name = fmt.Sprintf("(%s).%s", fi.Receiver, fi.Name)
-				}
-				fmt.Fprintf(&b, "- `%s`: `%s`\n", fi.File, name)
+	for _, file := range files {
+		fmt.Fprintf(b, "- `%s`\n", file)
+		list := fileMap[file]
+
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].StartLine == list[j].StartLine {
+				return list[i].Name < list[j].Name
+			}
+			return list[i].StartLine < list[j].StartLine
+		})
+
+		for _, f := range list {
+			fmt.Fprintf(b, "  - `%s`\n", qualifiedName(f))
+			fmt.Fprintf(b, "    - signature: `%s`\n", f.Signature)
+			if f.Build != "" {
+				fmt.Fprintf(b, "    - build: `%s`\n", f.Build)
+			}
+			fmt.Fprintf(b, "    - package: `%s` (%s, %d LOC)\n",
+				f.Package, links.link(f, fmt.Sprintf("lines %d–%d", f.StartLine, f.EndLine)), f.LineCount)
+			if f.MaxDepth > 0 {
+				fmt.Fprintf(b, "    - max nesting depth: %d\n", f.MaxDepth)
+			}
+			if f.Recursive {
+				fmt.Fprintf(b, "    - recursive\n")
 			}
-			fmt.Fprintf(&b, "\n")
 		}
+		fmt.Fprintf(b, "\n")
 	}
+}
 
-	return b.String()
+// printFuncEntry writes one function of a package listing as a bullet at
+// indent, with its signature, build, file and structure notes nested below.
+func printFuncEntry(b *strings.Builder, f *FuncInfo, indent string, links *sourceLinks) {
+	fmt.Fprintf(b, "%s- `%s`\n", indent, qualifiedName(f))
+	fmt.Fprintf(b, "%s  - signature: `%s`\n", indent, f.Signature)
+	if f.Build != "" {
+		fmt.Fprintf(b, "%s  - build: `%s`\n", indent, f.Build)
+	}
+	fmt.Fprintf(b, "%s  - file: `%s` (%s, %d LOC)\n",
+		indent, f.File, links.link(f, fmt.Sprintf("lines %d–%d", f.StartLine, f.EndLine)), f.LineCount)
+	if f.LineDirective != "" {
+		fmt.Fprintf(b, "%s  - generated from: `%s`\n", indent, f.LineDirective)
+	}
+	if f.MaxDepth > 0 {
+		fmt.Fprintf(b, "%s  - max nesting depth: %d\n", indent, f.MaxDepth)
+	}
+	if f.Recursive {
+		fmt.Fprintf(b, "%s  - recursive\n", indent)
+	}
 }
 
-func printFuncListByPackage(b *strings.Builder, funcs []*FuncInfo) {
+func printFuncListByPackage(b *strings.Builder, funcs []*FuncInfo, links *sourceLinks) {
 	// group by package
 	pkgMap := make(map[string][]*FuncInfo)
 	for _, f := range funcs {
@@ -492,68 +7631,289 @@ func printFuncListByPackage(b *strings.Builder, funcs []*FuncInfo) {
 		fmt.Fprintf(b, "- `%s`\n", pkg)
 		list := pkgMap[pkg]
 
-		// sort by receiver + name
-		sort.Slice(list, func(i, j int) bool {
-			if list[i].Receiver == list[j].Receiver {
-				return list[i].Name < list[j].Name
-			}
-			return list[i].Receiver < list[j].Receiver
-		})
+		// sort by receiver + name
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Receiver == list[j].Receiver {
+				return list[i].Name < list[j].Name
+			}
+			return list[i].Receiver < list[j].Receiver
+		})
+
+		for _, f := range list {
+			printFuncEntry(b, f, "  ", links)
+		}
+		fmt.Fprintf(b, "\n")
+	}
+}
+
+func formatFuncHeader(info *FuncInfo) string {
+	recvPart := ""
+	if info.Receiver != "" {
+		recvPart = fmt.Sprintf("(%s) ", info.Receiver)
+	}
+	// Signature already holds "(params)", "(params) T" or "(params) (results)"
+	return fmt.Sprintf("func %s%s%s", recvPart, info.Name, info.Signature)
+}
+
+// extractLines returns the text of lines [startLine, endLine] (1-based, inclusive).
+func extractLines(src []byte, startLine, endLine int) string {
+	lines := strings.Split(string(src), "\n")
+	if len(lines) == 0 {
+		return ""
+	}
+
+	if startLine < 1 {
+		startLine = 1
+	}
+	if endLine > len(lines) {
+		endLine = len(lines)
+	}
+	if startLine > endLine {
+		return ""
+	}
+
+	// slice is 0-based, startLine/endLine are 1-based
+	return strings.Join(lines[startLine-1:endLine], "\n")
+}
+
+// truncateBody shortens body to at most max bytes, cutting at a line boundary
+// when possible, and appends a marker with the number of lines dropped. A
+// non-positive max means unlimited.
+func truncateBody(body string, max int) string {
+	if max <= 0 || len(body) <= max {
+		return body
+	}
+	cut := strings.LastIndex(body[:max], "\n")
+	if cut <= 0 {
+		cut = len(truncateUTF8(body, max))
+	}
+	rest := strings.TrimPrefix(body[cut:], "\n")
+	more := strings.Count(rest, "\n") + 1
+	return fmt.Sprintf("%s\n… (truncated, %d more lines)", body[:cut], more)
+}
+
+// sanitizeFilenamePart makes s safe to embed in a single file name: path
+// separators (both / and \), characters reserved on Windows, control
+// characters and spaces become "_", backticks are dropped, and ".." runs and
+// leading dots are removed so the result can never name a parent directory or
+// a hidden file. Unicode letters are kept as-is.
+func sanitizeFilenamePart(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '`':
+		case r == '/', r == '\\', r == ' ', unicode.IsControl(r), strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	s = b.String()
+	for strings.Contains(s, "..") {
+		s = strings.ReplaceAll(s, "..", ".")
+	}
+	return strings.TrimLeft(s, ".")
+}
+
+// maxReportNameLen keeps per-function file names well below the 255-byte
+// limit shared by most filesystems.
+const maxReportNameLen = 200
+
+// reportNamer hands out unique per-function file names within one --out-dir.
+// Names are compared case-insensitively, so two functions whose names differ
+// only in case don't overwrite each other on macOS or Windows.
+type reportNamer struct {
+	used map[string]bool // lowercased
+}
+
+func newReportNamer() *reportNamer {
+	return &reportNamer{used: make(map[string]bool)}
+}
+
+// claim returns name, shortened if it is too long and suffixed with a short
+// hash of info's identity if another function already claimed it, ignoring
+// case. Only the last element of a slash-separated name is ever rewritten.
+func (n *reportNamer) claim(name string, info *FuncInfo) string {
+	dir, name := path.Split(name)
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	id := shortHash(funcSortKey(info) + "\x00" + info.Build)
+
+	if len(name) > maxReportNameLen {
+		base = truncateUTF8(base, maxReportNameLen-len(ext)-len(id)-1) + "_" + id
+	}
+
+	taken := func(name string) bool { return n.used[strings.ToLower(name)] }
+	candidate := dir + base + ext
+	if taken(candidate) {
+		candidate = dir + base + "_" + id + ext
+		for i := 2; taken(candidate); i++ {
+			candidate = fmt.Sprintf("%s%s_%s_%d%s", dir, base, id, i, ext)
+		}
+	}
+	n.used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// truncateUTF8 cuts s to at most max bytes without splitting a rune.
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+func shortHash(s string) string {
+	h := sha1.Sum([]byte(s))
+	return fmt.Sprintf("%x", h[:4])
+}
+
+// fuzzArgTypes are the parameter types testing.F accepts as fuzz arguments.
+var fuzzArgTypes = map[string]bool{
+	"string": true, "[]byte": true, "bool": true, "byte": true, "rune": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+	"float32": true, "float64": true,
+}
 
-		for _, f := range list {
-			fullName := f.Name
-			if f.Receiver != "" {
-				fullName = fmt.Sprintf("(%s).%s", f.Receiver, f.Name)
-			}
-			fmt.Fprintf(b, "  - `%s`\n", fullName)
-			fmt.Fprintf(b, "    - signature: `%s`\n", f.Signature)
-			fmt.Fprintf(b, "    - file: `%s` (lines %d–%d, %d LOC)\n",
-				f.File, f.StartLine, f.EndLine, f.LineCount)
+// fuzzable reports whether a fuzz stub can call f directly: an exported,
+// non-generic function (not a method) of a non-test package with at least
+// one parameter, all of fuzzable types.
+func fuzzable(f *FuncInfo) bool {
+	if !f.Exported || f.Receiver != "" || len(f.TypeParams) > 0 || len(f.ParamTypes) == 0 {
+		return false
+	}
+	if strings.HasSuffix(path.Base(f.Package), "_test") {
+		return false
+	}
+	for _, t := range f.ParamTypes {
+		if !fuzzArgTypes[t] {
+			return false
 		}
-		fmt.Fprintf(b, "\n")
 	}
+	return true
 }
 
-func formatFuncHeader(info *FuncInfo) string {
-	recvPart := ""
-	if info.Receiver != "" {
-		recvPart = fmt.Sprintf("(%s) ", info.Receiver)
+// fuzzSeed is the zero value of a fuzz argument type, typed so that f.Add
+// accepts it.
+func fuzzSeed(t string) string {
+	switch t {
+	case "string":
+		return `""`
+	case "[]byte":
+		return "[]byte{}"
+	case "bool":
+		return "false"
 	}
-	// Signature already holds "(params)" or "(params) (results)"
-	return fmt.Sprintf("func %s%s%s", recvPart, info.Name, info.Signature)
+	return t + "(0)"
 }
 
-// extractLines returns the text of lines [startLine, endLine] (1-based, inclusive).
-func extractLines(src []byte, startLine, endLine int) string {
-	lines := strings.Split(string(src), "\n")
-	if len(lines) == 0 {
-		return ""
+// fuzzStubFile is the name of the file --emit-fuzz-stubs writes into each
+// package directory under --out-dir.
+const fuzzStubFile = "funcdiff_fuzz_test.go"
+
+// writeFuzzStubs writes a FuzzXxx stub for every fuzzable changed function
+// (the newer side) into outDir, one funcdiff_fuzz_test.go per package
+// directory, mirroring the repository layout so each file can be copied next
+// to the code it tests. Build variants of one function share a stub.
+// Functions outside the report root (--relative-outside=keep) are skipped.
+// It returns the number of stubs and files written.
+func writeFuzzStubs(outDir string, diff DiffResult, opts ReportOptions) (stubs, files int, err error) {
+	type pkgDir struct{ dir, pkg string }
+	byDir := make(map[pkgDir][]*FuncInfo)
+	seen := make(map[pkgDir]map[string]bool)
+	for _, pair := range diff.ChangedFuncs {
+		f := pair[0]
+		dir := path.Dir(filepath.ToSlash(f.File))
+		if !fuzzable(f) || dir == ".." || strings.HasPrefix(dir, "../") {
+			continue
+		}
+		k := pkgDir{dir, path.Base(f.Package)}
+		if seen[k] == nil {
+			seen[k] = make(map[string]bool)
+		}
+		if seen[k][f.Name] {
+			continue
+		}
+		seen[k][f.Name] = true
+		byDir[k] = append(byDir[k], f)
 	}
-
-	if startLine < 1 {
-		startLine = 1
+	if len(byDir) == 0 {
+		return 0, 0, nil
 	}
-	if endLine > len(lines) {
-		endLine = len(lines)
+
+	root, err := resolveOutDir(outDir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("--out-dir %s: %w", outDir, err)
 	}
-	if startLine > endLine {
-		return ""
+	keys := make([]pkgDir, 0, len(byDir))
+	for k := range byDir {
+		keys = append(keys, k)
 	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].dir < keys[j].dir })
+
+	for _, k := range keys {
+		funcs := byDir[k]
+		sort.Slice(funcs, func(i, j int) bool { return funcs[i].Name < funcs[j].Name })
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "// Fuzz stubs for functions changed between %s and %s, written by\n", opts.ToRef, opts.FromRef)
+		fmt.Fprintf(&b, "// funcdiff --emit-fuzz-stubs. Add seeds and assertions before committing.\n\n")
+		fmt.Fprintf(&b, "package %s\n\nimport \"testing\"\n", k.pkg)
+		for _, f := range funcs {
+			seeds := make([]string, len(f.ParamTypes))
+			params := make([]string, len(f.ParamTypes))
+			args := make([]string, len(f.ParamTypes))
+			for i, t := range f.ParamTypes {
+				seeds[i] = fuzzSeed(t)
+				args[i] = fmt.Sprintf("arg%d", i)
+				params[i] = args[i] + " " + t
+			}
+			fmt.Fprintf(&b, "\nfunc Fuzz%s(f *testing.F) {\n", f.Name)
+			fmt.Fprintf(&b, "\tf.Add(%s)\n", strings.Join(seeds, ", "))
+			fmt.Fprintf(&b, "\tf.Fuzz(func(t *testing.T, %s) {\n", strings.Join(params, ", "))
+			fmt.Fprintf(&b, "\t\t%s(%s)\n", f.Name, strings.Join(args, ", "))
+			fmt.Fprintf(&b, "\t})\n}\n")
+		}
 
-	// slice is 0-based, startLine/endLine are 1-based
-	return strings.Join(lines[startLine-1:endLine], "\n")
+		src, err := format.Source([]byte(b.String()))
+		if err != nil {
+			return stubs, files, fmt.Errorf("format stubs for %s: %w", k.dir, err)
+		}
+		file := filepath.Join(root, filepath.FromSlash(k.dir), fuzzStubFile)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return stubs, files, fmt.Errorf("create %s: %w", filepath.Dir(file), err)
+		}
+		if err := os.WriteFile(file, src, 0o644); err != nil {
+			return stubs, files, fmt.Errorf("write %s: %w", file, err)
+		}
+		stubs += len(funcs)
+		files++
+	}
+	return stubs, files, nil
 }
 
-// sanitizeFilenamePart ensures we don't accidentally create weird filenames.
-// For now we just replace spaces with "_" and remove backticks.
-func sanitizeFilenamePart(s string) string {
-	s = strings.ReplaceAll(s, " ", "_")
-	s = strings.ReplaceAll(s, "`", "")
-	return s
+// resolveOutDir creates dir if needed and returns it with symlinks resolved,
+// so every file lands under one real directory. A dangling symlink is an
+// error rather than something MkdirAll trips over with "file exists".
+func resolveOutDir(dir string) (string, error) {
+	if target, err := os.Readlink(dir); err == nil {
+		if _, err := os.Stat(dir); err != nil {
+			return "", fmt.Errorf("it is a symlink to %s, which does not exist", target)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(dir)
 }
 
 // writeChangedFuncReport writes a separate markdown file describing a single changed function.
 func writeChangedFuncReport(
+	ctx context.Context,
 	fromRef, toRef string,
 	fromInfo, toInfo *FuncInfo,
 ) (string, error) {
@@ -589,7 +7949,7 @@ func writeChangedFuncReport(
 	fmt.Fprintf(&b, "```\n\n")
 	fmt.Fprintf(&b, "- lines: %d–%d (%d LOC)\n\n", fromInfo.StartLine, fromInfo.EndLine, fromInfo.LineCount)
 
-	if src, err := gitShowFile(fromRef, fromInfo.File); err == nil {
+	if src, err := gitShowFile(ctx, "", fromRef, fromInfo.File); err == nil {
 		body := extractLines(src, fromInfo.StartLine, fromInfo.EndLine)
 		if strings.TrimSpace(body) != "" {
 			fmt.Fprintf(&b, "```go\n")
@@ -610,7 +7970,7 @@ func writeChangedFuncReport(
 	fmt.Fprintf(&b, "```\n\n")
 	fmt.Fprintf(&b, "- lines: %d–%d (%d LOC)\n\n", toInfo.StartLine, toInfo.EndLine, toInfo.LineCount)
 
-	if src, err := gitShowFile(toRef, toInfo.File); err == nil {
+	if src, err := gitShowFile(ctx, "", toRef, toInfo.File); err == nil {
 		body := extractLines(src, toInfo.StartLine, toInfo.EndLine)
 		if strings.TrimSpace(body) != "" {
 			fmt.Fprintf(&b, "```go\n")
@@ -632,35 +7992,53 @@ func writeChangedFuncReport(
 }
 
 
-func writeChangedFuncFile(outDir, fromRef, toRef string, fromInfo, toInfo *FuncInfo) (string, error) {
-	if outDir == "" {
-		return "", nil
+// writeChangedFuncFile renders the report for one changed function and
+// writes it into outDir, returning the file name it used.
+func writeChangedFuncFile(ctx context.Context, opts ReportOptions, fromInfo, toInfo *FuncInfo, names *reportNamer) (string, error) {
+	baseName, content := renderChangedFuncFile(ctx, opts, fromInfo, toInfo, names)
+
+	path := filepath.Join(opts.OutDir, filepath.FromSlash(baseName))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", fmt.Errorf("create %s: %w", filepath.Dir(path), err)
 	}
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		return "", fmt.Errorf("create out dir: %w", err)
+	if err := ioutil.WriteFile(path, []byte(content), 0o644); err != nil {
+		return "", fmt.Errorf("write %s: %w", path, err)
 	}
+	return baseName, nil
+}
 
-	// Load full file contents to extract bodies
-	var fromBody, toBody string
-
-	if src, err := gitShowFile(fromRef, fromInfo.File); err == nil {
-		fromBody = extractLines(src, fromInfo.StartLine, fromInfo.EndLine)
+// renderChangedFuncFile builds the per-function report without touching the
+// filesystem. It returns the file name (relative to --out-dir) and content.
+// A nil toInfo is a new function (--head-only): its file, prefixed "new_",
+// shows the from side only.
+func renderChangedFuncFile(ctx context.Context, opts ReportOptions, fromInfo, toInfo *FuncInfo, names *reportNamer) (string, string) {
+	if toInfo == nil {
+		return renderNewFuncFile(ctx, opts, fromInfo, names)
 	}
-	if src, err := gitShowFile(toRef, toInfo.File); err == nil {
-		toBody = extractLines(src, toInfo.StartLine, toInfo.EndLine)
+	fromRef, toRef := opts.FromRef, opts.ToRef
+
+	// Load full file contents to extract bodies. A moved function is read
+	// from its own file on each side (fromInfo.File vs toInfo.File).
+	var fromBody, toBody string
+	var fromErr, toErr error
+	if !opts.NoBody {
+		fromBody, fromErr = loadFuncBody(ctx, opts.FromSource, fromInfo)
+		toBody, toErr = loadFuncBody(ctx, opts.ToSource, toInfo)
 	}
 
-	nf := normalizeBody(fromBody)
-	nt := normalizeBody(toBody)
+	// Detection always looks at the full bodies; only rendering is truncated.
+	nf := normalizeBody(fromBody, opts.Normalize)
+	nt := normalizeBody(toBody, opts.Normalize)
 	isIdenticalBody := nf != "" && nf == nt
-
-	// Build base filename (no prefix yet)
-	baseName := changedFuncFilenameWithRecv(fromInfo)
+	fromBody = truncateBody(fromBody, opts.MaxBodyBytes)
+	toBody = truncateBody(toBody, opts.MaxBodyBytes)
 
 	// If bodies are identical, prefix the filename
+	prefix := ""
 	if isIdenticalBody {
-		baseName = "identical_" + baseName
+		prefix = "identical_"
 	}
+	baseName := funcReportName(opts, fromInfo, prefix, names)
 
 	// Header and content
 	var b strings.Builder
@@ -669,34 +8047,152 @@ func writeChangedFuncFile(outDir, fromRef, toRef string, fromInfo, toInfo *FuncI
 		fullName = fmt.Sprintf("(%s).%s", fromInfo.Receiver, fromInfo.Name)
 	}
 	fmt.Fprintf(&b, "### %s — `%s`\n\n", fullName, fromInfo.File)
+	if opts.Explain {
+		fmt.Fprintf(&b, "_Changed: %s._\n\n", explainChange(fromInfo, toInfo, opts.Diff))
+	}
 
 	// From side
 	fmt.Fprintf(&b, "#### %s\n\n", fromRef)
 	fmt.Fprintf(&b, "```go\n%s\n```\n", formatFuncHeader(fromInfo))
 	fmt.Fprintf(&b, "- file: `%s`\n", fromInfo.File)
-	fmt.Fprintf(&b, "- lines: %d–%d (%d LOC)\n\n", fromInfo.StartLine, fromInfo.EndLine, fromInfo.LineCount)
-	if strings.TrimSpace(fromBody) != "" {
+	fmt.Fprintf(&b, "- lines: %s (%d LOC)\n", opts.Links.link(fromInfo, fmt.Sprintf("%d–%d", fromInfo.StartLine, fromInfo.EndLine)), fromInfo.LineCount)
+	if fromInfo.LineDirective != "" {
+		fmt.Fprintf(&b, "- generated from: `%s`\n", fromInfo.LineDirective)
+	}
+	fmt.Fprintf(&b, "\n")
+	switch {
+	case opts.NoBody:
+		// Signature-only report.
+	case strings.TrimSpace(fromBody) != "":
 		fmt.Fprintf(&b, "```go\n%s\n```\n\n", fromBody)
-	} else {
-		fmt.Fprintf(&b, "_function body unavailable_\n\n")
+	default:
+		fmt.Fprintf(&b, "%s\n\n", bodyUnavailableNote(fromRef, fromInfo, fromErr))
 	}
 
 	// To side
 	fmt.Fprintf(&b, "#### %s\n\n", toRef)
 	fmt.Fprintf(&b, "```go\n%s\n```\n", formatFuncHeader(toInfo))
 	fmt.Fprintf(&b, "- file: `%s`\n", toInfo.File)
-	fmt.Fprintf(&b, "- lines: %d–%d (%d LOC)\n\n", toInfo.StartLine, toInfo.EndLine, toInfo.LineCount)
-	if strings.TrimSpace(toBody) != "" {
+	fmt.Fprintf(&b, "- lines: %s (%d LOC)\n", opts.Links.link(toInfo, fmt.Sprintf("%d–%d", toInfo.StartLine, toInfo.EndLine)), toInfo.LineCount)
+	if toInfo.LineDirective != "" {
+		fmt.Fprintf(&b, "- generated from: `%s`\n", toInfo.LineDirective)
+	}
+	if bl, ok := opts.Blame[toInfo]; ok {
+		fmt.Fprintf(&b, "- last touched by: %s\n", bl.describe(opts.Canonical))
+	}
+	fmt.Fprintf(&b, "\n")
+	switch {
+	case opts.NoBody:
+		// Signature-only report.
+	case strings.TrimSpace(toBody) != "":
 		fmt.Fprintf(&b, "```go\n%s\n```\n\n", toBody)
-	} else {
-		fmt.Fprintf(&b, "_function body unavailable_\n\n")
+	default:
+		fmt.Fprintf(&b, "%s\n\n", bodyUnavailableNote(toRef, toInfo, toErr))
 	}
 
 	// Signature change note
-	if fromInfo.Signature != toInfo.Signature {
+	if signatureChanged(fromInfo, toInfo) {
 		fmt.Fprintf(&b, "#### Signature Change\n\n")
 		fmt.Fprintf(&b, "- %s: `%s`\n", fromRef, fromInfo.Signature)
 		fmt.Fprintf(&b, "- %s: `%s`\n\n", toRef, toInfo.Signature)
+		if fromInfo.ParamTypes != nil || toInfo.ParamTypes != nil || fromInfo.ResultTypes != nil || toInfo.ResultTypes != nil {
+			// Counted from the to side (base) to the from side, so "added"
+			// matches "New Functions".
+			dir := fmt.Sprintf("`%s` → `%s`", toRef, fromRef)
+			lines := typeCountDelta("parameters ("+dir+")", toInfo.ParamTypes, fromInfo.ParamTypes)
+			if len(toInfo.ResultTypes) == len(fromInfo.ResultTypes) {
+				lines += resultPositionChanges(dir, toInfo.ResultTypes, fromInfo.ResultTypes)
+			} else {
+				lines += typeCountDelta("results ("+dir+")", toInfo.ResultTypes, fromInfo.ResultTypes)
+			}
+			if lines != "" {
+				fmt.Fprintf(&b, "%s\n", lines)
+			}
+		}
+		if changes := pointerReturnChanges(toInfo.ResultTypes, fromInfo.ResultTypes); len(changes) > 0 {
+			fmt.Fprintf(&b, "> **Pointer/value return:** %s. Callers that store, compare or dereference the result no longer compile, or silently share or copy the value.\n\n", strings.Join(changes, "; "))
+		}
+		if typesReordered(fromInfo.ParamTypes, toInfo.ParamTypes) {
+			fmt.Fprintf(&b, "> **Parameters reordered:** `(%s)` → `(%s)`. The same types are taken in a different order, which silently breaks positional callers whose arguments are assignable to both types.\n\n",
+				strings.Join(toInfo.ParamTypes, ", "), strings.Join(fromInfo.ParamTypes, ", "))
+		}
+	}
+
+	// Structure deltas (closures, goroutines, ...), base → head like the
+	// other deltas.
+	var deltas []string
+	for _, m := range bodyMetrics {
+		if base, head := m.get(toInfo), m.get(fromInfo); base != head {
+			deltas = append(deltas, fmt.Sprintf("- %s: %d → %d\n", m.label, base, head))
+		}
+	}
+	if len(deltas) > 0 {
+		fmt.Fprintf(&b, "#### Structure Changes (`%s` → `%s`)\n\n", toRef, fromRef)
+		fmt.Fprintf(&b, "%s\n", strings.Join(deltas, ""))
+		if fromInfo.MaxDepth > toInfo.MaxDepth {
+			fmt.Fprintf(&b, "> **More deeply nested:** the deepest block went from %d to %d levels.\n\n", toInfo.MaxDepth, fromInfo.MaxDepth)
+		}
+		var added, paid []string
+		for _, m := range []string{"TODO", "FIXME", "XXX"} {
+			switch d := fromInfo.DebtMarkers[m] - toInfo.DebtMarkers[m]; {
+			case d > 0:
+				added = append(added, fmt.Sprintf("%d %s", d, m))
+			case d < 0:
+				paid = append(paid, fmt.Sprintf("%d %s", -d, m))
+			}
+		}
+		if len(added) > 0 {
+			fmt.Fprintf(&b, "> **New debt markers:** added %s.\n\n", strings.Join(added, ", "))
+		}
+		if len(paid) > 0 {
+			fmt.Fprintf(&b, "> **Debt paid down:** removed %s.\n\n", strings.Join(paid, ", "))
+		}
+		var exitChanges []string
+		for _, kind := range errorExitKinds {
+			switch d := fromInfo.ErrorExits[kind] - toInfo.ErrorExits[kind]; {
+			case d > 0:
+				exitChanges = append(exitChanges, fmt.Sprintf("added %d `%s`", d, kind))
+			case d < 0:
+				exitChanges = append(exitChanges, fmt.Sprintf("removed %d `%s`", -d, kind))
+			}
+		}
+		if len(exitChanges) > 0 {
+			fmt.Fprintf(&b, "> **Error handling changed:** %s. Check how failures now surface to callers.\n\n", strings.Join(exitChanges, ", "))
+		}
+		var wrapChanges []string
+		for _, kind := range errorWrapKinds {
+			switch d := fromInfo.ErrorWraps[kind] - toInfo.ErrorWraps[kind]; {
+			case d > 0:
+				wrapChanges = append(wrapChanges, fmt.Sprintf("added %d `%s`", d, kind))
+			case d < 0:
+				wrapChanges = append(wrapChanges, fmt.Sprintf("removed %d `%s`", -d, kind))
+			}
+		}
+		if len(wrapChanges) > 0 {
+			note := ""
+			if fromInfo.ErrorWraps["%w"] < toInfo.ErrorWraps["%w"] {
+				note = " Errors no longer wrapped with `%w` stop matching `errors.Is`/`errors.As` on their cause."
+			}
+			fmt.Fprintf(&b, "> **Error wrapping changed:** %s.%s\n\n", strings.Join(wrapChanges, ", "), note)
+		}
+	}
+
+	// Calls added or removed
+	added, removed := diffStrings(fromInfo.Calls, toInfo.Calls)
+	if len(added) > 0 || len(removed) > 0 || fromInfo.Recursive != toInfo.Recursive {
+		fmt.Fprintf(&b, "#### Call Changes\n\n")
+		if len(added) > 0 {
+			fmt.Fprintf(&b, "- now calls: %s\n", codeList(added))
+		}
+		if len(removed) > 0 {
+			fmt.Fprintf(&b, "- no longer calls: %s\n", codeList(removed))
+		}
+		if fromInfo.Recursive && !toInfo.Recursive {
+			fmt.Fprintf(&b, "- now recursive\n")
+		} else if toInfo.Recursive && !fromInfo.Recursive {
+			fmt.Fprintf(&b, "- no longer recursive\n")
+		}
+		fmt.Fprintf(&b, "\n")
 	}
 
 	// Body identical note
@@ -708,62 +8204,368 @@ func writeChangedFuncFile(outDir, fromRef, toRef string, fromInfo, toInfo *FuncI
 	h := sha1.Sum([]byte(b.String()))
 	fmt.Fprintf(&b, "_report hash: %x_\n", h[:6])
 
-	// Final path
-	path := filepath.Join(outDir, baseName)
-	if err := ioutil.WriteFile(path, []byte(b.String()), 0o644); err != nil {
-		return "", fmt.Errorf("write %s: %w", path, err)
+	return baseName, b.String()
+}
+
+// funcReportName picks the --out-dir file name for info: the default name or
+// --filename-template, with prefix added to the last element and made unique
+// by names.
+func funcReportName(opts ReportOptions, info *FuncInfo, prefix string, names *reportNamer) string {
+	baseName := changedFuncFilenameWithRecv(info)
+	if opts.FilenameTemplate != nil {
+		name, err := templateFilename(opts.FilenameTemplate, info)
+		if err != nil {
+			logf("warning", "", "", "%v; using %s", err, baseName)
+		} else {
+			baseName = name
+		}
 	}
-	return baseName, nil
+	if prefix != "" {
+		dir, file := path.Split(baseName)
+		baseName = dir + prefix + file
+	}
+	return names.claim(baseName, info)
+}
+
+// renderNewFuncFile builds the per-function report of a new function: its
+// header, location and body on the from side.
+func renderNewFuncFile(ctx context.Context, opts ReportOptions, info *FuncInfo, names *reportNamer) (string, string) {
+	baseName := funcReportName(opts, info, "new_", names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "### %s — `%s`\n\n", qualifiedName(info), info.File)
+	fmt.Fprintf(&b, "_New in `%s` (not in `%s`)._\n\n", opts.FromRef, opts.ToRef)
+	fmt.Fprintf(&b, "- package: `%s`\n", info.Package)
+	fmt.Fprintf(&b, "- file: `%s`\n", info.File)
+	fmt.Fprintf(&b, "- lines: %d–%d (%d LOC)\n", info.StartLine, info.EndLine, info.LineCount)
+	if info.LineDirective != "" {
+		fmt.Fprintf(&b, "- generated from: `%s`\n", info.LineDirective)
+	}
+	fmt.Fprintf(&b, "\n")
+	writeFuncBody(ctx, &b, opts, opts.FromRef, opts.FromSource, info)
+
+	h := sha1.Sum([]byte(b.String()))
+	fmt.Fprintf(&b, "_report hash: %x_\n", h[:6])
+	return baseName, b.String()
+}
+
+// diffStrings returns the elements only in a and only in b. Both must be
+// sorted; the results are sorted as well.
+func diffStrings(a, b []string) (onlyA, onlyB []string) {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			onlyA = append(onlyA, a[i])
+			i++
+		case i == len(a) || b[j] < a[i]:
+			onlyB = append(onlyB, b[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return onlyA, onlyB
+}
+
+// codeList renders items as a comma-separated list of code spans.
+func codeList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, s := range items {
+		quoted[i] = "`" + s + "`"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// typeCountDelta summarizes how a parameter or result list went from before
+// to after as a list item, e.g. "- results: 1 → 2 (added `error`)", naming the
+// types that were added or removed. It returns "" when the list only changed
+// order or not at all.
+func typeCountDelta(label string, before, after []string) string {
+	added, removed := typeListDelta(before, after)
+	if len(added) == 0 && len(removed) == 0 {
+		return ""
+	}
+	var notes []string
+	if len(added) > 0 {
+		notes = append(notes, "added "+codeList(added))
+	}
+	if len(removed) > 0 {
+		notes = append(notes, "removed "+codeList(removed))
+	}
+	return fmt.Sprintf("- %s: %d → %d (%s)\n", label, len(before), len(after), strings.Join(notes, "; "))
+}
+
+// resultPositionChanges compares two result lists of the same length
+// position by position and returns one list item per result whose type
+// changed, numbered from 1 and labeled with dir, e.g.
+// "- result 1 (`v1` → `v2`): `T` → `*T` (now a pointer)".
+func resultPositionChanges(dir string, before, after []string) string {
+	var b strings.Builder
+	for i := range before {
+		if canonicalType(before[i]) == canonicalType(after[i]) {
+			continue
+		}
+		note := ""
+		if change := pointerChange(before[i], after[i]); change != "" {
+			note = " (" + change + ")"
+		}
+		fmt.Fprintf(&b, "- result %d (%s): `%s` → `%s`%s\n", i+1, dir, before[i], after[i], note)
+	}
+	return b.String()
+}
+
+// pointerChange returns "now a pointer" if after is *before, "no longer a
+// pointer" if before is *after, and "" otherwise.
+func pointerChange(before, after string) string {
+	switch {
+	case canonicalType("*"+before) == canonicalType(after):
+		return "now a pointer"
+	case canonicalType(before) == canonicalType("*"+after):
+		return "no longer a pointer"
+	}
+	return ""
+}
+
+// pointerReturnChanges lists, as "returns `C` → `*C`", every result
+// position where the type switched between a value and a pointer to it.
+// before and after are result types; lists of different lengths have no
+// positions in common and yield nothing.
+func pointerReturnChanges(before, after []string) []string {
+	if len(before) != len(after) {
+		return nil
+	}
+	var out []string
+	for i := range before {
+		if pointerChange(before[i], after[i]) != "" {
+			out = append(out, fmt.Sprintf("returns `%s` → `%s`", before[i], after[i]))
+		}
+	}
+	return out
+}
+
+// typeListDelta compares two type lists as multisets of canonical types and
+// returns the types only in after (added) and only in before (removed), each
+// in list order.
+func typeListDelta(before, after []string) (added, removed []string) {
+	count := make(map[string]int)
+	for _, t := range before {
+		count[canonicalType(t)]++
+	}
+	for _, t := range after {
+		if c := canonicalType(t); count[c] > 0 {
+			count[c]--
+		} else {
+			added = append(added, t)
+		}
+	}
+	for _, t := range before {
+		if c := canonicalType(t); count[c] > 0 {
+			count[c]--
+			removed = append(removed, t)
+		}
+	}
+	return added, removed
+}
+
+// loadFuncBody reads info's source lines from src. An error wrapping
+// fs.ErrNotExist means the file is not present on that side.
+func loadFuncBody(ctx context.Context, src fileSource, info *FuncInfo) (string, error) {
+	data, err := src.ReadFile(ctx, info.File)
+	if err != nil {
+		return "", err
+	}
+	return extractLines(data, info.StartLine, info.EndLine), nil
+}
+
+// bodyUnavailableNote explains why a function body could not be shown: the
+// file is missing at that ref, reading it failed, or the line range is empty.
+func bodyUnavailableNote(ref string, info *FuncInfo, err error) string {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Sprintf("_function body unavailable: `%s` does not exist at `%s`_", info.File, ref)
+	case err != nil:
+		return fmt.Sprintf("_function body unavailable: could not read `%s` at `%s`: %v_", info.File, ref, err)
+	default:
+		return fmt.Sprintf("_function body unavailable: lines %d–%d of `%s` at `%s` are empty_", info.StartLine, info.EndLine, info.File, ref)
+	}
+}
+
+// typesReordered reports whether a and b hold the same types (as a multiset
+// of canonical types) in a different order.
+func typesReordered(a, b []string) bool {
+	if len(a) != len(b) || len(a) < 2 {
+		return false
+	}
+	same := true
+	counts := make(map[string]int)
+	for i := range a {
+		ca, cb := canonicalType(a[i]), canonicalType(b[i])
+		if ca != cb {
+			same = false
+		}
+		counts[ca]++
+		counts[cb]--
+	}
+	if same {
+		return false
+	}
+	for _, c := range counts {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func changedFuncFilenameWithRecv(info *FuncInfo) string {
-	safePath := strings.ReplaceAll(strings.ReplaceAll(info.File, "/", "_"), "\\", "_")
+	safePath := sanitizeFilenamePart(info.File)
+	name := sanitizeFilenamePart(info.Name)
 	recv := info.Receiver
 	if recv != "" {
-		recv = strings.ReplaceAll(recv, "*", "ptr")
-		return fmt.Sprintf("%s__%s__%s.md", safePath, recv, info.Name)
+		recv = sanitizeFilenamePart(strings.ReplaceAll(recv, "*", "ptr"))
+		return fmt.Sprintf("%s__%s__%s.md", safePath, recv, name)
 	}
-	return fmt.Sprintf("%s__%s.md", safePath, info.Name)
+	return fmt.Sprintf("%s__%s.md", safePath, name)
 }
 
-func writeAllChangedFuncFiles(outDir, fromRef, toRef string, changed [][2]*FuncInfo) []string {
-	if outDir == "" {
-		return nil
+// filenameFields is the data a --filename-template is executed with.
+type filenameFields struct {
+	Package  string
+	File     string
+	Receiver string
+	Name     string
+}
+
+// parseFilenameTemplate parses a --filename-template, returning nil for the
+// default scheme. The template is test-executed so that references to unknown
+// fields are reported up front rather than once per function.
+func parseFilenameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("filename").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --filename-template: %w", err)
+	}
+	if err := tmpl.Execute(ioutil.Discard, filenameFields{}); err != nil {
+		return nil, fmt.Errorf("invalid --filename-template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// templateFilename executes tmpl for info and turns the result into a safe
+// relative name: it is split into elements at / and \, every element is
+// sanitized and empty ones are dropped, so the name always stays inside
+// --out-dir.
+func templateFilename(tmpl *template.Template, info *FuncInfo) (string, error) {
+	var b strings.Builder
+	err := tmpl.Execute(&b, filenameFields{
+		Package:  info.Package,
+		File:     info.File,
+		Receiver: info.Receiver,
+		Name:     info.Name,
+	})
+	if err != nil {
+		return "", fmt.Errorf("--filename-template for %s: %w", qualifiedName(info), err)
+	}
+
+	var parts []string
+	for _, p := range strings.FieldsFunc(b.String(), func(r rune) bool { return r == '/' || r == '\\' }) {
+		if p = sanitizeFilenamePart(p); p != "" {
+			parts = append(parts, p)
+		}
 	}
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: failed to create out dir %s: %v\n", outDir, err)
+	if len(parts) == 0 {
+		return "", fmt.Errorf("--filename-template produced an empty name for %s", qualifiedName(info))
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// writeAllChangedFuncFiles writes one report per changed function (or new
+// function, for a pair with a nil to side) into opts.OutDir and returns the
+// file names. With opts.DryRun nothing is created;
+// the names that would have been written are returned instead.
+func writeAllChangedFuncFiles(ctx context.Context, opts ReportOptions, changed [][2]*FuncInfo) []string {
+	if opts.OutDir == "" {
 		return nil
 	}
+	if !opts.DryRun {
+		dir, err := resolveOutDir(opts.OutDir)
+		if err != nil {
+			logf("warning", "", "", "failed to create out dir %s: %v", opts.OutDir, err)
+			return nil
+		}
+		// Only the files are written to the resolved path; the report
+		// still names the directory as given.
+		opts.OutDir = dir
+	}
 
 	var files []string
+	names := newReportNamer()
 	for _, pair := range changed {
 		fromInfo := pair[0]
 		toInfo := pair[1]
-		name, err := writeChangedFuncFile(outDir, fromRef, toRef, fromInfo, toInfo)
+		if opts.DryRun {
+			name, _ := renderChangedFuncFile(ctx, opts, fromInfo, toInfo, names)
+			files = append(files, name)
+			continue
+		}
+		name, err := writeChangedFuncFile(ctx, opts, fromInfo, toInfo, names)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: failed to write changed function file: %v\n", err)
+			logf("warning", "", "", "failed to write changed function file: %v", err)
 			continue
 		}
 		if name != "" {
 			files = append(files, name)
 		}
 	}
+
+	if opts.DryRun {
+		logf("info", "", "", "dry run: %d per-function files would be written to %s", len(files), opts.OutDir)
+	}
 	return files
 }
 
-func addChangedFilesIndex(b *strings.Builder, outDir string, files []string) {
-	if outDir == "" || len(files) == 0 {
+func addChangedFilesIndex(b *strings.Builder, opts ReportOptions, files []string) {
+	if opts.OutDir == "" || len(files) == 0 {
 		return
 	}
-	fmt.Fprintf(b, "Per-function reports (Markdown files) written to `%s`:\n\n", outDir)
-	sort.Strings(files)
+	if opts.DryRun {
+		fmt.Fprintf(b, "Per-function reports (Markdown files) that would be written to `%s` (dry run):\n\n", opts.OutDir)
+	} else {
+		fmt.Fprintf(b, "Per-function reports (Markdown files) written to `%s`:\n\n", opts.OutDir)
+	}
+	// files follow ChangedFuncs, which is already in --sort=impact order.
+	if opts.Sort != "impact" {
+		sort.Strings(files)
+	}
 	for _, f := range files {
-		fmt.Fprintf(b, "- `%s/%s`\n", outDir, f)
+		fmt.Fprintf(b, "- `%s/%s`\n", opts.OutDir, f)
 	}
 	fmt.Fprintf(b, "\n")
 }
 
-func normalizeBody(s string) string {
+// bodyHash returns a short fingerprint of a normalized function body, or ""
+// for an empty body.
+func bodyHash(body string, norm BodyNormalization) string {
+	nb := normalizeBody(body, norm)
+	if nb == "" {
+		return ""
+	}
+	h := sha1.Sum([]byte(nb))
+	return fmt.Sprintf("%x", h[:8])
+}
+
+// trivialBodyHash is the fingerprint of an empty block, "{}".
+var trivialBodyHash = bodyHash("{}", BodyNormalization{})
+
+func normalizeBody(s string, norm BodyNormalization) string {
+	if len(norm.ImportRenames) > 0 {
+		s = renameQualifiers(s, norm.ImportRenames)
+	}
+
 	// Normalize line endings to LF
 	s = strings.ReplaceAll(s, "\r\n", "\n")
 	s = strings.ReplaceAll(s, "\r", "\n")
@@ -776,6 +8578,24 @@ func normalizeBody(s string) string {
 		lines[i] = strings.TrimRight(lines[i], " \t")
 	}
 
+	if norm.Comments {
+		lines = dropCommentLines(lines)
+	}
+	if norm.Indent {
+		for i := range lines {
+			lines[i] = strings.TrimLeft(lines[i], " \t")
+		}
+	}
+	if norm.BlankLines {
+		kept := lines[:0]
+		for _, l := range lines {
+			if strings.TrimSpace(l) != "" {
+				kept = append(kept, l)
+			}
+		}
+		lines = kept
+	}
+
 	// Drop leading/trailing completely empty lines
 	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
 		lines = lines[1:]
@@ -787,31 +8607,99 @@ func normalizeBody(s string) string {
 	return strings.Join(lines, "\n")
 }
 
-func collectTsFuncs(ref, repoRoot, pkgFilter string) (FuncSet, error) {
-	files, err := gitListTsFiles(ref)
+// renameQualifiers rewrites every identifier of s found in renames to its
+// new name where it qualifies a selector, as in "old.Foo", and is not itself
+// selected from something else (x.old.Foo is a field, not a package). s is
+// tokenized as Go, so string literals and comments are left alone.
+func renameQualifiers(s string, renames map[string]string) string {
+	var sc scanner.Scanner
+	file := token.NewFileSet().AddFile("", -1, len(s))
+	sc.Init(file, []byte(s), nil, 0)
+
+	var b strings.Builder
+	last := 0 // end of the text already copied to b
+	prev := token.ILLEGAL
+	var ident string
+	var identOff int
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.PERIOD && ident != "" {
+			if to, ok := renames[ident]; ok {
+				b.WriteString(s[last:identOff])
+				b.WriteString(to)
+				last = identOff + len(ident)
+			}
+		}
+		ident = ""
+		if tok == token.IDENT && prev != token.PERIOD {
+			ident, identOff = lit, file.Offset(pos)
+		}
+		prev = tok
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// dropCommentLines removes lines holding only a comment: "//" lines, and
+// "/* ... */" blocks from a line starting with "/*" to the line that closes
+// it.
+func dropCommentLines(lines []string) []string {
+	kept := lines[:0]
+	inBlock := false
+	for _, l := range lines {
+		t := strings.TrimSpace(l)
+		switch {
+		case inBlock:
+			inBlock = !strings.Contains(t, "*/")
+		case strings.HasPrefix(t, "//"):
+		case strings.HasPrefix(t, "/*"):
+			inBlock = !strings.Contains(t[2:], "*/")
+		default:
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+func collectTsFuncs(ctx context.Context, source fileSource, repoRoot string, opts CollectOptions) (FuncSet, TypeSet, []ParseFailure, error) {
+	ref := source.Name()
+	files, err := listSourceFiles(ctx, source, func(f string) bool {
+		return isTsSourceFile(f) && opts.includedPath(f)
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	funcs := make(FuncSet)
+	var failures []ParseFailure
 
-	for _, path := range files {
-		src, err := gitShowFile(ref, path)
+	for i, content := range readFiles(ctx, source, files, opts.Jobs) {
+		path := files[i]
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+		src, err := content.data, content.err
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: skipping %s@%s: %v\n", path, ref, err)
+			logf("warning", path, ref, "skipping %s@%s: %v", path, ref, err)
 			continue
 		}
 
 		infos, err := extractTsMethods(path, src)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: TS parse failed for %s@%s: %v\n", path, ref, err)
+			failures = append(failures, ParseFailure{Ref: ref, File: path, Err: err.Error()})
 			continue
 		}
 
-		for _, info := range infos {
+		for _, info := range mergeTsOverloads(infos) {
 			// pkg/path can be roughly the directory
 			pkgPath := filepath.Dir(path)
-			if pkgFilter != "" && !strings.Contains(pkgPath, pkgFilter) {
+			if opts.PackageFilter != "" && !strings.Contains(pkgPath, opts.PackageFilter) {
+				continue
+			}
+			if opts.excludedName(info.MethodName) {
 				continue
 			}
 
@@ -827,40 +8715,38 @@ func collectTsFuncs(ref, repoRoot, pkgFilter string) (FuncSet, error) {
 				EndLine:   info.EndLine,
 				LineCount: info.LineCount,
 			}
-
-			key := FuncKey{
-				Package:  pkgPath,
-				Receiver: fi.Receiver,
-				Name:     fi.Name,
+			if !opts.NoBody {
+				fi.BodyHash = bodyHash(info.Body, opts.Normalize)
 			}
-			funcs[key] = fi
+
+			addFunc(funcs, fi, ref)
 		}
 	}
 
-	return funcs, nil
+	return funcs, nil, failures, nil
 }
 
-func gitListTsFiles(ref string) ([]string, error) {
-	cmd := exec.Command("git", "ls-tree", "-r", "--name-only", ref)
-	out, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("git ls-tree failed for ref %s: %w", ref, err)
-	}
-
-	lines := strings.Split(string(out), "\n")
-	var files []string
-	for _, l := range lines {
-		l = strings.TrimSpace(l)
-		if l == "" {
-			continue
-		}
-		if strings.HasSuffix(l, ".ts") &&
-			!strings.HasSuffix(l, ".spec.ts") &&
-			!strings.HasSuffix(l, ".test.ts") {
-			files = append(files, l)
+// mergeTsOverloads folds TypeScript overload signatures into the
+// declaration they overload: a bodiless method directly followed by another
+// declaration of the same class and method is dropped, and that declaration's
+// line range grows to cover it. Overloads are legal, so they must not show up
+// as duplicates, yet editing one is still a change to the method. methods
+// must be in source order, as extractTsMethods returns them.
+func mergeTsOverloads(methods []TsExtractedMethod) []TsExtractedMethod {
+	var out []TsExtractedMethod
+	for _, m := range methods {
+		if n := len(out); n > 0 {
+			prev := out[n-1]
+			if prev.Body == "" && prev.ClassName == m.ClassName && prev.MethodName == m.MethodName {
+				m.StartLine = prev.StartLine
+				m.LineCount = m.EndLine - m.StartLine + 1
+				out[n-1] = m
+				continue
+			}
 		}
+		out = append(out, m)
 	}
-	return files, nil
+	return out
 }
 
 func extractTsMethods(path string, src []byte) ([]TsExtractedMethod, error) {
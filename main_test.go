@@ -0,0 +1,894 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// memSource is a fileSource backed by a map of file contents.
+type memSource struct {
+	name  string
+	files map[string]string
+}
+
+func (s memSource) Name() string { return s.name }
+
+func (s memSource) ListFiles(ctx context.Context) ([]string, error) {
+	var files []string
+	for f := range s.files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s memSource) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	data, ok := s.files[p]
+	if !ok {
+		return nil, fmt.Errorf("%s@%s: %w", p, s.name, fs.ErrNotExist)
+	}
+	return []byte(data), nil
+}
+
+// collectMem runs collectGoFuncs over files.
+func collectMem(t *testing.T, files map[string]string, opts CollectOptions) FuncSet {
+	t.Helper()
+	funcs, _, failures, err := collectGoFuncs(context.Background(), memSource{name: "test", files: files}, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) > 0 {
+		t.Fatalf("parse failures: %v", failures)
+	}
+	return funcs
+}
+
+// findFuncs returns the collected functions called name, sorted.
+func findFuncs(funcs FuncSet, name string) []*FuncInfo {
+	var out []*FuncInfo
+	for _, f := range funcs {
+		if f.Name == name {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return funcSortKey(out[i]) < funcSortKey(out[j]) })
+	return out
+}
+
+func TestSanitizeFilenamePart(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{`pkg/util/strings.go`, "pkg_util_strings.go"},
+		{`pkg\util\strings.go`, "pkg_util_strings.go"},
+		{`C:\src\app\main.go`, "C__src_app_main.go"},
+		{`..\..\etc\passwd`, "_._etc_passwd"},
+		{`../../etc/passwd`, "_._etc_passwd"},
+		{`.hidden`, "hidden"},
+		{"größe/ファイル.go", "größe_ファイル.go"},
+		{"Grüße", "Grüße"},
+		{"a b\tc", "a_b_c"},
+		{"`x`", "x"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilenamePart(tt.in); got != tt.want {
+			t.Errorf("sanitizeFilenamePart(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestChangedFuncFilenameWindowsAndUnicode(t *testing.T) {
+	unix := changedFuncFilenameWithRecv(&FuncInfo{File: "pkg/größe/calc.go", Receiver: "*Größe", Name: "Berechne"})
+	windows := changedFuncFilenameWithRecv(&FuncInfo{File: `pkg\größe\calc.go`, Receiver: "*Größe", Name: "Berechne"})
+	want := "pkg_größe_calc.go__ptrGröße__Berechne.md"
+	if unix != want || windows != want {
+		t.Errorf("got %q (slashes) and %q (backslashes), want %q for both", unix, windows, want)
+	}
+}
+
+func TestReportNamerCollisionsAndLength(t *testing.T) {
+	n := newReportNamer()
+	a := &FuncInfo{Package: "p", File: `a\b.go`, Name: "F"}
+	b := &FuncInfo{Package: "p", File: "a/b.go", Name: "F"}
+	first := n.claim(changedFuncFilenameWithRecv(a), a)
+	second := n.claim(changedFuncFilenameWithRecv(b), b)
+	if first == second {
+		t.Fatalf("both functions got %q", first)
+	}
+	if first != "a_b.go__F.md" {
+		t.Errorf("first claim = %q, want it unchanged", first)
+	}
+
+	long := &FuncInfo{Package: "p", File: "x.go", Name: strings.Repeat("ü", 300)}
+	name := n.claim(changedFuncFilenameWithRecv(long), long)
+	if len(name) > maxReportNameLen || !utf8.ValidString(name) || !strings.HasSuffix(name, ".md") {
+		t.Errorf("long name = %q (%d bytes), want valid UTF-8 ending in .md within %d bytes", name, len(name), maxReportNameLen)
+	}
+}
+
+func TestLargeChangesShowGrowthAsPositive(t *testing.T) {
+	head := &FuncInfo{Package: "p", File: "p/p.go", Name: "Grow", Signature: "()", StartLine: 1, EndLine: 120, LineCount: 120}
+	base := &FuncInfo{Package: "p", File: "p/p.go", Name: "Grow", Signature: "()", StartLine: 1, EndLine: 10, LineCount: 10}
+	diff := DiffResult{ChangedFuncs: [][2]*FuncInfo{{head, base}}, FromTotal: 1, ToTotal: 1}
+	opts := ReportOptions{FromRef: "development", ToRef: "master", SummaryOnly: true, ThresholdLOC: 50}
+
+	report := buildMarkdownReport(context.Background(), diff, opts)
+	if want := "10 → 120 LOC (+110)"; !strings.Contains(report, want) {
+		t.Errorf("report lacks %q:\n%s", want, report)
+	}
+}
+
+func TestDiffHashIgnoresPresentation(t *testing.T) {
+	a := &FuncInfo{Package: "p", File: "p/a.go", Name: "A", Signature: "()", StartLine: 3, EndLine: 5, LineCount: 3, BodyHash: "1"}
+	b := &FuncInfo{Package: "p", File: "p/b.go", Name: "B", Signature: "()", StartLine: 3, EndLine: 5, LineCount: 3, BodyHash: "2"}
+	gone := &FuncInfo{Package: "q", File: "q/q.go", Name: "Gone", Signature: "()", StartLine: 1, EndLine: 1, LineCount: 1}
+	head := &FuncInfo{Package: "p", File: "p/c.go", Name: "C", Signature: "(x int)", StartLine: 1, EndLine: 9, LineCount: 9, BodyHash: "3"}
+	base := &FuncInfo{Package: "p", File: "p/c.go", Name: "C", Signature: "()", StartLine: 1, EndLine: 4, LineCount: 4, BodyHash: "4"}
+	diff := DiffResult{
+		NewFuncs:     []*FuncInfo{a, b},
+		RemovedFuncs: []*FuncInfo{gone},
+		ChangedFuncs: [][2]*FuncInfo{{head, base}},
+		FromTotal:    3,
+		ToTotal:      2,
+	}
+	want := diffHash(diff)
+
+	opts := ReportOptions{
+		FromRef:      "development",
+		ToRef:        "master",
+		FromSource:   memSource{name: "development"},
+		ToSource:     memSource{name: "master"},
+		OutDir:       t.TempDir(),
+		ThresholdLOC: 1,
+	}
+	buildMarkdownReport(context.Background(), diff, opts)
+	buildTermReport(diff, ReportOptions{FromRef: "development", ToRef: "master", SummaryOnly: true}, true)
+	if got := diffHash(diff); got != want {
+		t.Errorf("hash changed after rendering with --out-dir: %s, want %s", got, want)
+	}
+
+	reordered := diff
+	reordered.NewFuncs = []*FuncInfo{b, a}
+	if got := diffHash(reordered); got != want {
+		t.Errorf("hash depends on list order: %s, want %s", got, want)
+	}
+
+	edited := *head
+	edited.BodyHash = "5"
+	changed := diff
+	changed.ChangedFuncs = [][2]*FuncInfo{{&edited, base}}
+	if diffHash(changed) == want {
+		t.Error("hash did not change with a function body")
+	}
+}
+
+func TestParametersReorderedBaseToHead(t *testing.T) {
+	base := &FuncInfo{Package: "p", File: "p/p.go", Name: "F", Signature: "(a int, b string)", ParamTypes: []string{"int", "string"}}
+	head := &FuncInfo{Package: "p", File: "p/p.go", Name: "F", Signature: "(b string, a int)", ParamTypes: []string{"string", "int"}}
+	opts := ReportOptions{FromRef: "development", ToRef: "master", FromSource: memSource{name: "development"}, ToSource: memSource{name: "master"}}
+	_, report := renderChangedFuncFile(context.Background(), opts, head, base, newReportNamer())
+	if want := "**Parameters reordered:** `(int, string)` → `(string, int)`"; !strings.Contains(report, want) {
+		t.Errorf("report lacks %q:\n%s", want, report)
+	}
+}
+
+func TestJUnitFailOnSignature(t *testing.T) {
+	head := &FuncInfo{Package: "p", File: "p/p.go", Name: "F", Signature: "(x int)", Exported: true, StartLine: 3, EndLine: 5}
+	base := &FuncInfo{Package: "p", File: "p/p.go", Name: "F", Signature: "()", Exported: true, StartLine: 3, EndLine: 4}
+	gone := &FuncInfo{Package: "p", File: "p/p.go", Name: "Gone", Signature: "()", Exported: true, StartLine: 7, EndLine: 7}
+	added := &FuncInfo{Package: "p", File: "p/p.go", Name: "Added", Signature: "()", Exported: true, StartLine: 7, EndLine: 7}
+	diff := DiffResult{
+		NewFuncs:     []*FuncInfo{added},
+		RemovedFuncs: []*FuncInfo{gone},
+		ChangedFuncs: [][2]*FuncInfo{{head, base}},
+	}
+
+	tests := []struct {
+		failOn            []string
+		failures, skipped int
+	}{
+		{nil, 1, 1},
+		{[]string{"signature"}, 2, 0},
+	}
+	for _, tt := range tests {
+		opts := ReportOptions{FromRef: "development", ToRef: "master", FailOn: tt.failOn}
+		out, err := buildJUnitReport(diff, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var suite junitTestSuite
+		if err := xml.Unmarshal([]byte(out), &suite); err != nil {
+			t.Fatal(err)
+		}
+		if suite.Tests != 3 || suite.Failures != tt.failures || suite.Skipped != tt.skipped {
+			t.Errorf("--fail-on=%v: tests=%d failures=%d skipped=%d, want 3, %d, %d",
+				tt.failOn, suite.Tests, suite.Failures, suite.Skipped, tt.failures, tt.skipped)
+		}
+		if want := "F: () (master at p/p.go:3-4) → (x int) (development at p/p.go:3-5)"; !strings.Contains(out, want) {
+			t.Errorf("--fail-on=%v: report lacks %q:\n%s", tt.failOn, want, out)
+		}
+	}
+}
+
+func TestTypesReorderedCanonical(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want bool
+	}{
+		{[]string{"int", "string"}, []string{"string", "int"}, true},
+		{[]string{"any", "int"}, []string{"int", "interface{}"}, true},
+		{[]string{"any", "int"}, []string{"interface{}", "int"}, false},
+		{[]string{"map[string]any", "int"}, []string{"map[string]interface{}", "int"}, false},
+		{[]string{"int", "string"}, []string{"int", "error"}, false},
+	}
+	for _, tt := range tests {
+		if got := typesReordered(tt.a, tt.b); got != tt.want {
+			t.Errorf("typesReordered(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMovedAndEditedFunction(t *testing.T) {
+	base := memSource{name: "master", files: map[string]string{
+		"util/a.go": "package util\n\nfunc Move() int {\n\treturn 1\n}\n",
+	}}
+	head := memSource{name: "development", files: map[string]string{
+		"util/a.go": "package util\n",
+		"util/b.go": "package util\n\n// Move moved here.\nfunc Move() int {\n\treturn 2\n}\n",
+	}}
+	ctx := context.Background()
+	from, _, _, err := collectGoFuncs(ctx, head, "", CollectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, _, _, err := collectGoFuncs(ctx, base, "", CollectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff := diffFuncs(from, to, DiffOptions{})
+	if len(diff.NewFuncs) != 0 || len(diff.RemovedFuncs) != 0 {
+		t.Fatalf("got %d new and %d removed functions, want the move reported as a change", len(diff.NewFuncs), len(diff.RemovedFuncs))
+	}
+	if len(diff.ChangedFuncs) != 1 {
+		t.Fatalf("got %d changed functions, want 1", len(diff.ChangedFuncs))
+	}
+	pair := diff.ChangedFuncs[0]
+	if pair[0].File != "util/b.go" || pair[1].File != "util/a.go" {
+		t.Errorf("changed pair is in %s and %s, want util/b.go and util/a.go", pair[0].File, pair[1].File)
+	}
+
+	_, report := renderChangedFuncFile(ctx, ReportOptions{FromRef: head.name, ToRef: base.name, FromSource: head, ToSource: base}, pair[0], pair[1], newReportNamer())
+	for _, want := range []string{"return 2", "return 1"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report is missing %q, the body of one side:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "unavailable") {
+		t.Errorf("report says a body is unavailable:\n%s", report)
+	}
+
+	// Without the file on the from side, the report says why.
+	empty := memSource{name: "development"}
+	_, report = renderChangedFuncFile(ctx, ReportOptions{FromRef: head.name, ToRef: base.name, FromSource: empty, ToSource: base}, pair[0], pair[1], newReportNamer())
+	if want := "_function body unavailable: `util/b.go` does not exist at `development`_"; !strings.Contains(report, want) {
+		t.Errorf("report lacks %q:\n%s", want, report)
+	}
+}
+
+func TestStructureChangesBaseToHead(t *testing.T) {
+	base := &FuncInfo{Package: "p", File: "p/p.go", Name: "F", Signature: "()", Closures: 1, MaxDepth: 1}
+	head := &FuncInfo{Package: "p", File: "p/p.go", Name: "F", Signature: "()", Closures: 3, MaxDepth: 2}
+	opts := ReportOptions{FromRef: "development", ToRef: "master", FromSource: memSource{name: "development"}, ToSource: memSource{name: "master"}}
+	_, report := renderChangedFuncFile(context.Background(), opts, head, base, newReportNamer())
+	for _, want := range []string{
+		"#### Structure Changes (`master` → `development`)",
+		"- closures: 1 → 3",
+		"the deepest block went from 1 to 2 levels",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report lacks %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestCanonicalSignature(t *testing.T) {
+	variants := map[string][]string{
+		"(a int, b int) (int, error)": {
+			"func F(a, b int) (int, error) { return 0, nil }",
+			"func F(a int, b int) (int, error) { return 0, nil }",
+			"func F( a int ,  b int )  ( int , error ) { return 0, nil }",
+			"func F(a int, /* second */ b int) (int /* n */, error) { return 0, nil }",
+			"func F(\n\ta int, // first\n\tb int,\n) (\n\tint,\n\terror,\n) {\n\treturn 0, nil\n}",
+		},
+		"() T": {
+			"func F() T { return T{} }",
+			"func F() (T) { return T{} }",
+			"func F()  T  { return T{} }",
+		},
+		"(xs ...string)": {
+			"func F(xs ...string) {}",
+			"func F(xs ... string) {}",
+		},
+	}
+	for want, srcs := range variants {
+		for _, src := range srcs {
+			funcs := collectMem(t, map[string]string{"p/p.go": "package p\n\ntype T struct{}\n\n" + src + "\n"}, CollectOptions{})
+			got := findFuncs(funcs, "F")
+			if len(got) != 1 {
+				t.Fatalf("%q: got %d functions F", src, len(got))
+			}
+			if got[0].Signature != want {
+				t.Errorf("%q: signature %q, want %q", src, got[0].Signature, want)
+			}
+		}
+	}
+}
+
+// slowSource delays every read, standing in for one git show process per
+// file.
+type slowSource struct {
+	memSource
+	delay time.Duration
+}
+
+func (s slowSource) ReadFile(ctx context.Context, p string) ([]byte, error) {
+	time.Sleep(s.delay)
+	return s.memSource.ReadFile(ctx, p)
+}
+
+func BenchmarkReadFiles(b *testing.B) {
+	src := slowSource{memSource: memSource{name: "bench", files: make(map[string]string)}, delay: 100 * time.Microsecond}
+	for i := 0; i < 500; i++ {
+		src.files[fmt.Sprintf("pkg%d/file%d.go", i%20, i)] = fmt.Sprintf("package pkg%d\n\nfunc F%d() {}\n", i%20, i)
+	}
+	files, _ := src.ListFiles(context.Background())
+
+	for _, jobs := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				read := 0
+				for _, content := range readFiles(context.Background(), src, files, jobs) {
+					if content.err != nil {
+						b.Fatal(content.err)
+					}
+					read++
+				}
+				if read != len(files) {
+					b.Fatalf("read %d files, want %d", read, len(files))
+				}
+			}
+		})
+	}
+}
+
+func TestReadFilesOrderAndEarlyStop(t *testing.T) {
+	src := memSource{name: "test", files: make(map[string]string)}
+	for i := 0; i < 100; i++ {
+		src.files[fmt.Sprintf("f%03d.go", i)] = fmt.Sprint(i)
+	}
+	files, _ := src.ListFiles(context.Background())
+
+	i := 0
+	for idx, content := range readFiles(context.Background(), src, files, 4) {
+		if idx != i || string(content.data) != fmt.Sprint(i) {
+			t.Fatalf("got file %d with %q at position %d", idx, content.data, i)
+		}
+		i++
+	}
+	if i != len(files) {
+		t.Fatalf("read %d files, want %d", i, len(files))
+	}
+
+	// Breaking out must not leave workers blocked.
+	for idx := range readFiles(context.Background(), src, files, 4) {
+		if idx == 3 {
+			break
+		}
+	}
+}
+
+func TestDiffHashCoversChangedTypes(t *testing.T) {
+	from := &TypeInfo{Package: "p", File: "p/p.go", Name: "Config", StartLine: 3, EndLine: 6, Fields: []FieldInfo{{Name: "ID", Type: "int64"}}}
+	to := &TypeInfo{Package: "p", File: "p/p.go", Name: "Config", StartLine: 3, EndLine: 6, Fields: []FieldInfo{{Name: "ID", Type: "int"}}}
+	empty := diffHash(DiffResult{})
+	changed := diffHash(DiffResult{ChangedTypes: []typeChange{{From: from, To: to, Retyped: [][2]FieldInfo{{from.Fields[0], to.Fields[0]}}}}})
+	if changed == empty {
+		t.Error("a diff that only changes a struct type hashes like an empty diff")
+	}
+
+	retagged := *from
+	retagged.Fields = []FieldInfo{{Name: "ID", Type: "int64", Tag: `json:"id"`}}
+	if diffHash(DiffResult{ChangedTypes: []typeChange{{From: &retagged, To: to}}}) == changed {
+		t.Error("hash did not change with a struct tag")
+	}
+}
+
+func TestCollectSameNameUnderBuildTags(t *testing.T) {
+	funcs := collectMem(t, map[string]string{
+		"foo/helper_unix.go": "//go:build linux\n\npackage foo\n\nfunc Helper() int { return 1 }\n",
+		"foo/helper_win.go":  "//go:build windows\n\npackage foo\n\nfunc Helper() int { return 2 }\n",
+	}, CollectOptions{})
+
+	helpers := findFuncs(funcs, "Helper")
+	if len(helpers) != 2 {
+		t.Fatalf("got %d Helper functions, want 2", len(helpers))
+	}
+	builds := map[string]bool{}
+	for _, f := range helpers {
+		if f.Duplicate != 0 {
+			t.Errorf("%s: Duplicate = %d, want 0 for distinct build constraints", f.File, f.Duplicate)
+		}
+		builds[f.Build] = true
+	}
+	if !builds["linux"] || !builds["windows"] {
+		t.Errorf("builds = %v, want linux and windows", builds)
+	}
+}
+
+func TestCollectSameNameSameBuildKeepsBoth(t *testing.T) {
+	funcs := collectMem(t, map[string]string{
+		"foo/a.go": "//go:build linux\n\npackage foo\n\nfunc Helper() {}\n",
+		"foo/b.go": "//go:build linux\n\npackage foo\n\nfunc Helper() {}\n",
+	}, CollectOptions{})
+
+	helpers := findFuncs(funcs, "Helper")
+	if len(helpers) != 2 {
+		t.Fatalf("got %d Helper functions, want 2", len(helpers))
+	}
+	if helpers[0].File != "foo/a.go" || helpers[1].File != "foo/b.go" || helpers[1].Duplicate != 1 {
+		t.Errorf("got %s (dup %d) and %s (dup %d), want foo/a.go and foo/b.go (dup 1)",
+			helpers[0].File, helpers[0].Duplicate, helpers[1].File, helpers[1].Duplicate)
+	}
+}
+
+func TestMergeTsOverloads(t *testing.T) {
+	methods := []TsExtractedMethod{
+		{ClassName: "Svc", MethodName: "get", StartLine: 2, EndLine: 2},
+		{ClassName: "Svc", MethodName: "get", StartLine: 3, EndLine: 3},
+		{ClassName: "Svc", MethodName: "get", StartLine: 4, EndLine: 6, Body: "{ return x; }"},
+		{ClassName: "Svc", MethodName: "put", StartLine: 8, EndLine: 10, Body: "{}"},
+		{ClassName: "Base", MethodName: "run", StartLine: 13, EndLine: 13},
+	}
+	got := mergeTsOverloads(methods)
+	if len(got) != 3 {
+		t.Fatalf("got %d methods, want 3: %+v", len(got), got)
+	}
+	if g := got[0]; g.MethodName != "get" || g.StartLine != 2 || g.EndLine != 6 || g.LineCount != 5 || g.Body == "" {
+		t.Errorf("get = %+v, want the implementation spanning lines 2-6", g)
+	}
+	if got[1].MethodName != "put" || got[1].StartLine != 8 {
+		t.Errorf("put = %+v, want it unchanged", got[1])
+	}
+	// An abstract method has no body and nothing to merge into.
+	if got[2].MethodName != "run" || got[2].StartLine != 13 {
+		t.Errorf("run = %+v, want it kept", got[2])
+	}
+}
+
+func TestDiffHashCoversDeprecations(t *testing.T) {
+	from := &FuncInfo{Package: "p", File: "p/p.go", Name: "Old", StartLine: 5, EndLine: 6, Signature: "()", BodyHash: "h",
+		Doc: "Old does a thing.\n\nDeprecated: use New.\n"}
+	to := &FuncInfo{Package: "p", File: "p/p.go", Name: "Old", StartLine: 3, EndLine: 4, Signature: "()", BodyHash: "h",
+		Doc: "Old does a thing.\n"}
+	deprecated := diffHash(DiffResult{DeprecationChanges: [][2]*FuncInfo{{from, to}}})
+	if deprecated == diffHash(DiffResult{}) {
+		t.Error("a diff that only deprecates a function hashes like an empty diff")
+	}
+
+	renoted := *from
+	renoted.Doc = "Old does a thing.\n\nDeprecated: use Newer.\n"
+	if diffHash(DiffResult{DeprecationChanges: [][2]*FuncInfo{{&renoted, to}}}) == deprecated {
+		t.Error("hash did not change with the deprecation note")
+	}
+}
+
+func TestReportNamerCaseOnlyCollision(t *testing.T) {
+	n := newReportNamer()
+	upper := &FuncInfo{Package: "p", File: "p/a.go", Name: "Parse"}
+	lower := &FuncInfo{Package: "p", File: "p/a.go", Name: "parse"}
+	first := n.claim(changedFuncFilenameWithRecv(upper), upper)
+	second := n.claim(changedFuncFilenameWithRecv(lower), lower)
+	if first != "p_a.go__Parse.md" {
+		t.Errorf("first claim = %q, want it unchanged", first)
+	}
+	if strings.EqualFold(first, second) {
+		t.Fatalf("names %q and %q collide on a case-insensitive filesystem", first, second)
+	}
+
+	// The same holds when the files, not the functions, differ in case.
+	a := &FuncInfo{Package: "p", File: "p/Util.go", Name: "F"}
+	b := &FuncInfo{Package: "p", File: "p/util.go", Name: "F"}
+	first = n.claim(changedFuncFilenameWithRecv(a), a)
+	second = n.claim(changedFuncFilenameWithRecv(b), b)
+	if strings.EqualFold(first, second) {
+		t.Fatalf("names %q and %q collide on a case-insensitive filesystem", first, second)
+	}
+}
+
+func TestDiffHashIgnoresRelativeTo(t *testing.T) {
+	newDiff := func() DiffResult {
+		return DiffResult{
+			NewFuncs:     []*FuncInfo{{Package: "svc/api", File: "svc/api/h.go", Name: "Handle", Signature: "()", StartLine: 3, EndLine: 5, BodyHash: "1"}},
+			RemovedFuncs: []*FuncInfo{{Package: "lib", File: "lib/l.go", Name: "Old", Signature: "()", StartLine: 1, EndLine: 2, BodyHash: "2"}},
+			ChangedFuncs: [][2]*FuncInfo{{
+				{Package: "svc/api", File: "svc/api/h.go", Name: "Serve", Signature: "(x int)", StartLine: 7, EndLine: 9, BodyHash: "3"},
+				{Package: "svc/api", File: "svc/api/h.go", Name: "Serve", Signature: "()", StartLine: 7, EndLine: 8, BodyHash: "4"},
+			}},
+		}
+	}
+	selectors := func(specs ...string) []funcSelector {
+		sels, err := parseFuncSelectors(specs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sels
+	}
+
+	for _, tc := range []struct {
+		name           string
+		only, rootOnly []funcSelector
+	}{
+		{name: "all"},
+		{name: "--only", only: selectors("api/h.go:Serve"), rootOnly: selectors("svc/api/h.go:Serve")},
+	} {
+		plain := newDiff()
+		want := narrowDiff(&plain, NarrowOptions{Only: tc.rootOnly})
+
+		for _, keep := range []bool{false, true} {
+			rel := newDiff()
+			got := narrowDiff(&rel, NarrowOptions{Only: tc.only, RelativeTo: "svc", KeepOutside: keep})
+			if got != want {
+				t.Errorf("%s, keep outside %t: hash %s with --relative-to, %s without", tc.name, keep, got, want)
+			}
+			if f := rel.ChangedFuncs[0][0].File; f != "api/h.go" {
+				t.Errorf("%s: changed function file = %q, want it rebased to api/h.go", tc.name, f)
+			}
+			buildMarkdownReport(context.Background(), rel, ReportOptions{
+				FromRef:    "development",
+				ToRef:      "master",
+				FromSource: memSource{name: "development"},
+				ToSource:   memSource{name: "master"},
+				OutDir:     t.TempDir(),
+			})
+			if got := narrowDiff(&rel, NarrowOptions{}); got == want {
+				t.Errorf("%s: the rebased diff hashes like the original, so the paths were not rebased", tc.name)
+			}
+		}
+	}
+}
+
+func TestTypeParamConstraints(t *testing.T) {
+	collect := func(decl string) *FuncInfo {
+		t.Helper()
+		src := "package p\n\nimport \"golang.org/x/exp/constraints\"\n\n" + decl + "\n"
+		funcs := findFuncs(collectMem(t, map[string]string{"p/p.go": src}, CollectOptions{}), "F")
+		if len(funcs) != 1 {
+			t.Fatalf("%q: got %d functions F", decl, len(funcs))
+		}
+		return funcs[0]
+	}
+
+	tests := []struct {
+		decl string
+		want []string
+	}{
+		{"func F[T ~int | ~string](v T) T { return v }", []string{"~int | ~string"}},
+		{"func F[T ~int|~string](v T) T { return v }", []string{"~int | ~string"}},
+		{"func F[T constraints.Ordered](v T) T { return v }", []string{"constraints.Ordered"}},
+		{"func F[K comparable, V ~[]byte | string](k K, v V) {}", []string{"comparable", "~[]byte | string"}},
+	}
+	for _, tt := range tests {
+		got := collect(tt.decl).TypeParams
+		if strings.Join(got, ";") != strings.Join(tt.want, ";") {
+			t.Errorf("%q: type params %q, want %q", tt.decl, got, tt.want)
+		}
+	}
+
+	changed := []struct{ base, head string }{
+		{"func F[T any](v T) {}", "func F[T comparable](v T) {}"},
+		{"func F[T ~int | ~string](v T) {}", "func F[T ~int](v T) {}"},
+		{"func F[T ~int](v T) {}", "func F[T int](v T) {}"},
+		{"func F[T constraints.Ordered](v T) {}", "func F[T constraints.Integer](v T) {}"},
+	}
+	for _, c := range changed {
+		if !signatureChanged(collect(c.head), collect(c.base)) {
+			t.Errorf("%q -> %q: signature change not detected", c.base, c.head)
+		}
+	}
+
+	same := []struct{ base, head string }{
+		{"func F[T any](v T) {}", "func F[T interface{}](v T) {}"},
+		{"func F[T ~int|~string](v T) {}", "func F[T ~int | ~string](v T) {}"},
+	}
+	for _, c := range same {
+		if signatureChanged(collect(c.head), collect(c.base)) {
+			t.Errorf("%q -> %q: reported as a signature change", c.base, c.head)
+		}
+	}
+}
+
+func TestLineDirective(t *testing.T) {
+	src := "package gen\n\n" +
+		"func Plain() {}\n\n" +
+		"//line parser.y:100\n" +
+		"func Action() int {\n\treturn 1\n}\n"
+	funcs := collectMem(t, map[string]string{"gen/parser.go": src}, CollectOptions{})
+
+	plain := findFuncs(funcs, "Plain")
+	if len(plain) != 1 || plain[0].LineDirective != "" {
+		t.Fatalf("Plain = %+v, want no line directive", plain)
+	}
+	action := findFuncs(funcs, "Action")
+	if len(action) != 1 {
+		t.Fatalf("got %d functions Action", len(action))
+	}
+	f := action[0]
+	if f.File != "gen/parser.go" || f.StartLine != 6 || f.EndLine != 8 {
+		t.Errorf("Action at %s:%d–%d, want gen/parser.go:6–8", f.File, f.StartLine, f.EndLine)
+	}
+	if f.LineDirective != "gen/parser.y:100" {
+		t.Errorf("LineDirective = %q, want %q", f.LineDirective, "gen/parser.y:100")
+	}
+
+	var b strings.Builder
+	printFuncEntry(&b, f, "", nil)
+	if !strings.Contains(b.String(), "generated from: `gen/parser.y:100`") {
+		t.Errorf("entry does not mention the mapped position:\n%s", b.String())
+	}
+}
+
+func TestGitLabCodeQualitySeverities(t *testing.T) {
+	fn := func(name, sig, body string, exported bool) *FuncInfo {
+		return &FuncInfo{Package: "p", File: "p/p.go", Name: name, Signature: sig, BodyHash: body, Exported: exported, StartLine: 3, EndLine: 5}
+	}
+	diff := DiffResult{
+		NewFuncs:     []*FuncInfo{fn("Added", "()", "1", true)},
+		RemovedFuncs: []*FuncInfo{fn("Gone", "()", "2", true), fn("gone", "()", "3", false)},
+		ChangedFuncs: [][2]*FuncInfo{
+			{fn("Sig", "(x int)", "4", true), fn("Sig", "()", "4", true)},
+			{fn("Body", "()", "5", true), fn("Body", "()", "6", true)},
+		},
+	}
+	out, err := buildGitLabCodeQualityReport(diff, ReportOptions{FromRef: "development", ToRef: "master"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issues []codeQualityIssue
+	if err := json.Unmarshal([]byte(out), &issues); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for _, issue := range issues {
+		got[issue.CheckName] += issue.Severity
+	}
+	want := map[string]string{"funcdiff/removed": "major", "funcdiff/signature": "minor", "funcdiff/body": "info"}
+	if len(got) != len(want) || len(issues) != 3 {
+		t.Fatalf("got issues %+v, want one each of %v", issues, want)
+	}
+	for check, severity := range want {
+		if got[check] != severity {
+			t.Errorf("%s: severity %q, want %q", check, got[check], severity)
+		}
+	}
+}
+
+func TestCodeQualityFingerprint(t *testing.T) {
+	f := &FuncInfo{Package: "p", File: "p/p.go", Name: "Helper", StartLine: 3, EndLine: 5, Build: "linux"}
+	want := codeQualityFingerprint(f, "body")
+
+	moved := *f
+	moved.File, moved.StartLine, moved.EndLine = "p/q.go", 40, 52
+	if got := codeQualityFingerprint(&moved, "body"); got != want {
+		t.Errorf("fingerprint changed when the function moved: %s, want %s", got, want)
+	}
+
+	windows := *f
+	windows.Build = "windows"
+	if codeQualityFingerprint(&windows, "body") == want {
+		t.Error("per-build variants share a fingerprint")
+	}
+	if codeQualityFingerprint(f, "signature") == want {
+		t.Error("different kinds share a fingerprint")
+	}
+}
+
+func TestDiffFuncsOrderIsStable(t *testing.T) {
+	base := make(map[string]string)
+	head := make(map[string]string)
+	for p := 0; p < 8; p++ {
+		var b, h strings.Builder
+		fmt.Fprintf(&b, "package p%d\n\ntype T struct{}\n", p)
+		fmt.Fprintf(&h, "package p%d\n\ntype T struct{}\n", p)
+		for i := 0; i < 12; i++ {
+			switch i % 4 {
+			case 0: // removed
+				fmt.Fprintf(&b, "\nfunc Old%d() {}\n", i)
+			case 1: // new
+				fmt.Fprintf(&h, "\nfunc (T) New%d() {}\n", i)
+			case 2: // changed
+				fmt.Fprintf(&b, "\nfunc Changed%d() int { return 1 }\n", i)
+				fmt.Fprintf(&h, "\nfunc Changed%d(x int) int { return x }\n", i)
+			default: // unchanged
+				fmt.Fprintf(&b, "\nfunc (*T) Same%d() {}\n", i)
+				fmt.Fprintf(&h, "\nfunc (*T) Same%d() {}\n", i)
+			}
+		}
+		base[fmt.Sprintf("p%d/p.go", p)] = b.String()
+		head[fmt.Sprintf("p%d/p.go", p)] = h.String()
+	}
+
+	order := func() string {
+		from := collectMem(t, head, CollectOptions{})
+		to := collectMem(t, base, CollectOptions{})
+		diff := diffFuncs(from, to, DiffOptions{CompareBodies: true})
+		var b strings.Builder
+		for _, f := range diff.NewFuncs {
+			fmt.Fprintf(&b, "new %s.%s\n", f.Package, qualifiedName(f))
+		}
+		for _, f := range diff.RemovedFuncs {
+			fmt.Fprintf(&b, "removed %s.%s\n", f.Package, qualifiedName(f))
+		}
+		for _, pair := range diff.ChangedFuncs {
+			fmt.Fprintf(&b, "changed %s.%s\n", pair[0].Package, qualifiedName(pair[0]))
+		}
+		for _, f := range diff.UnchangedFuncs {
+			fmt.Fprintf(&b, "unchanged %s.%s\n", f.Package, qualifiedName(f))
+		}
+		return b.String()
+	}
+
+	want := order()
+	if n := strings.Count(want, "\n"); n != 8*12 {
+		t.Fatalf("diff lists %d functions, want %d", n, 8*12)
+	}
+	for i := 0; i < 20; i++ {
+		if got := order(); got != want {
+			t.Fatalf("run %d ordered the diff differently:\n%s\nfirst run:\n%s", i+2, got, want)
+		}
+	}
+}
+
+func TestQualifiedAndAliasedReceivers(t *testing.T) {
+	src := "package p\n\n" +
+		"type T struct{}\n\n" +
+		"type A = T\n\n" +
+		"type P = *T\n\n" +
+		"func (a A) OnAlias() {}\n\n" +
+		"func (a *A) OnAliasPtr() {}\n\n" +
+		"func (p P) OnPtrAlias() {}\n\n" +
+		"func (x pkg.T) OnQualified() {}\n\n" +
+		"func (x *pkg.T) OnQualifiedPtr() {}\n\n" +
+		"func (x (*pkg.T)) OnParenQualified() {}\n\n" +
+		"func (x *pkg.List[K, V]) OnQualifiedGeneric() {}\n"
+	funcs := collectMem(t, map[string]string{"p/p.go": src}, CollectOptions{})
+
+	want := map[string]string{
+		"OnAlias":            "A",
+		"OnAliasPtr":         "*A",
+		"OnPtrAlias":         "P",
+		"OnQualified":        "pkg.T",
+		"OnQualifiedPtr":     "*pkg.T",
+		"OnParenQualified":   "*pkg.T",
+		"OnQualifiedGeneric": "*pkg.List[K, V]",
+	}
+	for name, recv := range want {
+		got := findFuncs(funcs, name)
+		if len(got) != 1 {
+			t.Errorf("got %d methods %s", len(got), name)
+			continue
+		}
+		if got[0].Receiver != recv {
+			t.Errorf("%s: receiver %q, want %q", name, got[0].Receiver, recv)
+		}
+	}
+
+	// Respelling a qualified receiver is not a change.
+	respelled := strings.NewReplacer(
+		"func (x *pkg.T) OnQualifiedPtr", "func (x (*pkg.T)) OnQualifiedPtr",
+		"func (x (*pkg.T)) OnParenQualified", "func (x *(pkg.T)) OnParenQualified",
+	).Replace(src)
+	head := collectMem(t, map[string]string{"p/p.go": respelled}, CollectOptions{})
+	diff := diffFuncs(head, funcs, DiffOptions{CompareBodies: true})
+	if len(diff.NewFuncs) != 0 || len(diff.RemovedFuncs) != 0 {
+		t.Errorf("respelled receivers: %d new, %d removed, want none", len(diff.NewFuncs), len(diff.RemovedFuncs))
+	}
+}
+
+func TestCanonicalReportIsByteIdentical(t *testing.T) {
+	base := memSource{name: "master", files: make(map[string]string)}
+	head := memSource{name: "development", files: make(map[string]string)}
+	for p := 0; p < 6; p++ {
+		file := fmt.Sprintf("pkg%d/f.go", p)
+		base.files[file] = fmt.Sprintf("package pkg%d\n\nfunc Gone() {}\n\nfunc Edit() int {\n\treturn %d\n}\n\nfunc Keep() {}\n", p, p)
+		head.files[file] = fmt.Sprintf("package pkg%d\n\nfunc Edit() int {\n\treturn %d\n}\n\nfunc Keep() {}\n\nfunc Added(s string) {}\n", p, p+1)
+	}
+
+	render := func(jobs int) string {
+		ctx := context.Background()
+		collect := CollectOptions{Jobs: jobs}
+		from, _, _, err := collectGoFuncs(ctx, head, "", collect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		to, _, _, err := collectGoFuncs(ctx, base, "", collect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff := diffFuncs(from, to, DiffOptions{CompareBodies: true})
+		opts := ReportOptions{
+			FromRef:    head.name,
+			ToRef:      base.name,
+			FromSource: head,
+			ToSource:   base,
+			Diff:       DiffOptions{CompareBodies: true},
+			Canonical:  true,
+			Blame:      make(map[*FuncInfo]blameInfo),
+		}
+		for _, pair := range diff.ChangedFuncs {
+			opts.Blame[pair[1]] = blameInfo{Author: "a", Commit: "abc1234", Time: time.Date(2026, 3, 14, 9, 0, 0, 0, time.UTC)}
+		}
+
+		var b strings.Builder
+		b.WriteString(buildMarkdownReport(ctx, diff, opts))
+		names := newReportNamer()
+		for _, pair := range diff.ChangedFuncs {
+			name, content := renderChangedFuncFile(ctx, opts, pair[0], pair[1], names)
+			fmt.Fprintf(&b, "\n== %s ==\n%s", name, content)
+		}
+		return b.String()
+	}
+
+	want := render(1)
+	if !strings.Contains(want, "on 2026-03-14") || !strings.Contains(want, "report hash:") {
+		t.Fatalf("report lacks the canonical blame date or report hashes:\n%s", want)
+	}
+	for _, jobs := range []int{1, 4, 16} {
+		for i := 0; i < 3; i++ {
+			if got := render(jobs); got != want {
+				t.Fatalf("--jobs=%d run %d differs from the first run:\n%s\nfirst run:\n%s", jobs, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestDiffHashCoversDocChanges(t *testing.T) {
+	from := &FuncInfo{Package: "p", File: "p/p.go", Name: "F", Exported: true, StartLine: 3, EndLine: 4, Signature: "()", BodyHash: "h"}
+	to := &FuncInfo{Package: "p", File: "p/p.go", Name: "F", Exported: true, StartLine: 4, EndLine: 5, Signature: "()", BodyHash: "h", Doc: "F does a thing.\n"}
+	lost := diffHash(DiffResult{DocChanges: [][2]*FuncInfo{{from, to}}})
+	if lost == diffHash(DiffResult{}) {
+		t.Error("a diff that only drops a doc comment hashes like an empty diff")
+	}
+
+	gainedFrom, gainedTo := *from, *to
+	gainedFrom.Doc, gainedTo.Doc = to.Doc, ""
+	if diffHash(DiffResult{DocChanges: [][2]*FuncInfo{{&gainedFrom, &gainedTo}}}) == lost {
+		t.Error("gaining and losing a doc comment hash alike")
+	}
+}
+
+func TestRenameQualifiers(t *testing.T) {
+	renames := map[string]string{"oldstore": "store"}
+	tests := []struct{ in, want string }{
+		{"{\n\treturn oldstore.Open(p)\n}", "{\n\treturn store.Open(p)\n}"},
+		{"{ oldstore . Open() }", "{ store . Open() }"},
+		{"{ x.oldstore.Open() }", "{ x.oldstore.Open() }"},
+		{"{ oldstore := 1; _ = oldstore }", "{ oldstore := 1; _ = oldstore }"},
+		{"{ log(\"oldstore.Open failed\") }", "{ log(\"oldstore.Open failed\") }"},
+		{"{ s := `oldstore.Open`; _ = s }", "{ s := `oldstore.Open`; _ = s }"},
+		{"{\n\t// oldstore.Open is gone\n\tf() /* oldstore.X */\n}", "{\n\t// oldstore.Open is gone\n\tf() /* oldstore.X */\n}"},
+		{"{ oldstore.A(oldstore.B, \"oldstore.C\") }", "{ store.A(store.B, \"oldstore.C\") }"},
+	}
+	for _, tt := range tests {
+		if got := renameQualifiers(tt.in, renames); got != tt.want {
+			t.Errorf("renameQualifiers(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -68,6 +68,7 @@ async function main() {
           const lineCount = endLine - startLine + 1;
 
           const signature = buildSignature(sourceFile, member);
+          const body = member.body ? member.body.getText(sourceFile) : "";
           const exported = (node.modifiers || []).some(
             (m) => m.kind === ts.SyntaxKind.ExportKeyword
           );
@@ -85,6 +86,7 @@ async function main() {
             startLine,
             endLine,
             lineCount,
+            body,
           });
         });
       }